@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 'credulous agent start' holds decrypted credentials in memory for a
+// while, as ssh-agent does keys, so that 'source' and 'exec' needn't ask
+// for a passphrase every time. It listens on a Unix socket that only its
+// owner can connect to, and answers one JSON request per connection.
+const (
+	AGENT_SOCK_ENV  string = "CREDULOUS_AGENT_SOCK"
+	AGENT_SOCK_FILE string = "agent.sock"
+)
+
+const DEFAULT_AGENT_TTL time.Duration = time.Hour
+
+// how long a client or the agent waits for the other end
+const AGENT_TIMEOUT time.Duration = 5 * time.Second
+
+// how often the agent forgets the credentials that have timed out
+const AGENT_PURGE_INTERVAL time.Duration = 10 * time.Second
+
+const (
+	AGENT_GET    string = "get"
+	AGENT_PUT    string = "put"
+	AGENT_CLEAR  string = "clear"
+	AGENT_LOCK   string = "lock"
+	AGENT_UNLOCK string = "unlock"
+	AGENT_STATUS string = "status"
+)
+
+func agentSocketPath() string {
+	if path := os.Getenv(AGENT_SOCK_ENV); path != "" {
+		return path
+	}
+	return filepath.Join(getRootPath(), AGENT_SOCK_FILE)
+}
+
+// An agentEntry is a set of decrypted credentials, as sent to and from
+// the agent
+type agentEntry struct {
+	IamUsername      string
+	AccountAliasOrId string
+	CreateTime       string
+	LifeTime         int
+	Credential       Credential
+	Expires          time.Time
+}
+
+func newAgentEntry(creds Credentials) agentEntry {
+	return agentEntry{
+		IamUsername:      creds.IamUsername,
+		AccountAliasOrId: creds.AccountAliasOrId,
+		CreateTime:       creds.CreateTime,
+		LifeTime:         creds.LifeTime,
+		Credential:       creds.Encryptions[0].decoded,
+	}
+}
+
+func (entry agentEntry) credentials() Credentials {
+	return Credentials{
+		Version:          FORMAT_VERSION,
+		IamUsername:      entry.IamUsername,
+		AccountAliasOrId: entry.AccountAliasOrId,
+		CreateTime:       entry.CreateTime,
+		LifeTime:         entry.LifeTime,
+		Encryptions:      []Encryption{{decoded: entry.Credential}},
+	}
+}
+
+type agentRequest struct {
+	Op         string
+	Key        string      `json:",omitempty"`
+	Entry      *agentEntry `json:",omitempty"`
+	TTL        int         `json:",omitempty"`
+	Passphrase string      `json:",omitempty"`
+}
+
+type agentStatus struct {
+	Locked  bool
+	Entries []agentStatusEntry
+}
+
+// what the agent says about the credentials it holds, which is nothing
+// secret
+type agentStatusEntry struct {
+	Name    string
+	Expires time.Time
+}
+
+type agentResponse struct {
+	Error  string       `json:",omitempty"`
+	Entry  *agentEntry  `json:",omitempty"`
+	Status *agentStatus `json:",omitempty"`
+}
+
+type credentialAgent struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mutex   sync.Mutex
+	entries map[string]agentEntry
+	// the hash of the passphrase the agent was locked with
+	lock []byte
+}
+
+func newCredentialAgent(ttl time.Duration) *credentialAgent {
+	return &credentialAgent{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]agentEntry{},
+	}
+}
+
+func (agent *credentialAgent) purge() {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	now := agent.now()
+	for key, entry := range agent.entries {
+		if !now.Before(entry.Expires) {
+			delete(agent.entries, key)
+		}
+	}
+}
+
+// wipe forgets everything; as with 'serve', dropping the references is
+// the best Go can do
+func (agent *credentialAgent) wipe() {
+	agent.mutex.Lock()
+	agent.entries = map[string]agentEntry{}
+	agent.mutex.Unlock()
+}
+
+func (agent *credentialAgent) handle(req agentRequest) agentResponse {
+	agent.purge()
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+
+	locked := agent.lock != nil
+	switch req.Op {
+	case AGENT_GET:
+		if locked {
+			return agentResponse{Error: "The agent is locked"}
+		}
+		if entry, ok := agent.entries[req.Key]; ok {
+			return agentResponse{Entry: &entry}
+		}
+		return agentResponse{}
+
+	case AGENT_PUT:
+		if locked {
+			return agentResponse{Error: "The agent is locked"}
+		}
+		if req.Key == "" || req.Entry == nil {
+			return agentResponse{Error: "Nothing to store"}
+		}
+		entry := *req.Entry
+		ttl := agent.ttl
+		if req.TTL > 0 {
+			ttl = time.Duration(req.TTL) * time.Second
+		}
+		entry.Expires = agent.now().Add(ttl)
+		// temporary credentials are no use once they've expired
+		if entry.Credential.Expiration != "" {
+			expiry, err := time.Parse(time.RFC3339, entry.Credential.Expiration)
+			if err != nil {
+				return agentResponse{Error: err.Error()}
+			}
+			if expiry.Before(entry.Expires) {
+				entry.Expires = expiry
+			}
+		}
+		agent.entries[req.Key] = entry
+		return agentResponse{}
+
+	case AGENT_CLEAR:
+		agent.entries = map[string]agentEntry{}
+		return agentResponse{}
+
+	case AGENT_LOCK:
+		if locked {
+			return agentResponse{Error: "The agent is already locked"}
+		}
+		if req.Passphrase == "" {
+			return agentResponse{Error: "A passphrase is needed to lock the agent"}
+		}
+		hash := sha256.Sum256([]byte(req.Passphrase))
+		agent.lock = hash[:]
+		agent.entries = map[string]agentEntry{}
+		return agentResponse{}
+
+	case AGENT_UNLOCK:
+		if !locked {
+			return agentResponse{Error: "The agent is not locked"}
+		}
+		hash := sha256.Sum256([]byte(req.Passphrase))
+		if subtle.ConstantTimeCompare(hash[:], agent.lock) != 1 {
+			return agentResponse{Error: "Incorrect passphrase"}
+		}
+		agent.lock = nil
+		return agentResponse{}
+
+	case AGENT_STATUS:
+		status := agentStatus{Locked: locked, Entries: []agentStatusEntry{}}
+		keys := []string{}
+		for key := range agent.entries {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			entry := agent.entries[key]
+			status.Entries = append(status.Entries, agentStatusEntry{
+				Name:    entry.IamUsername + "@" + entry.AccountAliasOrId,
+				Expires: entry.Expires,
+			})
+		}
+		return agentResponse{Status: &status}
+	}
+	return agentResponse{Error: "Unknown request '" + req.Op + "'"}
+}
+
+func (agent *credentialAgent) serveConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(AGENT_TIMEOUT))
+	var req agentRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(agentResponse{Error: "Invalid request"})
+		return
+	}
+	json.NewEncoder(conn).Encode(agent.handle(req))
+}
+
+// listenAgent refuses to take over the socket of an agent that's still
+// running, and makes sure nobody else can connect to it
+func listenAgent(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, AGENT_TIMEOUT); err == nil {
+			conn.Close()
+			return nil, errors.New("An agent is already listening on " + path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// runAgent answers requests until a signal arrives, then forgets
+// everything and removes its socket
+func runAgent(listener net.Listener, agent *credentialAgent, signals <-chan os.Signal) error {
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				errs <- err
+				return
+			}
+			go agent.serveConn(conn)
+		}
+	}()
+
+	ticker := time.NewTicker(AGENT_PURGE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			agent.purge()
+		case err := <-errs:
+			agent.wipe()
+			return err
+		case <-signals:
+			err := listener.Close()
+			agent.wipe()
+			return err
+		}
+	}
+}
+
+func dialAgent() (net.Conn, error) {
+	return net.DialTimeout("unix", agentSocketPath(), AGENT_TIMEOUT)
+}
+
+func agentRoundTrip(conn net.Conn, req agentRequest) (agentResponse, error) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(AGENT_TIMEOUT))
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return agentResponse{}, err
+	}
+	var resp agentResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return agentResponse{}, err
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// callAgent is for the agent subcommands, which need an agent to talk to
+func callAgent(req agentRequest) (agentResponse, error) {
+	conn, err := dialAgent()
+	if err != nil {
+		return agentResponse{}, errors.New("Unable to connect to the agent at " + agentSocketPath() + "; is it running?")
+	}
+	return agentRoundTrip(conn, req)
+}
+
+// agentKey names credentials by the file they were decrypted from, so
+// that the agent's copy is passed over once they've been rotated
+func agentKey(repo, alias, username string) (string, error) {
+	dir := filepath.Join(repo, alias, username)
+	latest, err := latestFileInDir(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, latest.Name()), nil
+}
+
+// agentGetCredentials returns ok == false if there's no agent, or it
+// doesn't have the credentials
+func agentGetCredentials(repo, alias, username string) (creds Credentials, ok bool) {
+	conn, err := dialAgent()
+	if err != nil {
+		return Credentials{}, false
+	}
+	key, err := agentKey(repo, alias, username)
+	if err != nil {
+		conn.Close()
+		return Credentials{}, false
+	}
+	resp, err := agentRoundTrip(conn, agentRequest{Op: AGENT_GET, Key: key})
+	if err != nil || resp.Entry == nil {
+		return Credentials{}, false
+	}
+	return resp.Entry.credentials(), true
+}
+
+// agentPutCredentials hands the credentials to the agent, if one is
+// running
+func agentPutCredentials(repo, alias, username string, creds Credentials) {
+	conn, err := dialAgent()
+	if err != nil {
+		return
+	}
+	key, err := agentKey(repo, alias, username)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	entry := newAgentEntry(creds)
+	_, err = agentRoundTrip(conn, agentRequest{Op: AGENT_PUT, Key: key, Entry: &entry})
+	if err != nil {
+		log.Print("WARNING: Unable to add the credentials to the agent: " + err.Error())
+	}
+}
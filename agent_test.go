@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCredentialAgent(t *testing.T) {
+	Convey("Test holding credentials in the agent", t, func() {
+		now := time.Date(2014, 6, 12, 0, 0, 0, 0, time.UTC)
+		agent := newCredentialAgent(time.Hour)
+		agent.now = func() time.Time { return now }
+		entry := newAgentEntry(testCredentials())
+
+		resp := agent.handle(agentRequest{Op: AGENT_PUT, Key: "testkey", Entry: &entry})
+		So(resp.Error, ShouldEqual, "")
+		resp = agent.handle(agentRequest{Op: AGENT_GET, Key: "testkey"})
+		So(resp.Error, ShouldEqual, "")
+		So(resp.Entry.credentials().Encryptions[0].decoded.SecretKey, ShouldEqual, "plaintextsecret")
+		So(resp.Entry.credentials().Encryptions[0].decoded.EnvVars["FOO"], ShouldEqual, "bar")
+		So(resp.Entry.credentials().IamUsername, ShouldEqual, "testuser")
+
+		Convey("They're forgotten after the TTL", func() {
+			now = now.Add(time.Hour)
+			resp := agent.handle(agentRequest{Op: AGENT_GET, Key: "testkey"})
+			So(resp.Error, ShouldEqual, "")
+			So(resp.Entry, ShouldBeNil)
+			So(len(agent.entries), ShouldEqual, 0)
+		})
+
+		Convey("Temporary credentials are forgotten when they expire", func() {
+			session := newAgentEntry(testSession(now.Add(10 * time.Minute)))
+			agent.handle(agentRequest{Op: AGENT_PUT, Key: "session", Entry: &session, TTL: 7200})
+			So(agent.entries["session"].Expires, ShouldResemble, now.Add(10*time.Minute))
+		})
+
+		Convey("The status has nothing secret in it", func() {
+			resp := agent.handle(agentRequest{Op: AGENT_STATUS})
+			So(resp.Status.Locked, ShouldBeFalse)
+			So(resp.Status.Entries, ShouldResemble, []agentStatusEntry{{Name: "testuser@testalias", Expires: now.Add(time.Hour)}})
+			b, err := json.Marshal(resp)
+			So(err, ShouldEqual, nil)
+			So(string(b), ShouldNotContainSubstring, "plaintextsecret")
+		})
+
+		Convey("Clearing the agent", func() {
+			agent.handle(agentRequest{Op: AGENT_CLEAR})
+			resp := agent.handle(agentRequest{Op: AGENT_GET, Key: "testkey"})
+			So(resp.Entry, ShouldBeNil)
+		})
+
+		Convey("Locking and unlocking the agent", func() {
+			resp := agent.handle(agentRequest{Op: AGENT_LOCK})
+			So(resp.Error, ShouldNotEqual, "")
+			resp = agent.handle(agentRequest{Op: AGENT_LOCK, Passphrase: "sekrit"})
+			So(resp.Error, ShouldEqual, "")
+			So(len(agent.entries), ShouldEqual, 0)
+
+			resp = agent.handle(agentRequest{Op: AGENT_PUT, Key: "testkey", Entry: &entry})
+			So(resp.Error, ShouldNotEqual, "")
+			resp = agent.handle(agentRequest{Op: AGENT_GET, Key: "testkey"})
+			So(resp.Error, ShouldNotEqual, "")
+			resp = agent.handle(agentRequest{Op: AGENT_UNLOCK, Passphrase: "guess"})
+			So(resp.Error, ShouldNotEqual, "")
+			resp = agent.handle(agentRequest{Op: AGENT_UNLOCK, Passphrase: "sekrit"})
+			So(resp.Error, ShouldEqual, "")
+			resp = agent.handle(agentRequest{Op: AGENT_PUT, Key: "testkey", Entry: &entry})
+			So(resp.Error, ShouldEqual, "")
+		})
+	})
+}
+
+func TestAgentSocket(t *testing.T) {
+	Convey("Test talking to the agent over its socket", t, func() {
+		dir, err := ioutil.TempDir("", "credulous-agent")
+		panic_the_err(err)
+		defer os.RemoveAll(dir)
+		defer os.Setenv(AGENT_SOCK_ENV, os.Getenv(AGENT_SOCK_ENV))
+		path := filepath.Join(dir, "agent.sock")
+		os.Setenv(AGENT_SOCK_ENV, path)
+
+		repo := filepath.Join(dir, "repo")
+		os.MkdirAll(filepath.Join(repo, "testalias", "testuser"), 0700)
+		err = ioutil.WriteFile(filepath.Join(repo, "testalias", "testuser", "1401515273-creds.json"), []byte("{}"), 0600)
+		panic_the_err(err)
+
+		_, ok := agentGetCredentials(repo, "testalias", "testuser")
+		So(ok, ShouldBeFalse)
+
+		listener, err := listenAgent(path)
+		So(err, ShouldEqual, nil)
+		info, err := os.Stat(path)
+		So(err, ShouldEqual, nil)
+		So(info.Mode().Perm(), ShouldEqual, 0600)
+		_, err = listenAgent(path)
+		So(err, ShouldNotEqual, nil)
+
+		signals := make(chan os.Signal, 1)
+		done := make(chan error, 1)
+		go func() {
+			done <- runAgent(listener, newCredentialAgent(time.Hour), signals)
+		}()
+
+		_, ok = agentGetCredentials(repo, "testalias", "testuser")
+		So(ok, ShouldBeFalse)
+		agentPutCredentials(repo, "testalias", "testuser", testCredentials())
+		creds, ok := agentGetCredentials(repo, "testalias", "testuser")
+		So(ok, ShouldBeTrue)
+		So(creds.Encryptions[0].decoded.KeyId, ShouldEqual, "plaintextkeyid")
+
+		Convey("Rotated credentials aren't taken from the agent", func() {
+			err = ioutil.WriteFile(filepath.Join(repo, "testalias", "testuser", "1401515274-creds.json"), []byte("{}"), 0600)
+			panic_the_err(err)
+			_, ok := agentGetCredentials(repo, "testalias", "testuser")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("The agent's errors are passed on", func() {
+			_, err := callAgent(agentRequest{Op: "frobnicate"})
+			So(err, ShouldNotEqual, nil)
+			resp, err := callAgent(agentRequest{Op: AGENT_STATUS})
+			So(err, ShouldEqual, nil)
+			So(len(resp.Status.Entries), ShouldEqual, 1)
+		})
+
+		signals <- os.Interrupt
+		So(<-done, ShouldEqual, nil)
+		_, err = os.Stat(path)
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+}
@@ -5,7 +5,6 @@ import (
 	"reflect"
 	"strings"
 
-	"github.com/realestate-com-au/goamz/aws"
 	"github.com/realestate-com-au/goamz/iam"
 )
 
@@ -15,13 +14,12 @@ type Instancer interface {
 	ListAccountAliases() (*iam.AccountAliasesResp, error)
 }
 
-func getAWSUsernameAndAlias(cred Credential) (username, alias string, err error) {
-	auth := aws.Auth{
-		AccessKey: cred.KeyId,
-		SecretKey: cred.SecretKey,
+func getAWSUsernameAndAlias(cred Credential, config AWSConfig) (username, alias string, err error) {
+	if cred.temporary() {
+		return getSTSUsernameAndAccount(newSTSClient(cred, config))
 	}
-	// Note: the region is irrelevant for IAM
-	instance := iam.New(auth, aws.APSoutheast2)
+
+	instance := config.newIAM(cred)
 	username, err = getAWSUsername(instance)
 	if err != nil {
 		return "", "", err
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsQuery is a minimal client for AWS services that speak the Query
+// protocol, for the APIs goamz doesn't support (notably STS). Requests
+// are signed with Signature Version 4, using the session token if the
+// credentials have one.
+type awsQuery struct {
+	cred     Credential
+	service  string
+	region   string
+	endpoint string
+	version  string
+}
+
+type AWSError struct {
+	Type      string
+	Code      string
+	Message   string
+	RequestId string
+}
+
+func (e *AWSError) Error() string {
+	return fmt.Sprintf("%s: %s (request id %s)", e.Code, e.Message, e.RequestId)
+}
+
+type awsErrorResponse struct {
+	Error struct {
+		Type    string
+		Code    string
+		Message string
+	}
+	RequestId string
+}
+
+// call performs the action with the given parameters, and unmarshals the
+// XML response into response
+func (q awsQuery) call(action string, params url.Values, response interface{}) error {
+	form := url.Values{}
+	for name, values := range params {
+		form[name] = values
+	}
+	form.Set("Action", action)
+	form.Set("Version", q.version)
+	body := form.Encode()
+
+	req, err := http.NewRequest("POST", q.endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	q.sign(req, []byte(body), time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp awsErrorResponse
+		if xml.Unmarshal(data, &errResp) != nil || errResp.Error.Code == "" {
+			return fmt.Errorf("%s %s failed: %s", q.service, action, resp.Status)
+		}
+		return &AWSError{
+			Type:      errResp.Error.Type,
+			Code:      errResp.Error.Code,
+			Message:   errResp.Error.Message,
+			RequestId: errResp.RequestId,
+		}
+	}
+	return xml.Unmarshal(data, response)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds the Signature Version 4 headers to req; every header already
+// set on the request is signed, along with the host
+func (q awsQuery) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if q.cred.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", q.cred.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		trimmed := []string{}
+		for _, value := range values {
+			trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		query,
+		canonicalHeaders,
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := date + "/" + q.region + "/" + q.service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+q.cred.SecretKey), date)
+	key = hmacSHA256(key, q.region)
+	key = hmacSHA256(key, q.service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		q.cred.KeyId, scope, signedHeaders, signature))
+}
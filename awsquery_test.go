@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSignV4(t *testing.T) {
+	Convey("Test Signature Version 4 signing", t, func() {
+		// the "get-vanilla" case from the AWS SigV4 test suite
+		q := awsQuery{
+			cred:    Credential{KeyId: "AKIDEXAMPLE", SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"},
+			service: "service",
+			region:  "us-east-1",
+		}
+		req, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+		panic_the_err(err)
+		q.sign(req, []byte{}, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+		So(req.Header.Get("Authorization"), ShouldEqual, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31")
+
+		Convey("The session token is signed too", func() {
+			q.cred.SessionToken = "token"
+			req, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+			panic_the_err(err)
+			q.sign(req, []byte{}, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+			So(req.Header.Get("X-Amz-Security-Token"), ShouldEqual, "token")
+			So(req.Header.Get("Authorization"), ShouldContainSubstring, "SignedHeaders=host;x-amz-date;x-amz-security-token,")
+		})
+	})
+}
+
+func TestAWSQueryErrors(t *testing.T) {
+	Convey("Test AWS Query error responses", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>ExpiredToken</Code><Message>The security token included in the request is expired</Message></Error><RequestId>abc123</RequestId></ErrorResponse>`))
+		}))
+		defer server.Close()
+
+		q := awsQuery{cred: Credential{KeyId: "AKIAtest", SecretKey: "secret"}, service: "sts", region: "us-east-1", endpoint: server.URL, version: STS_API_VERSION}
+		err := q.call("GetCallerIdentity", nil, &getCallerIdentityResponse{})
+		So(err, ShouldNotEqual, nil)
+		awsErr, ok := err.(*AWSError)
+		So(ok, ShouldBeTrue)
+		So(awsErr.Code, ShouldEqual, "ExpiredToken")
+		So(awsErr.RequestId, ShouldEqual, "abc123")
+	})
+}
@@ -9,10 +9,29 @@
 
 credulous () {
     BINARY=$( type -P credulous )
-    RES=$( $BINARY $@ )
+    # Only 'source' output in the default format is meant for eval'ing;
+    # everything else (notably 'exec', which may run an interactive
+    # command) runs directly
+    if [ "x$1" != "xsource" ]; then
+        $BINARY "$@"
+        return $?
+    fi
+    ACTION="Loading AWS creds into"
+    for ARG in "$@"; do
+        case "$ARG" in
+            -o|-o=*|--format|--format=*)
+                $BINARY "$@"
+                return $?
+                ;;
+            --unset)
+                ACTION="Removing AWS creds from"
+                ;;
+        esac
+    done
+    RES=$( $BINARY "$@" )
     RET=$?
     if [ $RET -eq 0 -a "x$1" = "xsource" ]; then
-        echo -n "Loading AWS creds into current environment..."
+        echo -n "$ACTION current environment..."
         eval "$RES"
         if [ $? -eq 0 ]; then
           echo "OK"
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/realestate-com-au/goamz/aws"
+	"github.com/realestate-com-au/goamz/iam"
+)
+
+// AWSConfig says where to send IAM and STS requests. Each setting is
+// taken from the first of: the global command-line flags, the
+// environment, the config file, and the defaults for the partition.
+type AWSConfig struct {
+	Region      string `json:",omitempty"`
+	Partition   string `json:",omitempty"`
+	IAMEndpoint string `json:",omitempty"`
+	STSEndpoint string `json:",omitempty"`
+}
+
+const CONFIG_FILE string = "config.json"
+
+type awsPartition struct {
+	dnsSuffix     string
+	defaultRegion string
+	// IAM is a global service, with a single endpoint (and region to sign
+	// requests for) in each partition
+	iamEndpoint string
+	iamRegion   string
+}
+
+var AWS_PARTITIONS = map[string]awsPartition{
+	"aws": {
+		dnsSuffix:     "amazonaws.com",
+		defaultRegion: "us-east-1",
+		iamEndpoint:   "https://iam.amazonaws.com/",
+		iamRegion:     "us-east-1",
+	},
+	"aws-us-gov": {
+		dnsSuffix:     "amazonaws.com",
+		defaultRegion: "us-gov-west-1",
+		iamEndpoint:   "https://iam.us-gov.amazonaws.com/",
+		iamRegion:     "us-gov-west-1",
+	},
+	"aws-cn": {
+		dnsSuffix:     "amazonaws.com.cn",
+		defaultRegion: "cn-north-1",
+		iamEndpoint:   "https://iam.cn-north-1.amazonaws.com.cn/",
+		iamRegion:     "cn-north-1",
+	},
+}
+
+func partitionForRegion(region string) string {
+	switch {
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	}
+	return "aws"
+}
+
+func firstOf(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func readConfigFile(filename string) (AWSConfig, error) {
+	var config AWSConfig
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return config, errors.New("Unable to read " + filename + ": " + err.Error())
+	}
+	return config, nil
+}
+
+// resolveAWSConfig layers the flags over the environment over the config
+// file, and fills in whatever's left from the partition's defaults
+func resolveAWSConfig(flags, file AWSConfig, getenv func(string) string) (AWSConfig, error) {
+	config := AWSConfig{
+		Region: firstOf(flags.Region, getenv("CREDULOUS_REGION"),
+			getenv("AWS_REGION"), getenv("AWS_DEFAULT_REGION"), file.Region),
+		Partition: firstOf(flags.Partition, getenv("CREDULOUS_PARTITION"), file.Partition),
+		IAMEndpoint: firstOf(flags.IAMEndpoint, getenv("CREDULOUS_IAM_ENDPOINT"),
+			getenv("AWS_ENDPOINT_URL_IAM"), getenv("AWS_ENDPOINT_URL"), file.IAMEndpoint),
+		STSEndpoint: firstOf(flags.STSEndpoint, getenv("CREDULOUS_STS_ENDPOINT"),
+			getenv("AWS_ENDPOINT_URL_STS"), getenv("AWS_ENDPOINT_URL"), file.STSEndpoint),
+	}
+
+	if config.Partition == "" {
+		config.Partition = partitionForRegion(config.Region)
+	}
+	partition, ok := AWS_PARTITIONS[config.Partition]
+	if !ok {
+		return AWSConfig{}, errors.New("Unknown AWS partition " + config.Partition)
+	}
+	if config.Region == "" {
+		config.Region = partition.defaultRegion
+	}
+	if config.IAMEndpoint == "" {
+		config.IAMEndpoint = partition.iamEndpoint
+	}
+	if config.STSEndpoint == "" {
+		config.STSEndpoint = "https://sts." + config.Region + "." + partition.dnsSuffix + "/"
+	}
+	return config, nil
+}
+
+func parseAWSConfigArgs(c *cli.Context) (AWSConfig, error) {
+	flags := AWSConfig{
+		Region:      c.GlobalString("region"),
+		Partition:   c.GlobalString("partition"),
+		IAMEndpoint: c.GlobalString("iam-endpoint"),
+		STSEndpoint: c.GlobalString("sts-endpoint"),
+	}
+	file, err := readConfigFile(filepath.Join(getRootPath(), CONFIG_FILE))
+	if err != nil {
+		return AWSConfig{}, err
+	}
+	return resolveAWSConfig(flags, file, os.Getenv)
+}
+
+// iamRegion is the region IAM requests are signed for
+func (config AWSConfig) iamRegion() string {
+	if partition, ok := AWS_PARTITIONS[config.Partition]; ok {
+		return partition.iamRegion
+	}
+	return config.Region
+}
+
+func (config AWSConfig) newIAM(cred Credential) *iam.IAM {
+	auth := aws.Auth{
+		AccessKey: cred.KeyId,
+		SecretKey: cred.SecretKey,
+	}
+	region := aws.Region{
+		Name:        config.iamRegion(),
+		IAMEndpoint: strings.TrimSuffix(config.IAMEndpoint, "/"),
+	}
+	return iam.New(auth, region)
+}
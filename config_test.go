@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testGetenv(env map[string]string) func(string) string {
+	return func(name string) string {
+		return env[name]
+	}
+}
+
+func TestResolveAWSConfig(t *testing.T) {
+	Convey("Test resolving the AWS configuration", t, func() {
+		Convey("Defaults", func() {
+			config, err := resolveAWSConfig(AWSConfig{}, AWSConfig{}, testGetenv(nil))
+			So(err, ShouldEqual, nil)
+			So(config, ShouldResemble, AWSConfig{
+				Region:      "us-east-1",
+				Partition:   "aws",
+				IAMEndpoint: "https://iam.amazonaws.com/",
+				STSEndpoint: "https://sts.us-east-1.amazonaws.com/",
+			})
+			So(config.iamRegion(), ShouldEqual, "us-east-1")
+		})
+
+		Convey("The partition follows the region", func() {
+			config, err := resolveAWSConfig(AWSConfig{Region: "us-gov-east-1"}, AWSConfig{}, testGetenv(nil))
+			So(err, ShouldEqual, nil)
+			So(config.Partition, ShouldEqual, "aws-us-gov")
+			So(config.IAMEndpoint, ShouldEqual, "https://iam.us-gov.amazonaws.com/")
+			So(config.STSEndpoint, ShouldEqual, "https://sts.us-gov-east-1.amazonaws.com/")
+			So(config.iamRegion(), ShouldEqual, "us-gov-west-1")
+
+			config, err = resolveAWSConfig(AWSConfig{Partition: "aws-cn"}, AWSConfig{}, testGetenv(nil))
+			So(err, ShouldEqual, nil)
+			So(config.Region, ShouldEqual, "cn-north-1")
+			So(config.STSEndpoint, ShouldEqual, "https://sts.cn-north-1.amazonaws.com.cn/")
+		})
+
+		Convey("Flags override the environment, which overrides the file", func() {
+			file := AWSConfig{Region: "eu-west-1", IAMEndpoint: "http://file:5000"}
+			env := map[string]string{"AWS_DEFAULT_REGION": "ap-southeast-2", "AWS_ENDPOINT_URL": "http://localhost:4566"}
+			config, err := resolveAWSConfig(AWSConfig{}, file, testGetenv(env))
+			So(err, ShouldEqual, nil)
+			So(config.Region, ShouldEqual, "ap-southeast-2")
+			So(config.IAMEndpoint, ShouldEqual, "http://localhost:4566")
+			So(config.STSEndpoint, ShouldEqual, "http://localhost:4566")
+
+			env["CREDULOUS_IAM_ENDPOINT"] = "http://localhost:5000"
+			config, err = resolveAWSConfig(AWSConfig{Region: "us-west-2"}, file, testGetenv(env))
+			So(err, ShouldEqual, nil)
+			So(config.Region, ShouldEqual, "us-west-2")
+			So(config.IAMEndpoint, ShouldEqual, "http://localhost:5000")
+		})
+
+		Convey("Unknown partitions", func() {
+			_, err := resolveAWSConfig(AWSConfig{Partition: "aws-moon"}, AWSConfig{}, testGetenv(nil))
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+
+	Convey("Test reading the config file", t, func() {
+		dir, err := ioutil.TempDir("", "credulous-config")
+		panic_the_err(err)
+		defer os.RemoveAll(dir)
+		filename := filepath.Join(dir, CONFIG_FILE)
+
+		config, err := readConfigFile(filename)
+		So(err, ShouldEqual, nil)
+		So(config, ShouldResemble, AWSConfig{})
+
+		err = ioutil.WriteFile(filename, []byte(`{"Partition": "aws-us-gov", "IAMEndpoint": "http://localhost:5000"}`), 0600)
+		panic_the_err(err)
+		config, err = readConfigFile(filename)
+		So(err, ShouldEqual, nil)
+		So(config.Partition, ShouldEqual, "aws-us-gov")
+
+		err = ioutil.WriteFile(filename, []byte(`not json`), 0600)
+		panic_the_err(err)
+		_, err = readConfigFile(filename)
+		So(err, ShouldNotEqual, nil)
+	})
+
+	Convey("Test IAM connections use the configured endpoint", t, func() {
+		config := AWSConfig{Region: "us-east-1", Partition: "aws", IAMEndpoint: "http://localhost:5000/"}
+		instance := config.newIAM(Credential{KeyId: "AKIAtest", SecretKey: "secret"})
+		So(instance.Region.IAMEndpoint, ShouldEqual, "http://localhost:5000")
+		So(instance.Auth.AccessKey, ShouldEqual, "AKIAtest")
+	})
+}
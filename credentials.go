@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,13 +14,13 @@ import (
 	"strings"
 	"time"
 
-	"github.com/realestate-com-au/goamz/aws"
-	"github.com/realestate-com-au/goamz/iam"
-
-	"code.google.com/p/go.crypto/ssh"
+	"golang.org/x/crypto/ssh"
 )
 
-const FORMAT_VERSION string = "2014-06-12"
+// Credentials written in this format are encrypted with AES-GCM, with
+// the unencrypted metadata bound to each ciphertext as additional data.
+// Older formats are still readable, but are never written.
+const FORMAT_VERSION string = "2026-10-16"
 
 // How long to retry after rotating credentials for
 // new credentials to become active (in seconds)
@@ -36,17 +37,46 @@ type Credentials struct {
 
 type Encryption struct {
 	Fingerprint string
-	Ciphertext  string
+	// the SSH key type, eg. "ssh-rsa" or "ssh-ed25519"; empty in
+	// credentials saved before other key types were supported
+	KeyType string
+	// empty if the private key decrypts Ciphertext directly, or
+	// SCHEME_AGENT if it must be decrypted via an ssh-agent
+	Scheme     string
+	Ciphertext string
 	// we can do this because the field isn't exported
 	// and so won't be included when we call Marshal to
 	// save the encrypted credentials
 	decoded Credential
+	// likewise, the public key of the SSH key that decrypted them
+	pubkey ssh.PublicKey
 }
 
 type Credential struct {
 	KeyId     string
 	SecretKey string
-	EnvVars   map[string]string
+	// only temporary credentials, as issued by STS, have a session token,
+	// and an expiry time in RFC 3339 format
+	SessionToken string `json:",omitempty"`
+	Expiration   string `json:",omitempty"`
+	EnvVars      map[string]string
+}
+
+func (cred Credential) temporary() bool {
+	return cred.SessionToken != ""
+}
+
+// expired reports whether the credentials were past their expiry time at
+// now; credentials without one never expire
+func (cred Credential) expired(now time.Time) (bool, error) {
+	if cred.Expiration == "" {
+		return false, nil
+	}
+	expiry, err := time.Parse(time.RFC3339, cred.Expiration)
+	if err != nil {
+		return false, err
+	}
+	return !now.Before(expiry), nil
 }
 
 type OldCredential struct {
@@ -69,6 +99,7 @@ type SaveData struct {
 	force    bool
 	repo     string
 	isRepo   bool
+	config   AWSConfig
 }
 
 func decodeOldCredential(data []byte, keyfile string) (*OldCredential, error) {
@@ -78,7 +109,11 @@ func decodeOldCredential(data []byte, keyfile string) (*OldCredential, error) {
 		return nil, err
 	}
 
-	privKey, err := loadPrivateKey(keyfile)
+	signer, err := loadPrivateKey(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	privKey, err := rsaPrivateKey(signer)
 	if err != nil {
 		return nil, err
 	}
@@ -135,19 +170,49 @@ func parseCredential(data []byte, keyfile string) (*Credentials, error) {
 		return nil, err
 	}
 
-	privKey, err := loadPrivateKey(keyfile)
+	var tmp string
+	var pubkey ssh.PublicKey
+	if creds.Version == FORMAT_VERSION {
+		additionalData, err := creds.additionalData()
+		if err != nil {
+			return nil, err
+		}
+		// use the ssh-agent if we can, so the private key need never be read
+		tmp, pubkey = decryptWithAgent(creds, additionalData)
+	}
+
+	if tmp == "" {
+		tmp, pubkey, err = decryptWithKeyfile(creds, keyfile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var cred Credential
+	err = json.Unmarshal([]byte(tmp), &cred)
 	if err != nil {
 		return nil, err
 	}
 
-	fp, err := SSHPrivateFingerprint(*privKey)
+	creds.Encryptions[0].decoded = cred
+	creds.Encryptions[0].pubkey = pubkey
+	return &creds, nil
+}
+
+func decryptWithKeyfile(creds Credentials, keyfile string) (string, ssh.PublicKey, error) {
+	privKey, err := loadPrivateKey(keyfile)
 	if err != nil {
-		return nil, err
+		return "", nil, err
+	}
+
+	pubkey, err := sshPublicKey(privKey)
+	if err != nil {
+		return "", nil, err
 	}
 
 	var offset int = -1
 	for i, enc := range creds.Encryptions {
-		if enc.Fingerprint == fp {
+		if fingerprintMatches(enc.Fingerprint, pubkey) && enc.Scheme == "" {
 			offset = i
 			break
 		}
@@ -155,30 +220,57 @@ func parseCredential(data []byte, keyfile string) (*Credentials, error) {
 
 	if offset < 0 {
 		err := errors.New("The SSH key specified cannot decrypt those credentials")
-		return nil, err
+		return "", nil, err
 	}
 
 	var tmp string
+	var rsaKey *rsa.PrivateKey
 	switch {
 	case creds.Version == "2014-05-31":
 		log.Print("INFO: These credentials are in the old format; re-run 'credulous save' now to remove this warning")
-		tmp, err = CredulousDecodePureRSA(creds.Encryptions[offset].Ciphertext, privKey)
+		if rsaKey, err = rsaPrivateKey(privKey); err == nil {
+			tmp, err = CredulousDecodePureRSA(creds.Encryptions[offset].Ciphertext, rsaKey)
+		}
 	case creds.Version == "2014-06-12":
-		tmp, err = CredulousDecodeAES(creds.Encryptions[offset].Ciphertext, privKey)
-	}
-
-	if err != nil {
-		return nil, err
+		log.Print("INFO: These credentials are in the old format; re-run 'credulous save' now to remove this warning")
+		if rsaKey, err = rsaPrivateKey(privKey); err == nil {
+			tmp, err = CredulousDecodeAES(creds.Encryptions[offset].Ciphertext, rsaKey)
+		}
+	case creds.Version == FORMAT_VERSION:
+		var additionalData []byte
+		additionalData, err = creds.additionalData()
+		if err != nil {
+			return "", nil, err
+		}
+		tmp, err = CredulousDecodeAESGCM(creds.Encryptions[offset].Ciphertext, privKey, additionalData)
+	default:
+		err = errors.New("Unknown credential format version " + creds.Version)
 	}
 
-	var cred Credential
-	err = json.Unmarshal([]byte(tmp), &cred)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
+	return tmp, pubkey, nil
+}
 
-	creds.Encryptions[0].decoded = cred
-	return &creds, nil
+// additionalData returns the metadata which is authenticated, but not
+// encrypted, along with each ciphertext; changing any of it (say, to make
+// credentials appear to belong to a different account) makes decryption fail
+func (cred Credentials) additionalData() ([]byte, error) {
+	metadata := struct {
+		Version          string
+		IamUsername      string
+		AccountAliasOrId string
+		CreateTime       string
+		LifeTime         int
+	}{
+		Version:          cred.Version,
+		IamUsername:      cred.IamUsername,
+		AccountAliasOrId: cred.AccountAliasOrId,
+		CreateTime:       cred.CreateTime,
+		LifeTime:         cred.LifeTime,
+	}
+	return json.Marshal(metadata)
 }
 
 func readCredentialFile(fileName string, keyfile string) (*Credentials, error) {
@@ -205,6 +297,10 @@ func readCredentialFile(fileName string, keyfile string) (*Credentials, error) {
 }
 
 func (cred Credentials) WriteToDisk(repo, filename string) (err error) {
+	return cred.writeAndCommit(repo, filename, "Added by Credulous")
+}
+
+func (cred Credentials) writeAndCommit(repo, filename, message string) (err error) {
 	b, err := json.Marshal(cred)
 	if err != nil {
 		return err
@@ -223,34 +319,79 @@ func (cred Credentials) WriteToDisk(repo, filename string) (err error) {
 		return nil
 	}
 	relpath := filepath.Join(cred.AccountAliasOrId, cred.IamUsername, filename)
-	_, err = gitAddCommitFile(repo, relpath, "Added by Credulous")
+	_, err = gitAddCommitFile(repo, relpath, message)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+type envVar struct {
+	name  string
+	value string
+}
+
+// environment returns the variables these credentials set: the AWS keys
+// (and session token, if any), followed by any saved along with them, in name order
+func (cred Credentials) environment() []envVar {
+	decoded := cred.Encryptions[0].decoded
+	vars := []envVar{
+		{"AWS_ACCESS_KEY_ID", decoded.KeyId},
+		{"AWS_SECRET_ACCESS_KEY", decoded.SecretKey},
+	}
+	if decoded.SessionToken != "" {
+		vars = append(vars, envVar{"AWS_SESSION_TOKEN", decoded.SessionToken})
+	}
+
+	names := []string{}
+	for name := range decoded.EnvVars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		vars = append(vars, envVar{name, decoded.EnvVars[name]})
+	}
+	return vars
+}
+
 func (cred OldCredential) Display(output io.Writer) {
 	fmt.Fprintf(output, "export AWS_ACCESS_KEY_ID=\"%v\"\nexport AWS_SECRET_ACCESS_KEY=\"%v\"\n", cred.KeyId, cred.SecretKey)
 }
 
 func (cred Credentials) Display(output io.Writer) {
-	fmt.Fprintf(output, "export AWS_ACCESS_KEY_ID=\"%v\"\nexport AWS_SECRET_ACCESS_KEY=\"%v\"\n",
-		cred.Encryptions[0].decoded.KeyId, cred.Encryptions[0].decoded.SecretKey)
-	for key, val := range cred.Encryptions[0].decoded.EnvVars {
-		fmt.Fprintf(output, "export %s=\"%s\"\n", key, val)
+	cred.DisplayAs(output, posixFormat{})
+}
+
+func (cred Credentials) DisplayAs(output io.Writer, format OutputFormat) error {
+	return format.Set(output, cred.environment())
+}
+
+// DisplayUnset clears the AWS variables, including any left over from
+// temporary credentials, and those saved along with these credentials
+func (cred Credentials) DisplayUnset(output io.Writer, format OutputFormat) error {
+	names := append([]string{}, AWS_ENV_VARS...)
+	for _, v := range cred.environment() {
+		found := false
+		for _, name := range names {
+			if name == v.name {
+				found = true
+			}
+		}
+		if !found {
+			names = append(names, v.name)
+		}
 	}
+	return format.Unset(output, names)
 }
 
-func (creds Credentials) verifyUserAndAccount() error {
+func (creds Credentials) verifyUserAndAccount(config AWSConfig) error {
+	if creds.Encryptions[0].decoded.temporary() {
+		return creds.verifyTemporaryUserAndAccount(config)
+	}
+
 	// need to check both the username and the account alias for the
 	// supplied creds match the passed-in username and account alias
-	auth := aws.Auth{
-		AccessKey: creds.Encryptions[0].decoded.KeyId,
-		SecretKey: creds.Encryptions[0].decoded.SecretKey,
-	}
-	// Note: the region is irrelevant for IAM
-	instance := iam.New(auth, aws.APSoutheast2)
+	instance := config.newIAM(creds.Encryptions[0].decoded)
 
 	// Make sure the account is who we expect
 	err := verify_account(creds.AccountAliasOrId, instance)
@@ -273,108 +414,16 @@ func (creds Credentials) verifyUserAndAccount() error {
 	return nil
 }
 
-// Only delete the oldest key *if* the new key is valid; otherwise,
-// delete the newest key
-func (cred *Credential) deleteOneKey(username string) (err error) {
-	auth := aws.Auth{
-		AccessKey: cred.KeyId,
-		SecretKey: cred.SecretKey,
-	}
-	instance := iam.New(auth, aws.APSoutheast2)
-
-	allKeys, err := instance.AccessKeys(username)
-	if err != nil {
-		return err
-	}
-
-	// wtf?
-	if len(allKeys.AccessKeys) == 0 {
-		err = errors.New("Zero access keys found for this account -- cannot rotate")
-		return err
-	}
-
-	// only one key
-	if len(allKeys.AccessKeys) == 1 {
-		return nil
-	}
-
-	// Find out which key to delete.
-	var oldestId string
-	var oldest int64
-
-	for _, key := range allKeys.AccessKeys {
-		t, err := time.Parse("2006-01-02T15:04:05Z", key.CreateDate)
-		key_create_date := t.Unix()
-		if err != nil {
-			return err
-		}
-		// If we find an inactive one, just delete it
-		if key.Status == "Inactive" {
-			oldestId = key.Id
-			break
-		}
-		if oldest == 0 || key_create_date < oldest {
-			oldest = key_create_date
-			oldestId = key.Id
-		}
-	}
-
-	if oldestId == "" {
-		err = errors.New("Cannot find oldest key for this account, will not rotate")
-		return err
-	}
-
-	_, err = instance.DeleteAccessKey(oldestId, username)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (cred *Credential) createNewAccessKey(username string) (err error) {
-	auth := aws.Auth{
-		AccessKey: cred.KeyId,
-		SecretKey: cred.SecretKey,
-	}
-	instance := iam.New(auth, aws.APSoutheast2)
-
-	resp, err := instance.CreateAccessKey(username)
-	if err != nil {
-		return err
-	}
-
-	cred.KeyId = resp.AccessKey.Id
-	cred.SecretKey = resp.AccessKey.Secret
-	return nil
-}
-
-// Potential conditions to handle here:
-// * AWS has one key
-//     * only generate a new key, do not delete the old one
-// * AWS has two keys
-//     * both are active and valid
-//     * new one is inactive
-//     * old one is inactive
-// * We successfully delete the oldest key, but fail in creating the new key (eg network, permission issues)
-func (cred *Credential) rotateCredentials(username string) (err error) {
-	err = cred.deleteOneKey(username)
-	if err != nil {
-		return err
-	}
-	err = cred.createNewAccessKey(username)
+func (creds Credentials) verifyTemporaryUserAndAccount(config AWSConfig) error {
+	username, account, err := getSTSUsernameAndAccount(newSTSClient(creds.Encryptions[0].decoded, config))
 	if err != nil {
 		return err
 	}
-	// Loop until the credentials are active
-	count := 0
-	for _, _, err = getAWSUsernameAndAlias(*cred); err != nil && count < ROTATE_TIMEOUT; _, _, err = getAWSUsernameAndAlias(*cred) {
-		time.Sleep(1 * time.Second)
-		count += 1
+	if account != creds.AccountAliasOrId {
+		return errors.New("Cannot verify account: does not match account " + creds.AccountAliasOrId)
 	}
-	if err != nil {
-		err = errors.New("Timed out waiting for new credentials to become active")
-		return err
+	if username != creds.IamUsername {
+		return errors.New("Cannot verify user: credentials are not for " + creds.IamUsername)
 	}
 	return nil
 }
@@ -385,9 +434,24 @@ func SaveCredentials(data SaveData) (err error) {
 
 	if data.force {
 		key_create_date = time.Now().Unix()
+	} else if data.cred.temporary() {
+		// temporary credentials have no IAM access key to take a date from.
+		// They're always saved as STS identifies them, since that's what
+		// they're checked against when they're used
+		username, account, err := getSTSUsernameAndAccount(newSTSClient(data.cred, data.config))
+		if err != nil {
+			return err
+		}
+		if data.username != "" && data.username != username {
+			log.Print("WARNING: saving temporary credentials as " + username + ", who STS says they belong to, rather than " + data.username)
+		}
+		if data.alias != "" && data.alias != account {
+			log.Print("WARNING: saving temporary credentials under the account ID " + account + " rather than " + data.alias)
+		}
+		data.username, data.alias = username, account
+		key_create_date = time.Now().Unix()
 	} else {
-		auth := aws.Auth{AccessKey: data.cred.KeyId, SecretKey: data.cred.SecretKey}
-		instance := iam.New(auth, aws.APSoutheast2)
+		instance := data.config.newIAM(data.cred)
 		if data.username == "" {
 			data.username, err = getAWSUsername(instance)
 			if err != nil {
@@ -409,38 +473,89 @@ func SaveCredentials(data SaveData) (err error) {
 		}
 	}
 
+	// temporary credentials last until they expire, which can then be seen
+	// without decrypting them
+	if data.lifetime == 0 && data.cred.Expiration != "" {
+		expiry, err := time.Parse(time.RFC3339, data.cred.Expiration)
+		if err != nil {
+			return err
+		}
+		data.lifetime = int(expiry.Unix() - key_create_date)
+		if data.lifetime < 1 {
+			data.lifetime = 1
+		}
+	}
+
 	fmt.Printf("saving credentials for %s@%s\n", data.username, data.alias)
 	plaintext, err := json.Marshal(data.cred)
 	if err != nil {
 		return err
 	}
 
-	enc_slice := []Encryption{}
-	for _, pubkey := range data.pubkeys {
-		encoded, err := CredulousEncode(string(plaintext), pubkey)
-		if err != nil {
-			return err
-		}
-
-		enc_slice = append(enc_slice, Encryption{
-			Ciphertext:  encoded,
-			Fingerprint: SSHFingerprint(pubkey),
-		})
-	}
 	creds := Credentials{
 		Version:          FORMAT_VERSION,
 		AccountAliasOrId: data.alias,
 		IamUsername:      data.username,
 		CreateTime:       fmt.Sprintf("%d", key_create_date),
-		Encryptions:      enc_slice,
 		LifeTime:         data.lifetime,
 	}
+	err = creds.encrypt(plaintext, data.pubkeys)
+	if err != nil {
+		return err
+	}
 
 	filename := fmt.Sprintf("%v-%v.json", key_create_date, data.cred.KeyId[12:])
 	err = creds.WriteToDisk(data.repo, filename)
 	return err
 }
 
+// encrypt sets the encryptions of plaintext for each of the public keys,
+// and for the ssh-agent where it holds them; the metadata must be set first
+func (creds *Credentials) encrypt(plaintext []byte, pubkeys []ssh.PublicKey) error {
+	additionalData, err := creds.additionalData()
+	if err != nil {
+		return err
+	}
+
+	sshAgent, conn := connectSSHAgent()
+	if sshAgent != nil {
+		defer conn.Close()
+	}
+
+	enc_slice := []Encryption{}
+	for _, pubkey := range pubkeys {
+		encoded, err := CredulousEncode(string(plaintext), pubkey, additionalData)
+		if err != nil {
+			return err
+		}
+
+		enc_slice = append(enc_slice, Encryption{
+			Ciphertext:  encoded,
+			Fingerprint: SSHFingerprint(pubkey),
+			KeyType:     pubkey.Type(),
+		})
+
+		if sshAgent == nil {
+			continue
+		}
+		encoded, ok, err := agentEncode(string(plaintext), pubkey, additionalData, sshAgent)
+		if err != nil {
+			log.Print("WARNING: Not saving an ssh-agent-decryptable copy: " + err.Error())
+			continue
+		}
+		if ok {
+			enc_slice = append(enc_slice, Encryption{
+				Ciphertext:  encoded,
+				Fingerprint: SSHFingerprint(pubkey),
+				KeyType:     pubkey.Type(),
+				Scheme:      SCHEME_AGENT,
+			})
+		}
+	}
+	creds.Encryptions = enc_slice
+	return nil
+}
+
 type FileLister interface {
 	Readdir(int) ([]os.FileInfo, error)
 	Name() string
@@ -454,7 +569,8 @@ func getDirs(fl FileLister) ([]os.FileInfo, error) {
 
 	dirs := []os.FileInfo{}
 	for _, dirent := range dirents {
-		if dirent.IsDir() {
+		// hidden directories (.git, .roles and so on) never hold credentials
+		if dirent.IsDir() && !strings.HasPrefix(dirent.Name(), ".") {
 			dirs = append(dirs, dirent)
 		}
 	}
@@ -478,7 +594,7 @@ func findDefaultDir(fl FileLister) (string, error) {
 	return dirs[0].Name(), nil
 }
 
-func (cred Credentials) ValidateCredentials(alias string, username string) error {
+func (cred Credentials) ValidateCredentials(alias string, username string, config AWSConfig) error {
 	if cred.IamUsername != username {
 		err := errors.New("FATAL: username in credential does not match requested username")
 		return err
@@ -488,7 +604,16 @@ func (cred Credentials) ValidateCredentials(alias string, username string) error
 		return err
 	}
 
-	err := cred.verifyUserAndAccount()
+	decoded := cred.Encryptions[0].decoded
+	expired, err := decoded.expired(time.Now())
+	if err != nil {
+		return err
+	}
+	if expired {
+		return errors.New("These temporary credentials expired at " + decoded.Expiration)
+	}
+
+	err = cred.verifyUserAndAccount(config)
 	if err != nil {
 		return err
 	}
@@ -496,6 +621,28 @@ func (cred Credentials) ValidateCredentials(alias string, username string) error
 }
 
 func RetrieveCredentials(rootPath string, alias string, username string, keyfile string) (Credentials, error) {
+	alias, username = findDefaultCredentials(rootPath, alias, username)
+
+	fullPath := filepath.Join(rootPath, alias, username)
+	latest, err := latestFileInDir(fullPath)
+	if err != nil {
+		return Credentials{}, err
+	}
+	filePath := filepath.Join(fullPath, latest.Name())
+	if err = verifyIfRequired(rootPath, filepath.Join(alias, username, latest.Name())); err != nil {
+		return Credentials{}, err
+	}
+	cred, err := readCredentialFile(filePath, keyfile)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	return *cred, nil
+}
+
+// findDefaultCredentials fills in the alias and username, if they weren't
+// given, when there's only one to choose from
+func findDefaultCredentials(rootPath string, alias string, username string) (string, string) {
 	rootDir, err := os.Open(rootPath)
 	if err != nil {
 		panic_the_err(err)
@@ -517,26 +664,20 @@ func RetrieveCredentials(rootPath string, alias string, username string, keyfile
 			panic_the_err(err)
 		}
 	}
-
-	fullPath := filepath.Join(rootPath, alias, username)
-	latest, err := latestFileInDir(fullPath)
-	if err != nil {
-		return Credentials{}, err
-	}
-	filePath := filepath.Join(fullPath, latest.Name())
-	cred, err := readCredentialFile(filePath, keyfile)
-	if err != nil {
-		return Credentials{}, err
-	}
-
-	return *cred, nil
+	return alias, username
 }
 
+// errNoCredentialsSaved is returned for a user's directory with nothing
+// in it, so that callers can tell it from one that can't be read
+var errNoCredentialsSaved = errors.New("No credentials have been saved for that user and account; please run 'credulous save' first")
+
 func latestFileInDir(dir string) (os.FileInfo, error) {
 	entries, err := ioutil.ReadDir(dir)
-	panic_the_err(err)
+	if err != nil {
+		return nil, err
+	}
 	if len(entries) == 0 {
-		return nil, errors.New("No credentials have been saved for that user and account; please run 'credulous save' first")
+		return nil, errNoCredentialsSaved
 	}
 	return entries[len(entries)-1], nil
 }
@@ -1,11 +1,12 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 	"time"
 	. "github.com/smartystreets/goconvey/convey"
-	// "io/ioutil"
 	// "fmt"
 )
 
@@ -96,6 +97,17 @@ func TestGetDirs(t *testing.T) {
 			So(err, ShouldEqual, nil)
 			So(len(ents), ShouldEqual, 4)
 		})
+		Convey("Test hidden dirs are skipped", func() {
+			i := []os.FileInfo{}
+			i = append(i, &TestFileInfo{isDir: true, name: ".git"})
+			i = append(i, &TestFileInfo{isDir: true, name: ".roles"})
+			i = append(i, &TestFileInfo{isDir: true, name: "foo"})
+			t := TestFileList{testList: i}
+			ents, err := getDirs(&t)
+			So(err, ShouldEqual, nil)
+			So(len(ents), ShouldEqual, 1)
+			So(ents[0].Name(), ShouldEqual, "foo")
+		})
 	})
 }
 
@@ -144,6 +156,49 @@ func TestValidateCredentials(t *testing.T) {
 		// the best way to have implemented that function.
 		// goamz provides an iamtest package, and we should
 		// use that.
+
+		Convey("Expired temporary credentials are rejected", func() {
+			creds := testCredentials()
+			creds.Encryptions[0].decoded.SessionToken = "token"
+			creds.Encryptions[0].decoded.Expiration = "2014-06-12T00:00:00Z"
+			err := creds.ValidateCredentials("testalias", "testuser", AWSConfig{})
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "expired")
+		})
+	})
+}
+
+func TestTemporaryCredentials(t *testing.T) {
+	Convey("Test temporary credentials", t, func() {
+		cred := Credential{KeyId: "ASIAtest", SecretKey: "secret", SessionToken: "token"}
+		So(cred.temporary(), ShouldBeTrue)
+		So(Credential{KeyId: "AKIAtest"}.temporary(), ShouldBeFalse)
+
+		Convey("Expiry", func() {
+			now := time.Date(2014, 6, 12, 0, 0, 0, 0, time.UTC)
+			expired, err := cred.expired(now)
+			So(err, ShouldEqual, nil)
+			So(expired, ShouldBeFalse)
+
+			cred.Expiration = "2014-06-12T01:00:00Z"
+			expired, err = cred.expired(now)
+			So(err, ShouldEqual, nil)
+			So(expired, ShouldBeFalse)
+			expired, err = cred.expired(now.Add(time.Hour))
+			So(err, ShouldEqual, nil)
+			So(expired, ShouldBeTrue)
+
+			cred.Expiration = "tomorrow"
+			_, err = cred.expired(now)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("The session token is exported", func() {
+			creds := Credentials{Encryptions: []Encryption{{decoded: cred}}}
+			testWriter := TestWriter{}
+			creds.Display(&testWriter)
+			So(string(testWriter.Written), ShouldEqual, "export AWS_ACCESS_KEY_ID=\"ASIAtest\"\nexport AWS_SECRET_ACCESS_KEY=\"secret\"\nexport AWS_SESSION_TOKEN=\"token\"\n")
+		})
 	})
 }
 
@@ -170,6 +225,22 @@ func TestReadFile(t *testing.T) {
 			So(cred.Encryptions[0].decoded.KeyId, ShouldEqual, "plaintextkeyid")
 			So(cred.Encryptions[0].decoded.SecretKey, ShouldEqual, "plaintextsecret")
 		})
+		Convey("Valid AEAD Json returns Credentials", func() {
+			cred, err := readCredentialFile("testdata/aeadcreds.json", "testdata/testkey")
+			So(err, ShouldEqual, nil)
+			So(cred.Version, ShouldEqual, FORMAT_VERSION)
+			So(cred.IamUsername, ShouldEqual, "testuser")
+			So(cred.AccountAliasOrId, ShouldEqual, "testalias")
+			So(cred.Encryptions[0].decoded.KeyId, ShouldEqual, "plaintextkeyid")
+			So(cred.Encryptions[0].decoded.SecretKey, ShouldEqual, "plaintextsecret")
+		})
+		Convey("AEAD Json with modified metadata fails to decrypt", func() {
+			b, err := ioutil.ReadFile("testdata/aeadcreds.json")
+			panic_the_err(err)
+			tampered := strings.Replace(string(b), "\"testalias\"", "\"otheralias\"", 1)
+			_, err = parseCredential([]byte(tampered), "testdata/testkey")
+			So(err, ShouldNotEqual, nil)
+		})
 		Convey("New credentials display correctly", func() {
 			cred, err := readCredentialFile("testdata/newcreds.json", "testdata/testkey")
 			testWriter := TestWriter{}
@@ -1,19 +1,21 @@
 package main
 
 import (
-	"crypto/x509"
-	"encoding/pem"
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"path"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"syscall"
+	"time"
 
-	"code.google.com/p/go.crypto/ssh"
+	"golang.org/x/crypto/ssh"
 
 	"code.google.com/p/gopass"
 	"github.com/codegangsta/cli"
@@ -21,10 +23,59 @@ import (
 
 const ENV_PATTERN string = "^[A-Za-z_][A-Za-z0-9_]*=.*"
 
-func decryptPEM(pemblock *pem.Block, filename string) ([]byte, error) {
+// The SSH keys in ~/.ssh to use, in order of preference, if none is specified
+var DEFAULT_SSH_KEYS = []string{"id_rsa", "id_ed25519", "id_ecdsa"}
+
+func defaultSSHKey() string {
+	for _, name := range DEFAULT_SSH_KEYS {
+		filename := filepath.Join(os.Getenv("HOME"), ".ssh", name)
+		if _, err := os.Stat(filename); err == nil {
+			return filename
+		}
+	}
+	return filepath.Join(os.Getenv("HOME"), ".ssh", DEFAULT_SSH_KEYS[0])
+}
+
+// Without a terminal to prompt on (as when the AWS CLI runs 'credulous
+// process', capturing its stderr), the passphrase is asked of the program
+// named in the first of these variables that is set, as ssh does. It's
+// run with the prompt as its argument, and should print the passphrase.
+var ASKPASS_VARS = []string{"CREDULOUS_ASKPASS", "SSH_ASKPASS"}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func askPassphrase(prompt string) ([]byte, error) {
+	for _, name := range ASKPASS_VARS {
+		program := os.Getenv(name)
+		if program == "" {
+			continue
+		}
+		cmd := exec.Command(program, prompt)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", program, err)
+		}
+		return bytes.TrimRight(out, "\r\n"), nil
+	}
+	return nil, errors.New("There is no terminal to read the passphrase from; add the key to ssh-agent, or set CREDULOUS_ASKPASS to a program that prints it")
+}
+
+func readPassphrase(filename string) ([]byte, error) {
+	return promptPassphrase(fmt.Sprintf("Enter passphrase for %s: ", filename))
+}
+
+func promptPassphrase(prompt string) ([]byte, error) {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stderr) {
+		return askPassphrase(prompt)
+	}
+
 	var err error
-	if _, err = fmt.Fprintf(os.Stderr, "Enter passphrase for %s: ", filename); err != nil {
-		return []byte(""), err
+	if _, err = fmt.Fprint(os.Stderr, prompt); err != nil {
+		return nil, err
 	}
 
 	// we already emit the prompt to stderr; GetPass only emits to stdout
@@ -32,25 +83,14 @@ func decryptPEM(pemblock *pem.Block, filename string) ([]byte, error) {
 	passwd, err = gopass.GetPass("")
 	fmt.Fprintln(os.Stderr, "")
 	if err != nil {
-		return []byte(""), err
-	}
-
-	var decryptedBytes []byte
-	if decryptedBytes, err = x509.DecryptPEMBlock(pemblock, []byte(passwd)); err != nil {
-		return []byte(""), err
-	}
-
-	pemBytes := pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: decryptedBytes,
+		return nil, err
 	}
-	decryptedPEM := pem.EncodeToMemory(&pemBytes)
-	return decryptedPEM, nil
+	return []byte(passwd), nil
 }
 
 func getPrivateKey(c *cli.Context) (filename string) {
 	if c.String("key") == "" {
-		filename = filepath.Join(os.Getenv("HOME"), "/.ssh/id_rsa")
+		filename = defaultSSHKey()
 	} else {
 		filename = c.String("key")
 	}
@@ -69,7 +109,16 @@ func splitUserAndAccount(arg string) (string, string, error) {
 
 func getAccountAndUserName(c *cli.Context) (string, string, error) {
 	if len(c.Args()) > 0 {
-		user, acct, err := splitUserAndAccount(c.Args()[0])
+		return getAccountAndUserNameFrom(c, c.Args()[0])
+	}
+	return getAccountAndUserNameFrom(c, "")
+}
+
+// getAccountAndUserNameFrom prefers arg (if it isn't empty) to the
+// --credentials, --account and --username flags
+func getAccountAndUserNameFrom(c *cli.Context, arg string) (string, string, error) {
+	if arg != "" {
+		user, acct, err := splitUserAndAccount(arg)
 		if err != nil {
 			return "", "", err
 		}
@@ -150,10 +199,12 @@ func readSSHPubkeyFile(filename string) (pubkey ssh.PublicKey, err error) {
 	return pubkey, nil
 }
 
+// parseKeyArgs reads the public keys given with --key, and those of the
+// recipients in the repository's keyring given with --recipient
 func parseKeyArgs(c *cli.Context) (pubkeys []ssh.PublicKey, err error) {
 	// no args, so just use the default
-	if len(c.StringSlice("key")) == 0 {
-		pubkey, err := readSSHPubkeyFile(filepath.Join(os.Getenv("HOME"), "/.ssh/id_rsa.pub"))
+	if len(c.StringSlice("key")) == 0 && len(c.StringSlice("recipient")) == 0 {
+		pubkey, err := readSSHPubkeyFile(defaultSSHKey() + ".pub")
 		if err != nil {
 			return nil, err
 		}
@@ -168,29 +219,315 @@ func parseKeyArgs(c *cli.Context) (pubkeys []ssh.PublicKey, err error) {
 		}
 		pubkeys = append(pubkeys, pubkey)
 	}
-	return pubkeys, nil
+
+	if len(c.StringSlice("recipient")) == 0 {
+		return pubkeys, nil
+	}
+	repo, err := parseRepoArgs(c)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := readKeyring(repo)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := keyring.resolve(c.StringSlice("recipient"))
+	if err != nil {
+		return nil, err
+	}
+	return append(pubkeys, resolved...), nil
 }
 
-// parseLifetimeArgs attempts to be a little clever in determining what credential
-// lifetime you've chosen. It returns a number of hours and an error. It assumes that
-// the argument was passed in as hours.
+// parseLifetimeArgs returns the lifetime chosen for the credentials in
+// seconds, which can be given as a number of seconds, or as a duration
+// such as 90d or 12h. The default is zero, meaning forever.
 func parseLifetimeArgs(c *cli.Context) (lifetime int, err error) {
-	// the default is zero, which is our default
-	if c.Int("lifetime") < 0 {
-		return 0, nil
+	d, err := parseDuration(c.String("lifetime"))
+	if err != nil {
+		return 0, err
 	}
-
-	return c.Int("lifetime"), nil
+	if d < 0 {
+		return 0, errors.New("The credential lifetime cannot be negative")
+	}
+	return int(d / time.Second), nil
 }
 
+// parseRepoArgs takes the name of a repository in ~/.credulous (the
+// default repository if none is given), or else a path to one. --repo
+// used to take only paths, so a directory of that name in the current
+// directory is still used, with a warning.
 func parseRepoArgs(c *cli.Context) (repo string, err error) {
-	// the default is 'local' which is set below, so not much to do here
-	if c.String("repo") == "local" {
-		repo = path.Join(getRootPath(), "local")
-	} else {
-		repo = c.String("repo")
+	repo = c.String("repo")
+	if repo == "" {
+		repo, err = defaultRepo(filepath.Join(getRootPath(), CONFIG_FILE))
+		if err != nil {
+			return "", err
+		}
+	} else if isRepoName(repo) {
+		abs, _ := filepath.Abs(repo)
+		if info, err := os.Stat(repo); err == nil && info.IsDir() && abs != repoPath(repo) {
+			log.Print("WARNING: --repo " + repo + " is taken to be the directory ./" + repo +
+				"; in future it will name the repository in ~/.credulous, so please give ./" + repo + " instead")
+			return repo, nil
+		}
+	}
+	if !isRepoName(repo) {
+		return repo, nil
+	}
+	if _, err = os.Stat(repoPath(repo)); err != nil && repo != DEFAULT_REPO {
+		return "", errors.New("No repository named '" + repo + "'; create one with 'credulous repo init'")
+	}
+	return repoPath(repo), nil
+}
+
+func isRepoName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsRune(name, filepath.Separator)
+}
+
+func parseCloneArgs(c *cli.Context) (url, repo string, err error) {
+	if len(c.Args()) != 2 {
+		return "", "", errors.New("Please specify the URL of the repository to clone, and a name for it")
+	}
+	if !isRepoName(c.Args()[1]) {
+		return "", "", errors.New("Invalid repository name '" + c.Args()[1] + "'")
+	}
+	return c.Args()[0], repoPath(c.Args()[1]), nil
+}
+
+// parseRotateAllArgs sets up 'rotate --all'; the public keys given with
+// --key are only candidates for the recipients of the rotated credentials
+func parseRotateAllArgs(c *cli.Context) (*autoRotator, error) {
+	if len(c.StringSlice("env")) > 0 {
+		return nil, errors.New("Environment variables can't be set with --all; each set of credentials keeps its own")
+	}
+	repo, err := parseRepoArgs(c)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := candidateRecipients(c.StringSlice("key"), repo)
+	if err != nil {
+		return nil, err
+	}
+	olderThan, err := parseDuration(c.String("older-than"))
+	if err != nil {
+		return nil, err
+	}
+	lifetime, err := parseLifetimeArgs(c)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseAWSConfigArgs(c)
+	if err != nil {
+		return nil, err
+	}
+	keyfile := c.String("identity")
+	if keyfile == "" {
+		keyfile = defaultSSHKey()
+	}
+	return &autoRotator{
+		repo:       repo,
+		keyfile:    keyfile,
+		candidates: candidates,
+		policy:     rotationPolicy{olderThan: olderThan},
+		lifetime:   lifetime,
+		dryRun:     c.Bool("dry-run"),
+		config:     config,
+		now:        time.Now,
+		rotate:     rotateCredentials,
+	}, nil
+}
+
+// parseRekeyArgs sets up 'rekey'. --add takes the names of recipients or
+// groups in the keyring, or public key files; --remove takes names in the
+// keyring, or fingerprints. --key and --recipient give everyone to
+// encrypt for instead.
+func parseRekeyArgs(c *cli.Context) (*rekeyer, error) {
+	replace := len(c.StringSlice("key")) > 0 || len(c.StringSlice("recipient")) > 0
+	change := len(c.StringSlice("add")) > 0 || len(c.StringSlice("remove")) > 0
+	if replace == change {
+		return nil, errors.New("Please give the recipients to add with --add and remove with --remove, " +
+			"or else all of them with --key and --recipient")
+	}
+	repo, err := parseRepoArgs(c)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := readKeyring(repo)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := candidateRecipients(nil, repo)
+	if err != nil {
+		return nil, err
+	}
+	keyfile := c.String("identity")
+	if keyfile == "" {
+		keyfile = defaultSSHKey()
+	}
+	r := &rekeyer{
+		repo:       repo,
+		keyfile:    keyfile,
+		candidates: candidates,
+		dryRun:     c.Bool("dry-run"),
+	}
+	if replace {
+		if r.replace, err = parseKeyArgs(c); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	for _, name := range c.StringSlice("add") {
+		if !keyring.has(name) {
+			pubkey, err := readSSHPubkeyFile(name)
+			if err != nil {
+				return nil, errors.New("No recipient or group named '" + name + "', and " + err.Error())
+			}
+			r.add = append(r.add, pubkey)
+			continue
+		}
+		pubkeys, err := keyring.resolve([]string{name})
+		if err != nil {
+			return nil, err
+		}
+		r.add = append(r.add, pubkeys...)
+	}
+	for _, name := range c.StringSlice("remove") {
+		if !keyring.has(name) {
+			if !strings.HasPrefix(name, "SHA256:") && strings.Count(name, ":") != 15 {
+				return nil, errors.New("No recipient or group named '" + name + "', and it isn't a fingerprint")
+			}
+			r.remove = append(r.remove, name)
+			continue
+		}
+		pubkeys, err := keyring.resolve([]string{name})
+		if err != nil {
+			return nil, err
+		}
+		for _, pubkey := range pubkeys {
+			r.remove = append(r.remove, SSHFingerprint(pubkey), SSHFingerprintMD5(pubkey))
+		}
+	}
+	return r, nil
+}
+
+// parseRotateArgs sets up rotating the credentials in the environment,
+// which are saved for the same keys and with the same environment
+// variables and lifetime as the latest saved for the user, apart from
+// what's given with --key, --env and --lifetime
+func parseRotateArgs(c *cli.Context) (SaveData, error) {
+	cred, err := credentialFromEnvironment()
+	if err != nil {
+		return SaveData{}, errors.New("Can't rotate, " + err.Error())
+	}
+	if cred.temporary() {
+		return SaveData{}, errors.New("Temporary credentials cannot be rotated; they have no IAM access key")
+	}
+	env, err := parseEnvironmentArgs(c)
+	if err != nil {
+		return SaveData{}, err
+	}
+	lifetime, err := parseLifetimeArgs(c)
+	if err != nil {
+		return SaveData{}, err
+	}
+	repo, err := parseRepoArgs(c)
+	if err != nil {
+		return SaveData{}, err
+	}
+	config, err := parseAWSConfigArgs(c)
+	if err != nil {
+		return SaveData{}, err
+	}
+	username, account, err := getAWSUsernameAndAlias(cred, config)
+	if err != nil {
+		return SaveData{}, err
+	}
+	data := SaveData{
+		cred:     cred,
+		username: username,
+		alias:    account,
+		lifetime: lifetime,
+		repo:     repo,
+		config:   config,
+	}
+
+	var candidates []ssh.PublicKey
+	if len(c.StringSlice("key")) > 0 || len(c.StringSlice("recipient")) > 0 {
+		if data.pubkeys, err = parseKeyArgs(c); err != nil {
+			return SaveData{}, err
+		}
+	} else if candidates, err = candidateRecipients(nil, repo); err != nil {
+		return SaveData{}, err
+	}
+	keyfile := c.String("identity")
+	if keyfile == "" {
+		keyfile = defaultSSHKey()
+	}
+	saved, err := inheritSaved(&data, env, c.String("lifetime") != "", keyfile, candidates)
+	if err != nil {
+		return SaveData{}, err
+	}
+	// the first time, they're saved as they would be by 'save'
+	if !saved && len(data.pubkeys) == 0 {
+		if data.pubkeys, err = parseKeyArgs(c); err != nil {
+			return SaveData{}, err
+		}
+	}
+	return data, nil
+}
+
+// resumeRotations finishes, or with --rollback undoes, the interrupted
+// rotations of the credentials given as an argument, or of all of them
+func resumeRotations(c *cli.Context) error {
+	journals, err := readJournals(journalDir())
+	if err != nil {
+		return err
+	}
+	if len(c.Args()) > 0 {
+		username, account, err := splitUserAndAccount(c.Args()[0])
+		if err != nil {
+			return err
+		}
+		selected := []rotationJournal{}
+		for _, journal := range journals {
+			if journal.Username == username && journal.Alias == account {
+				selected = append(selected, journal)
+			}
+		}
+		journals = selected
+	}
+	if len(journals) == 0 {
+		return errors.New("No interrupted rotations found")
+	}
+	config, err := parseAWSConfigArgs(c)
+	if err != nil {
+		return err
+	}
+	keyfile := c.String("identity")
+	if keyfile == "" {
+		keyfile = defaultSSHKey()
+	}
+
+	failed := 0
+	for _, journal := range journals {
+		r := resumeRotation(journalDir(), journal, keyfile, config)
+		if c.Bool("rollback") {
+			fmt.Printf("rolling back the rotation of %s\n", journal.name())
+			err = r.rollback()
+		} else {
+			fmt.Printf("resuming the rotation of %s at the %s step\n", journal.name(), journal.Step)
+			err = r.resume()
+		}
+		if err != nil {
+			log.Print("WARNING: " + err.Error())
+			failed++
+		}
 	}
-	return repo, nil
+	if failed > 0 {
+		return fmt.Errorf("%d of %d rotations could not be finished", failed, len(journals))
+	}
+	return nil
 }
 
 func parseSaveArgs(c *cli.Context) (cred Credential, username, account string, pubkeys []ssh.PublicKey, lifetime int, repo string, err error) {
@@ -219,21 +556,270 @@ func parseSaveArgs(c *cli.Context) (cred Credential, username, account string, p
 		return Credential{}, "", "", nil, 0, "", err
 	}
 
-	AWSAccessKeyId := os.Getenv("AWS_ACCESS_KEY_ID")
-	AWSSecretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
-	if AWSAccessKeyId == "" || AWSSecretAccessKey == "" {
-		err := errors.New("Can't save, no credentials in the environment")
+	cred, err = credentialFromEnvironment()
+	if err != nil {
+		return Credential{}, "", "", nil, 0, "", errors.New("Can't save, " + err.Error())
+	}
+	cred.EnvVars = envmap
+
+	return cred, username, account, pubkeys, lifetime, repo, nil
+}
+
+// credentialFromEnvironment reads the AWS credentials in the environment,
+// including the session token and its expiry if they are temporary
+func credentialFromEnvironment() (Credential, error) {
+	cred := Credential{
+		KeyId:        os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Expiration:   os.Getenv("AWS_CREDENTIAL_EXPIRATION"),
+	}
+	if cred.KeyId == "" || cred.SecretKey == "" {
+		return Credential{}, errors.New("no credentials in the environment")
+	}
+	// older tools use the name AWS_SECURITY_TOKEN
+	if cred.SessionToken == "" {
+		cred.SessionToken = os.Getenv("AWS_SECURITY_TOKEN")
+	}
+	if cred.Expiration != "" {
+		if _, err := time.Parse(time.RFC3339, cred.Expiration); err != nil {
+			return Credential{}, errors.New("AWS_CREDENTIAL_EXPIRATION is not an RFC 3339 time: " + cred.Expiration)
+		}
+	}
+	return cred, nil
+}
+
+// A credentialSource is what's been decrypted for 'source', 'exec' or
+// 'serve', along with what's needed to turn it into the credentials to
+// hand out, so that session credentials can be renewed without
+// decrypting anything again
+type credentialSource struct {
+	creds   Credentials
+	profile *RoleProfile
+	config  AWSConfig
+}
+
+// credentials returns the source credentials, or with a role profile,
+// new session credentials for the role
+func (source credentialSource) credentials() (Credentials, error) {
+	// with --mfa too, the role is assumed using the MFA session
+	if source.profile != nil {
+		return assumeRoleProfile(source.creds, *source.profile, source.config)
+	}
+	return source.creds, nil
+}
+
+// loadCredentials decrypts the credentials for 'source' and 'exec', and
+// unless --force was given, checks that they are what they claim to be.
+// With --mfa or --role (or both), it returns session credentials instead.
+func loadCredentials(c *cli.Context, arg string) (Credentials, error) {
+	source, err := loadCredentialSource(c, arg)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return source.credentials()
+}
+
+func loadCredentialSource(c *cli.Context, arg string) (credentialSource, error) {
+	keyfile := getPrivateKey(c)
+	repo, err := parseRepoArgs(c)
+	if err != nil {
+		return credentialSource{}, err
+	}
+	config, err := parseAWSConfigArgs(c)
+	if err != nil {
+		return credentialSource{}, err
+	}
+
+	var profile *RoleProfile
+	if c.String("role") != "" {
+		found, err := readRoleProfile(repo, c.String("role"))
 		if err != nil {
-			return Credential{}, "", "", nil, 0, "", err
+			return credentialSource{}, err
+		}
+		profile = &found
+		// the profile's source credentials are only a default
+		if arg == "" && c.String("credentials") == "" && c.String("account") == "" && c.String("username") == "" {
+			arg = profile.Source
 		}
 	}
-	cred = Credential{
-		KeyId:     AWSAccessKeyId,
-		SecretKey: AWSSecretAccessKey,
-		EnvVars:   envmap,
+
+	account, username, err := getAccountAndUserNameFrom(c, arg)
+	if err != nil {
+		return credentialSource{}, err
 	}
+	account, username = findDefaultCredentials(repo, account, username)
 
-	return cred, username, account, pubkeys, lifetime, repo, nil
+	var creds Credentials
+	if c.Bool("mfa") && !c.Bool("unset") {
+		creds, err = loadMFASession(repo, account, username, keyfile, MFAOptions{
+			serial:       c.String("mfa-serial"),
+			code:         c.String("mfa-code"),
+			duration:     c.Int("mfa-duration"),
+			force:        c.Bool("force"),
+			ignoreExpiry: c.Bool("ignore-expiry"),
+			config:       config,
+		})
+		if err != nil {
+			return credentialSource{}, err
+		}
+	} else if cached, ok := agentGetCredentials(repo, account, username); ok {
+		// the agent is only given credentials that have been validated
+		creds = cached
+		if !c.Bool("unset") {
+			err = creds.checkLifetime(time.Now(), c.Bool("ignore-expiry"))
+			if err != nil {
+				return credentialSource{}, err
+			}
+		}
+	} else {
+		creds, err = RetrieveCredentials(repo, account, username, keyfile)
+		if err != nil {
+			return credentialSource{}, err
+		}
+
+		// there's no point checking credentials that are only being unset
+		if c.Bool("unset") {
+			return credentialSource{creds: creds, config: config}, nil
+		}
+		err = creds.checkLifetime(time.Now(), c.Bool("ignore-expiry"))
+		if err != nil {
+			return credentialSource{}, err
+		}
+		if !c.Bool("force") {
+			err = creds.ValidateCredentials(account, username, config)
+			if err != nil {
+				return credentialSource{}, err
+			}
+			agentPutCredentials(repo, account, username, creds)
+		}
+	}
+	return credentialSource{creds: creds, profile: profile, config: config}, nil
+}
+
+// credentialProcessCommand is the 'credulous process' command that loads
+// the same credentials as 'export' would write out. The AWS SDKs run it
+// through a shell, from any directory, so each argument is quoted, and
+// paths are made absolute.
+func credentialProcessCommand(c *cli.Context, arg string) (string, error) {
+	args := []string{"credulous", "process"}
+	// a role profile knows its own source credentials
+	needsCredentials := arg != "" || c.String("credentials") != "" || c.String("account") != "" ||
+		c.String("username") != "" || c.String("role") == ""
+	repo := ""
+	if needsCredentials || c.String("repo") != "" {
+		var err error
+		if repo, err = parseRepoArgs(c); err != nil {
+			return "", err
+		}
+	}
+	if needsCredentials {
+		account, username, err := getAccountAndUserNameFrom(c, arg)
+		if err != nil {
+			return "", err
+		}
+		account, username = findDefaultCredentials(repo, account, username)
+		args = append(args, username+"@"+account)
+	}
+	if c.String("repo") != "" {
+		abs, err := filepath.Abs(repo)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "--repo", abs)
+	}
+	if c.String("key") != "" {
+		keyfile, err := filepath.Abs(c.String("key"))
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "--key", keyfile)
+	}
+	if c.String("role") != "" {
+		args = append(args, "--role", c.String("role"))
+	}
+	if c.Bool("force") {
+		args = append(args, "--force")
+	}
+	if c.Bool("ignore-expiry") {
+		args = append(args, "--ignore-expiry")
+	}
+	return shellJoin(args), nil
+}
+
+func parseRoleProfileArgs(c *cli.Context) (RoleProfile, error) {
+	if len(c.Args()) != 1 {
+		return RoleProfile{}, errors.New("Please specify a single role profile name")
+	}
+	if c.String("arn") == "" {
+		return RoleProfile{}, errors.New("Please specify the ARN of the role with --arn")
+	}
+	profile := RoleProfile{
+		Name:            c.Args()[0],
+		RoleArn:         c.String("arn"),
+		ExternalId:      c.String("external-id"),
+		SessionName:     c.String("session-name"),
+		DurationSeconds: c.Int("duration"),
+		Source:          c.String("source"),
+	}
+	return profile, profile.validate()
+}
+
+func parseRecipientArgs(c *cli.Context) (Recipient, error) {
+	if len(c.Args()) != 1 {
+		return Recipient{}, errors.New("Please specify a single recipient name")
+	}
+	keyfile := c.String("key")
+	if keyfile == "" {
+		keyfile = defaultSSHKey() + ".pub"
+	}
+	recipient, err := newRecipient(c.Args()[0], c.String("email"), keyfile)
+	if err != nil {
+		return Recipient{}, err
+	}
+	recipient.PGPFingerprint = normalizePGPFingerprint(c.String("pgp-fingerprint"))
+	return recipient, nil
+}
+
+// parseSigningArgs changes how commits are signed and credentials
+// verified, as the options say
+func parseSigningArgs(c *cli.Context, repo string) error {
+	signing := 0
+	for _, set := range []bool{c.String("ssh-key") != "", c.String("gpg-key") != "", c.Bool("no-sign")} {
+		if set {
+			signing++
+		}
+	}
+	if signing > 1 {
+		return errors.New("Please specify only one of --ssh-key, --gpg-key and --no-sign")
+	}
+	if c.Bool("verify") && c.Bool("no-verify") {
+		return errors.New("Please specify only one of --verify and --no-verify")
+	}
+
+	var err error
+	switch {
+	case c.String("ssh-key") != "":
+		var keyfile string
+		if keyfile, err = filepath.Abs(c.String("ssh-key")); err != nil {
+			return err
+		}
+		if _, err = readSSHPubkeyFile(strings.TrimSuffix(keyfile, ".pub") + ".pub"); err != nil {
+			return err
+		}
+		err = gitSetSigning(repo, "ssh", keyfile)
+	case c.String("gpg-key") != "":
+		err = gitSetSigning(repo, "openpgp", c.String("gpg-key"))
+	case c.Bool("no-sign"):
+		err = gitSetSigning(repo, "", "")
+	}
+	if err != nil {
+		return err
+	}
+	if c.Bool("verify") || c.Bool("no-verify") {
+		return gitSetVerifySignatures(repo, c.Bool("verify"))
+	}
+	return nil
 }
 
 func main() {
@@ -242,6 +828,29 @@ func main() {
 	app.Usage = "Secure AWS Credential Management"
 	app.Version = "0.2.2"
 
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "region",
+			Value: "",
+			Usage: "\n        AWS region for STS requests (us-east-1 by default)",
+		},
+		cli.StringFlag{
+			Name:  "partition",
+			Value: "",
+			Usage: "\n        AWS partition: aws, aws-us-gov or aws-cn (from the region by default)",
+		},
+		cli.StringFlag{
+			Name:  "iam-endpoint",
+			Value: "",
+			Usage: "\n        URL of the IAM API endpoint",
+		},
+		cli.StringFlag{
+			Name:  "sts-endpoint",
+			Value: "",
+			Usage: "\n        URL of the STS API endpoint",
+		},
+	}
+
 	app.Commands = []cli.Command{
 		{
 			Name:  "save",
@@ -252,15 +861,20 @@ func main() {
 					Value: &cli.StringSlice{},
 					Usage: "\n        SSH public keys for encryption",
 				},
+				cli.StringSliceFlag{
+					Name:  "recipient, R",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Recipients or groups in the repository's keyring to encrypt for",
+				},
 				cli.StringSliceFlag{
 					Name:  "env, e",
 					Value: &cli.StringSlice{},
 					Usage: "\n        Environment variables to set in the form VAR=value",
 				},
-				cli.IntFlag{
+				cli.StringFlag{
 					Name:  "lifetime, l",
-					Value: 0,
-					Usage: "\n        Credential lifetime in seconds (0 means forever)",
+					Value: "",
+					Usage: "\n        Credential lifetime, in seconds or as a duration such as 90d or 12h (forever by default)",
 				},
 				cli.BoolFlag{
 					Name: "force, f",
@@ -279,13 +893,15 @@ func main() {
 				},
 				cli.StringFlag{
 					Name:  "repo, r",
-					Value: "local",
-					Usage: "\n        Repository location ('local' by default)",
+					Value: "",
+					Usage: "\n        Repository name or path (the default repository if not given)",
 				},
 			},
 			Action: func(c *cli.Context) {
 				cred, username, account, pubkeys, lifetime, repo, err := parseSaveArgs(c)
 				panic_the_err(err)
+				config, err := parseAWSConfigArgs(c)
+				panic_the_err(err)
 				err = SaveCredentials(SaveData{
 					cred:     cred,
 					username: username,
@@ -294,8 +910,10 @@ func main() {
 					lifetime: lifetime,
 					force:    c.Bool("force"),
 					repo:     repo,
+					config:   config,
 				})
 				panic_the_err(err)
+				syncAfterSave(repo)
 			},
 		},
 
@@ -327,34 +945,897 @@ func main() {
 					Name:  "force, f",
 					Usage: "\n        Force sourcing of credentials without validating username or account",
 				},
+				cli.BoolFlag{
+					Name:  "ignore-expiry",
+					Usage: "\n        Use the credentials even if their lifetime has run out",
+				},
 				cli.StringFlag{
 					Name:  "repo, r",
-					Value: "local",
-					Usage: "\n        Repository location ('local' by default)",
+					Value: "",
+					Usage: "\n        Repository name or path (the default repository if not given)",
 				},
-			},
-			Action: func(c *cli.Context) {
-				keyfile := getPrivateKey(c)
-				account, username, err := getAccountAndUserName(c)
-				if err != nil {
-					panic_the_err(err)
+				cli.StringFlag{
+					Name:  "role",
+					Value: "",
+					Usage: "\n        Assume the role in this role profile (or with this ARN), using the credentials",
+				},
+				cli.BoolFlag{
+					Name:  "mfa",
+					Usage: "\n        Use MFA session credentials, prompting for an MFA code unless a session is cached",
+				},
+				cli.StringFlag{
+					Name:  "mfa-serial",
+					Value: "",
+					Usage: "\n        ARN or serial number of the MFA device (the user's virtual MFA device by default)",
+				},
+				cli.StringFlag{
+					Name:  "mfa-code",
+					Value: "",
+					Usage: "\n        The current MFA code, instead of prompting for it",
+				},
+				cli.IntFlag{
+					Name:  "mfa-duration",
+					Value: 0,
+					Usage: "\n        MFA session duration in seconds (12 hours if 0)",
+				},
+				cli.StringFlag{
+					Name:  "format, o",
+					Value: DEFAULT_OUTPUT_FORMAT,
+					Usage: "\n        Output format: bash, zsh, sh, fish, powershell, cmd, dotenv or json",
+				},
+				cli.BoolFlag{
+					Name:  "unset",
+					Usage: "\n        Output statements that clear the credentials from the environment",
+				},
+			},
+			Action: func(c *cli.Context) {
+				var arg string
+				if len(c.Args()) > 0 {
+					arg = c.Args()[0]
 				}
-				repo, err := parseRepoArgs(c)
-				if err != nil {
-					panic_the_err(err)
+				format, err := getOutputFormat(c.String("format"))
+				panic_the_err(err)
+				creds, err := loadCredentials(c, arg)
+				panic_the_err(err)
+				if c.Bool("unset") {
+					err = creds.DisplayUnset(os.Stdout, format)
+				} else {
+					err = creds.DisplayAs(os.Stdout, format)
 				}
-				creds, err := RetrieveCredentials(repo, account, username, keyfile)
-				if err != nil {
-					panic_the_err(err)
+				panic_the_err(err)
+			},
+		},
+
+		{
+			Name:  "exec",
+			Usage: "Run a command with AWS credentials in its environment\n        exec [username@account] -- command [args...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "account, a",
+					Value: "",
+					Usage: "\n        AWS Account alias or id",
+				},
+				cli.StringFlag{
+					Name:  "key, k",
+					Value: "",
+					Usage: "\n        SSH private key",
+				},
+				cli.StringFlag{
+					Name:  "username, u",
+					Value: "",
+					Usage: "\n        IAM User",
+				},
+				cli.StringFlag{
+					Name:  "credentials, c",
+					Value: "",
+					Usage: "\n        Credentials, for example username@account",
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "\n        Force use of credentials without validating username or account",
+				},
+				cli.BoolFlag{
+					Name:  "ignore-expiry",
+					Usage: "\n        Use the credentials even if their lifetime has run out",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (the default repository if not given)",
+				},
+				cli.StringFlag{
+					Name:  "role",
+					Value: "",
+					Usage: "\n        Assume the role in this role profile (or with this ARN), using the credentials",
+				},
+				cli.BoolFlag{
+					Name:  "mfa",
+					Usage: "\n        Use MFA session credentials, prompting for an MFA code unless a session is cached",
+				},
+				cli.StringFlag{
+					Name:  "mfa-serial",
+					Value: "",
+					Usage: "\n        ARN or serial number of the MFA device (the user's virtual MFA device by default)",
+				},
+				cli.StringFlag{
+					Name:  "mfa-code",
+					Value: "",
+					Usage: "\n        The current MFA code, instead of prompting for it",
+				},
+				cli.IntFlag{
+					Name:  "mfa-duration",
+					Value: 0,
+					Usage: "\n        MFA session duration in seconds (12 hours if 0)",
+				},
+			},
+			Action: func(c *cli.Context) {
+				arg, command, err := splitExecArgs(c.Args())
+				panic_the_err(err)
+				creds, err := loadCredentials(c, arg)
+				panic_the_err(err)
+				status, err := runWithCredentials(creds, command)
+				panic_the_err(err)
+				os.Exit(status)
+			},
+		},
+
+		{
+			Name:  "import",
+			Usage: "Save the credentials in the AWS CLI's shared credentials and config files\n        import [profile...]",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "key, k",
+					Value: &cli.StringSlice{},
+					Usage: "\n        SSH public keys for encryption",
+				},
+				cli.StringSliceFlag{
+					Name:  "recipient, R",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Recipients or groups in the repository's keyring to encrypt for",
+				},
+				cli.StringFlag{
+					Name:  "lifetime, l",
+					Value: "",
+					Usage: "\n        Credential lifetime, in seconds or as a duration such as 90d or 12h (forever by default)",
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "\n        Save without checking with AWS whose credentials they are, going by the profile names",
+				},
+				cli.StringFlag{
+					Name:  "account, a",
+					Value: "",
+					Usage: "\n        With --force, the account for profiles not named username@account",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (the default repository if not given)",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.String("account") != "" && !c.Bool("force") {
+					panic_the_err(errors.New("Cannot specify the account without force"))
 				}
+				pubkeys, err := parseKeyArgs(c)
+				panic_the_err(err)
+				lifetime, err := parseLifetimeArgs(c)
+				panic_the_err(err)
+				repo, err := parseRepoArgs(c)
+				panic_the_err(err)
+				config, err := parseAWSConfigArgs(c)
+				panic_the_err(err)
 
-				if !c.Bool("force") {
-					err = creds.ValidateCredentials(account, username)
+				profiles, err := readSharedProfiles(sharedCredentialsPath(), sharedConfigPath())
+				panic_the_err(err)
+				profiles, err = selectProfiles(profiles, []string(c.Args()))
+				panic_the_err(err)
+				if len(profiles) == 0 {
+					panic_the_err(errors.New("No credentials found in " + sharedCredentialsPath() + " or " + sharedConfigPath()))
+				}
+				failed := 0
+				for _, profile := range profiles {
+					err = importProfile(profile, SaveData{
+						alias:    c.String("account"),
+						pubkeys:  pubkeys,
+						lifetime: lifetime,
+						force:    c.Bool("force"),
+						repo:     repo,
+						config:   config,
+					})
 					if err != nil {
-						panic_the_err(err)
+						log.Print("WARNING: Unable to import the profile '" + profile.name + "': " + err.Error())
+						failed += 1
 					}
 				}
-				creds.Display(os.Stdout)
+				syncAfterSave(repo)
+				if failed > 0 {
+					panic_the_err(fmt.Errorf("%d of %d profiles could not be imported", failed, len(profiles)))
+				}
+			},
+		},
+
+		{
+			Name:  "export",
+			Usage: "Write a set of AWS credentials into the AWS CLI's shared credentials file\n        export [username@account]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "profile, p",
+					Value: "default",
+					Usage: "\n        The profile to write the credentials into",
+				},
+				cli.BoolFlag{
+					Name:  "credential-process",
+					Usage: "\n        Set up the profile in the config file to run 'credulous process', instead of writing the credentials out",
+				},
+				cli.StringFlag{
+					Name:  "account, a",
+					Value: "",
+					Usage: "\n        AWS Account alias or id",
+				},
+				cli.StringFlag{
+					Name:  "key, k",
+					Value: "",
+					Usage: "\n        SSH private key",
+				},
+				cli.StringFlag{
+					Name:  "username, u",
+					Value: "",
+					Usage: "\n        IAM User",
+				},
+				cli.StringFlag{
+					Name:  "credentials, c",
+					Value: "",
+					Usage: "\n        Credentials, for example username@account",
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "\n        Force use of credentials without validating username or account",
+				},
+				cli.BoolFlag{
+					Name:  "ignore-expiry",
+					Usage: "\n        Use the credentials even if their lifetime has run out",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (the default repository if not given)",
+				},
+				cli.StringFlag{
+					Name:  "role",
+					Value: "",
+					Usage: "\n        Assume the role in this role profile (or with this ARN), using the credentials",
+				},
+			},
+			Action: func(c *cli.Context) {
+				var arg string
+				if len(c.Args()) > 0 {
+					arg = c.Args()[0]
+				}
+				profile := c.String("profile")
+				if c.Bool("credential-process") {
+					command, err := credentialProcessCommand(c, arg)
+					panic_the_err(err)
+					err = exportCredentialProcess(sharedConfigPath(), sharedCredentialsPath(), profile, command)
+					panic_the_err(err)
+					fmt.Printf("profile %s in %s now runs '%s'\n", profile, sharedConfigPath(), command)
+					return
+				}
+
+				creds, err := loadCredentials(c, arg)
+				panic_the_err(err)
+				err = exportProfile(sharedCredentialsPath(), profile, creds.Encryptions[0].decoded)
+				panic_the_err(err)
+				fmt.Printf("exported credentials for %s@%s to profile %s in %s\n",
+					creds.IamUsername, creds.AccountAliasOrId, profile, sharedCredentialsPath())
+			},
+		},
+
+		{
+			Name:  "process",
+			Usage: "Output AWS credentials for the AWS CLI and SDKs' credential_process setting\n        process [username@account]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "account, a",
+					Value: "",
+					Usage: "\n        AWS Account alias or id",
+				},
+				cli.StringFlag{
+					Name:  "key, k",
+					Value: "",
+					Usage: "\n        SSH private key",
+				},
+				cli.StringFlag{
+					Name:  "username, u",
+					Value: "",
+					Usage: "\n        IAM User",
+				},
+				cli.StringFlag{
+					Name:  "credentials, c",
+					Value: "",
+					Usage: "\n        Credentials, for example username@account",
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "\n        Force use of credentials without validating username or account",
+				},
+				cli.BoolFlag{
+					Name:  "ignore-expiry",
+					Usage: "\n        Use the credentials even if their lifetime has run out",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (the default repository if not given)",
+				},
+				cli.StringFlag{
+					Name:  "role",
+					Value: "",
+					Usage: "\n        Assume the role in this role profile (or with this ARN), using the credentials",
+				},
+			},
+			Action: func(c *cli.Context) {
+				var arg string
+				if len(c.Args()) > 0 {
+					arg = c.Args()[0]
+				}
+				creds, err := loadCredentials(c, arg)
+				panic_the_err(err)
+				err = creds.DisplayProcess(os.Stdout)
+				panic_the_err(err)
+			},
+		},
+
+		{
+			Name:  "serve",
+			Usage: "Serve AWS credentials to the AWS SDKs on localhost, as ECS and EC2 do\n        serve [username@account]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "account, a",
+					Value: "",
+					Usage: "\n        AWS Account alias or id",
+				},
+				cli.StringFlag{
+					Name:  "key, k",
+					Value: "",
+					Usage: "\n        SSH private key",
+				},
+				cli.StringFlag{
+					Name:  "username, u",
+					Value: "",
+					Usage: "\n        IAM User",
+				},
+				cli.StringFlag{
+					Name:  "credentials, c",
+					Value: "",
+					Usage: "\n        Credentials, for example username@account",
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "\n        Force use of credentials without validating username or account",
+				},
+				cli.BoolFlag{
+					Name:  "ignore-expiry",
+					Usage: "\n        Use the credentials even if their lifetime has run out",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (the default repository if not given)",
+				},
+				cli.StringFlag{
+					Name:  "role",
+					Value: "",
+					Usage: "\n        Assume the role in this role profile (or with this ARN), using the credentials",
+				},
+				cli.BoolFlag{
+					Name:  "mfa",
+					Usage: "\n        Use MFA session credentials, prompting for an MFA code unless a session is cached",
+				},
+				cli.StringFlag{
+					Name:  "mfa-serial",
+					Value: "",
+					Usage: "\n        ARN or serial number of the MFA device (the user's virtual MFA device by default)",
+				},
+				cli.StringFlag{
+					Name:  "mfa-code",
+					Value: "",
+					Usage: "\n        The current MFA code, instead of prompting for it",
+				},
+				cli.IntFlag{
+					Name:  "mfa-duration",
+					Value: 0,
+					Usage: "\n        MFA session duration in seconds (12 hours if 0)",
+				},
+				cli.StringFlag{
+					Name:  "listen, l",
+					Value: DEFAULT_SERVE_ADDRESS,
+					Usage: "\n        Loopback address and port to listen on (a random port by default)",
+				},
+				cli.BoolFlag{
+					Name:  "imds",
+					Usage: "\n        Also serve credentials as EC2 does, to any local process that asks",
+				},
+				cli.StringFlag{
+					Name:  "format, o",
+					Value: DEFAULT_OUTPUT_FORMAT,
+					Usage: "\n        Format of the environment variables to output: bash, zsh, sh, fish, powershell, cmd, dotenv or json",
+				},
+			},
+			Action: func(c *cli.Context) {
+				var arg string
+				if len(c.Args()) > 0 {
+					arg = c.Args()[0]
+				}
+				format, err := getOutputFormat(c.String("format"))
+				panic_the_err(err)
+				source, err := loadCredentialSource(c, arg)
+				panic_the_err(err)
+				server, err := newCredentialServer(source.credentials, c.Bool("imds"))
+				panic_the_err(err)
+				// the server has its own copy, which it wipes when it's done
+				source = credentialSource{}
+
+				// rather than on the first request, fail now if there's
+				// nothing to serve
+				_, _, _, err = server.credential()
+				panic_the_err(err)
+				listener, err := listenLoopback(c.String("listen"))
+				panic_the_err(err)
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+				address := listener.Addr().String()
+				err = format.Set(os.Stdout, server.environment(address))
+				panic_the_err(err)
+				fmt.Fprintf(os.Stderr, "Serving credentials on http://%s until interrupted\n", address)
+				if c.Bool("imds") {
+					log.Print("WARNING: serving credentials as EC2 does, to any local user who asks")
+				}
+				err = serveCredentials(listener, server, signals)
+				panic_the_err(err)
+			},
+		},
+
+		{
+			Name:  "agent",
+			Usage: "Keep decrypted credentials in memory for a while, for 'source' and 'exec'",
+			Subcommands: []cli.Command{
+				{
+					Name:  "start",
+					Usage: "Run the agent until interrupted",
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "ttl, t",
+							Value: int(DEFAULT_AGENT_TTL / time.Second),
+							Usage: "\n        How many seconds to keep credentials for",
+						},
+						cli.StringFlag{
+							Name:  "format, o",
+							Value: DEFAULT_OUTPUT_FORMAT,
+							Usage: "\n        Format of the environment variable to output: bash, zsh, sh, fish, powershell, cmd, dotenv or json",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if c.Int("ttl") <= 0 {
+							panic_the_err(errors.New("The TTL must be a positive number of seconds"))
+						}
+						format, err := getOutputFormat(c.String("format"))
+						panic_the_err(err)
+						path := agentSocketPath()
+						listener, err := listenAgent(path)
+						panic_the_err(err)
+						signals := make(chan os.Signal, 1)
+						signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+						err = format.Set(os.Stdout, []envVar{{AGENT_SOCK_ENV, path}})
+						panic_the_err(err)
+						fmt.Fprintf(os.Stderr, "Agent listening on %s until interrupted\n", path)
+						err = runAgent(listener, newCredentialAgent(time.Duration(c.Int("ttl"))*time.Second), signals)
+						panic_the_err(err)
+					},
+				},
+				{
+					Name:  "status",
+					Usage: "Show the credentials the agent holds, and when it will forget them",
+					Action: func(c *cli.Context) {
+						resp, err := callAgent(agentRequest{Op: AGENT_STATUS})
+						panic_the_err(err)
+						if resp.Status.Locked {
+							fmt.Println("The agent is locked")
+						}
+						for _, entry := range resp.Status.Entries {
+							fmt.Printf("%s\tuntil %s\n", entry.Name, entry.Expires.Local().Format(time.RFC1123))
+						}
+					},
+				},
+				{
+					Name:  "clear",
+					Usage: "Make the agent forget all its credentials",
+					Action: func(c *cli.Context) {
+						_, err := callAgent(agentRequest{Op: AGENT_CLEAR})
+						panic_the_err(err)
+					},
+				},
+				{
+					Name:  "lock",
+					Usage: "Make the agent forget all its credentials, and refuse any more until unlocked",
+					Action: func(c *cli.Context) {
+						passphrase, err := promptPassphrase("Enter a passphrase to lock the agent with: ")
+						panic_the_err(err)
+						_, err = callAgent(agentRequest{Op: AGENT_LOCK, Passphrase: string(passphrase)})
+						panic_the_err(err)
+					},
+				},
+				{
+					Name:  "unlock",
+					Usage: "Let the agent hold credentials again",
+					Action: func(c *cli.Context) {
+						passphrase, err := promptPassphrase("Enter the passphrase the agent was locked with: ")
+						panic_the_err(err)
+						_, err = callAgent(agentRequest{Op: AGENT_UNLOCK, Passphrase: string(passphrase)})
+						panic_the_err(err)
+					},
+				},
+			},
+		},
+
+		{
+			Name:  "role",
+			Usage: "Manage profiles for roles to assume with stored credentials",
+			Subcommands: []cli.Command{
+				{
+					Name:  "add",
+					Usage: "Add (or replace) a role profile\n        role add [options] name",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "arn",
+							Value: "",
+							Usage: "\n        ARN of the role to assume",
+						},
+						cli.StringFlag{
+							Name:  "external-id",
+							Value: "",
+							Usage: "\n        External ID required by the role's trust policy",
+						},
+						cli.StringFlag{
+							Name:  "session-name",
+							Value: "",
+							Usage: "\n        Role session name (the IAM username by default)",
+						},
+						cli.IntFlag{
+							Name:  "duration",
+							Value: 0,
+							Usage: "\n        Session duration in seconds (the role's default if 0)",
+						},
+						cli.StringFlag{
+							Name:  "source, s",
+							Value: "",
+							Usage: "\n        Credentials to assume the role with, for example username@account",
+						},
+						cli.StringFlag{
+							Name:  "repo, r",
+							Value: "",
+							Usage: "\n        Repository name or path (the default repository if not given)",
+						},
+					},
+					Action: func(c *cli.Context) {
+						profile, err := parseRoleProfileArgs(c)
+						panic_the_err(err)
+						repo, err := parseRepoArgs(c)
+						panic_the_err(err)
+						err = profile.WriteToDisk(repo)
+						panic_the_err(err)
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "List role profiles",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "repo, r",
+							Value: "",
+							Usage: "\n        Repository name or path (the default repository if not given)",
+						},
+					},
+					Action: func(c *cli.Context) {
+						repo, err := parseRepoArgs(c)
+						panic_the_err(err)
+						profiles, err := listRoleProfiles(repo)
+						panic_the_err(err)
+						for _, profile := range profiles {
+							fmt.Printf("%s\t%s\t%s\n", profile.Name, profile.RoleArn, profile.Source)
+						}
+					},
+				},
+				{
+					Name:  "remove",
+					Usage: "Remove a role profile\n        role remove [options] name",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "repo, r",
+							Value: "",
+							Usage: "\n        Repository name or path (the default repository if not given)",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if len(c.Args()) != 1 {
+							panic_the_err(errors.New("Please specify a single role profile name"))
+						}
+						repo, err := parseRepoArgs(c)
+						panic_the_err(err)
+						err = removeRoleProfile(repo, c.Args()[0])
+						panic_the_err(err)
+					},
+				},
+			},
+		},
+
+		{
+			Name:  "keys",
+			Usage: "Manage the recipients that credentials in a repository are encrypted for",
+			Subcommands: []cli.Command{
+				{
+					Name:  "add",
+					Usage: "Add (or replace) a recipient\n        keys add [options] name",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "key, k",
+							Value: "",
+							Usage: "\n        The recipient's SSH public key (yours by default)",
+						},
+						cli.StringFlag{
+							Name:  "email, e",
+							Value: "",
+							Usage: "\n        The recipient's email address",
+						},
+						cli.StringFlag{
+							Name:  "pgp-fingerprint",
+							Value: "",
+							Usage: "\n        The fingerprint of the OpenPGP key the recipient signs commits with",
+						},
+						cli.StringSliceFlag{
+							Name:  "group, g",
+							Value: &cli.StringSlice{},
+							Usage: "\n        Groups to put the recipient in",
+						},
+						cli.StringFlag{
+							Name:  "repo, r",
+							Value: "",
+							Usage: "\n        Repository name or path (the default repository if not given)",
+						},
+					},
+					Action: func(c *cli.Context) {
+						recipient, err := parseRecipientArgs(c)
+						panic_the_err(err)
+						repo, err := parseRepoArgs(c)
+						panic_the_err(err)
+						keyring, err := readKeyring(repo)
+						panic_the_err(err)
+						err = keyring.add(recipient, c.StringSlice("group"))
+						panic_the_err(err)
+						err = keyring.WriteToDisk(repo, "Recipient "+recipient.Name+" added by Credulous")
+						panic_the_err(err)
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "List recipients, and the groups they're in",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "repo, r",
+							Value: "",
+							Usage: "\n        Repository name or path (the default repository if not given)",
+						},
+					},
+					Action: func(c *cli.Context) {
+						repo, err := parseRepoArgs(c)
+						panic_the_err(err)
+						keyring, err := readKeyring(repo)
+						panic_the_err(err)
+						err = writeKeyring(os.Stdout, keyring)
+						panic_the_err(err)
+					},
+				},
+				{
+					Name:  "remove",
+					Usage: "Remove a recipient, or a group\n        keys remove [options] name",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "repo, r",
+							Value: "",
+							Usage: "\n        Repository name or path (the default repository if not given)",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if len(c.Args()) != 1 {
+							panic_the_err(errors.New("Please specify a single recipient or group name"))
+						}
+						repo, err := parseRepoArgs(c)
+						panic_the_err(err)
+						keyring, err := readKeyring(repo)
+						panic_the_err(err)
+						err = keyring.remove(c.Args()[0])
+						panic_the_err(err)
+						err = keyring.WriteToDisk(repo, c.Args()[0]+" removed by Credulous")
+						panic_the_err(err)
+					},
+				},
+			},
+		},
+
+		{
+			Name:  "repo",
+			Usage: "Create, share and remove repositories",
+			Subcommands: []cli.Command{
+				{
+					Name:  "init",
+					Usage: "Create a repository in ~/.credulous\n        repo init [options] name",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "description, d",
+							Value: "",
+							Usage: "\n        What the repository is for",
+						},
+						cli.StringFlag{
+							Name:  "user-name",
+							Value: "",
+							Usage: "\n        Name to commit as (git's user.name by default)",
+						},
+						cli.StringFlag{
+							Name:  "user-email",
+							Value: "",
+							Usage: "\n        Email address to commit as (git's user.email by default)",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if len(c.Args()) != 1 {
+							panic_the_err(errors.New("Please specify a single repository name"))
+						}
+						user := gitDefaultUser()
+						if c.String("user-name") != "" {
+							user.Name = c.String("user-name")
+						}
+						if c.String("user-email") != "" {
+							user.Email = c.String("user-email")
+						}
+						err := initRepo(c.Args()[0], c.String("description"), user)
+						panic_the_err(err)
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "List repositories, marking the default one",
+					Action: func(c *cli.Context) {
+						name, err := defaultRepo(filepath.Join(getRootPath(), CONFIG_FILE))
+						panic_the_err(err)
+						repos, err := listRepos(getRootPath(), name)
+						panic_the_err(err)
+						err = writeRepos(os.Stdout, repos)
+						panic_the_err(err)
+					},
+				},
+				{
+					Name:  "remove",
+					Usage: "Remove a repository\n        repo remove [options] name",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "force, f",
+							Usage: "\n        Remove the repository even if it holds credentials",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if len(c.Args()) != 1 {
+							panic_the_err(errors.New("Please specify a single repository name"))
+						}
+						err := removeRepo(getRootPath(), c.Args()[0], c.Bool("force"))
+						panic_the_err(err)
+						configFile := filepath.Join(getRootPath(), CONFIG_FILE)
+						name, err := defaultRepo(configFile)
+						panic_the_err(err)
+						if name == c.Args()[0] {
+							err = setDefaultRepo(configFile, DEFAULT_REPO)
+							panic_the_err(err)
+						}
+					},
+				},
+				{
+					Name:  "set-default",
+					Usage: "Use a repository when none is given with --repo\n        repo set-default name",
+					Action: func(c *cli.Context) {
+						if len(c.Args()) != 1 {
+							panic_the_err(errors.New("Please specify a single repository name"))
+						}
+						name := c.Args()[0]
+						if !isRepoName(name) {
+							panic_the_err(errors.New("Invalid repository name '" + name + "'"))
+						}
+						if _, err := os.Stat(repoPath(name)); err != nil && name != DEFAULT_REPO {
+							panic_the_err(errors.New("No repository named '" + name + "'"))
+						}
+						err := setDefaultRepo(filepath.Join(getRootPath(), CONFIG_FILE), name)
+						panic_the_err(err)
+					},
+				},
+				{
+					Name:  "clone",
+					Usage: "Clone a repository into ~/.credulous\n        repo clone [options] url name",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "auto-sync",
+							Usage: "\n        Sync the repository whenever anything is saved in it",
+						},
+					},
+					Action: func(c *cli.Context) {
+						url, repo, err := parseCloneArgs(c)
+						panic_the_err(err)
+						err = gitClone(url, repo)
+						panic_the_err(err)
+						if c.Bool("auto-sync") {
+							err = gitSetAutoSync(repo, true)
+							panic_the_err(err)
+						}
+					},
+				},
+				{
+					Name:  "signing",
+					Usage: "Sign commits, and verify the signatures of credentials before they're used\n        repo signing [options]",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "ssh-key",
+							Value: "",
+							Usage: "\n        Sign commits with this SSH key",
+						},
+						cli.StringFlag{
+							Name:  "gpg-key",
+							Value: "",
+							Usage: "\n        Sign commits with this OpenPGP key, using gpg",
+						},
+						cli.BoolFlag{
+							Name:  "no-sign",
+							Usage: "\n        Stop signing commits",
+						},
+						cli.BoolFlag{
+							Name:  "verify",
+							Usage: "\n        Only use credentials committed with a signature from someone in the keyring",
+						},
+						cli.BoolFlag{
+							Name:  "no-verify",
+							Usage: "\n        Stop verifying credentials",
+						},
+						cli.StringFlag{
+							Name:  "repo, r",
+							Value: "",
+							Usage: "\n        Repository name or path (the default repository if not given)",
+						},
+					},
+					Action: func(c *cli.Context) {
+						repo, err := parseRepoArgs(c)
+						panic_the_err(err)
+						err = parseSigningArgs(c, repo)
+						panic_the_err(err)
+						description, err := describeSigning(repo)
+						panic_the_err(err)
+						fmt.Println(description)
+					},
+				},
+				{
+					Name:  "sync",
+					Usage: "Fetch from the repository's remote, merging what has changed, and push",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "repo, r",
+							Value: "",
+							Usage: "\n        Repository name or path (the default repository if not given)",
+						},
+					},
+					Action: func(c *cli.Context) {
+						repo, err := parseRepoArgs(c)
+						panic_the_err(err)
+						err = gitSync(repo)
+						panic_the_err(err)
+					},
+				},
 			},
 		},
 
@@ -362,17 +1843,14 @@ func main() {
 			Name:  "current",
 			Usage: "Show the username and alias of the currently-loaded credentials",
 			Action: func(c *cli.Context) {
-				AWSAccessKeyId := os.Getenv("AWS_ACCESS_KEY_ID")
-				AWSSecretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
-				if AWSAccessKeyId == "" || AWSSecretAccessKey == "" {
-					err := errors.New("No amazon credentials are currently in your environment")
+				cred, err := credentialFromEnvironment()
+				if err != nil {
+					err = errors.New("No amazon credentials are currently in your environment")
 					panic_the_err(err)
 				}
-				cred := Credential{
-					KeyId:     AWSAccessKeyId,
-					SecretKey: AWSSecretAccessKey,
-				}
-				username, alias, err := getAWSUsernameAndAlias(cred)
+				config, err := parseAWSConfigArgs(c)
+				panic_the_err(err)
+				username, alias, err := getAWSUsernameAndAlias(cred, config)
 				if err != nil {
 					panic_the_err(err)
 				}
@@ -388,6 +1866,9 @@ func main() {
 				AWSSecretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
 				fmt.Printf("AWS_ACCESS_KEY_ID: %s\n", AWSAccessKeyId)
 				fmt.Printf("AWS_SECRET_ACCESS_KEY: %s\n", AWSSecretAccessKey)
+				if AWSSessionToken := os.Getenv("AWS_SESSION_TOKEN"); AWSSessionToken != "" {
+					fmt.Printf("AWS_SESSION_TOKEN: %s\n", AWSSessionToken)
+				}
 			},
 		},
 
@@ -409,47 +1890,168 @@ func main() {
 			},
 		},
 
+		{
+			Name:  "status",
+			Usage: "Show when the lifetime of each set of stored credentials runs out",
+			Action: func(c *cli.Context) {
+				statuses, err := readCredentialStatuses(getRootPath())
+				panic_the_err(err)
+				if len(statuses) == 0 {
+					panic_the_err(errors.New("No saved credentials found; please run 'credulous save' first"))
+				}
+				err = writeCredentialStatuses(os.Stdout, statuses, time.Now())
+				panic_the_err(err)
+			},
+		},
+
 		{
 			Name:  "rotate",
 			Usage: "Rotate current AWS credentials, deleting the oldest",
 			Flags: []cli.Flag{
-				cli.IntFlag{
+				cli.StringFlag{
 					Name:  "lifetime, l",
-					Value: 0,
-					Usage: "\n        New credential lifetime in seconds (0 means forever)",
+					Value: "",
+					Usage: "\n        New credential lifetime, in seconds or as a duration such as 90d or 12h (the same as before by default)",
 				},
 				cli.StringSliceFlag{
 					Name:  "key, k",
 					Value: &cli.StringSlice{},
-					Usage: "\n        SSH public keys for encryption",
+					Usage: "\n        SSH public keys for encryption (the same keys as before by default)",
+				},
+				cli.StringSliceFlag{
+					Name:  "recipient, R",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Recipients or groups in the repository's keyring to encrypt for (as for --key)",
 				},
 				cli.StringSliceFlag{
 					Name:  "env, e",
 					Value: &cli.StringSlice{},
-					Usage: "\n        Environment variables to set in the form VAR=value",
+					Usage: "\n        Environment variables to set in the form VAR=value, besides those saved before",
 				},
 				cli.StringFlag{
 					Name:  "repo, r",
-					Value: "local",
-					Usage: "\n        Repository location ('local' by default)",
+					Value: "",
+					Usage: "\n        Repository name or path (the default repository if not given)",
+				},
+				cli.BoolFlag{
+					Name:  "all, a",
+					Usage: "\n        Rotate every set of stored credentials whose lifetime has run out, or soon will",
+				},
+				cli.StringFlag{
+					Name:  "older-than",
+					Value: "",
+					Usage: "\n        With --all, also rotate credentials created longer ago than this, such as 30d",
+				},
+				cli.StringFlag{
+					Name:  "identity, i",
+					Value: "",
+					Usage: "\n        SSH private key to decrypt stored credentials with",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run, n",
+					Usage: "\n        With --all, only show what would be rotated",
+				},
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "\n        Finish rotations that were interrupted",
+				},
+				cli.BoolFlag{
+					Name:  "rollback",
+					Usage: "\n        Undo rotations that were interrupted, if their old keys haven't been deleted",
+				},
+				cli.BoolFlag{
+					Name:  "daemon",
+					Usage: "\n        Keep running, rotating as --all does every --interval",
+				},
+				cli.StringFlag{
+					Name:  "interval",
+					Value: "",
+					Usage: "\n        How often --daemon checks the credentials (24h by default)",
 				},
 			},
 			Action: func(c *cli.Context) {
-				cred, _, _, pubkeys, lifetime, repo, err := parseSaveArgs(c)
+				if c.Bool("resume") || c.Bool("rollback") {
+					if c.Bool("resume") && c.Bool("rollback") {
+						panic_the_err(errors.New("Choose one of --resume and --rollback"))
+					}
+					err := resumeRotations(c)
+					panic_the_err(err)
+					return
+				}
+				if c.Bool("all") || c.Bool("daemon") {
+					rotator, err := parseRotateAllArgs(c)
+					panic_the_err(err)
+					if !c.Bool("daemon") {
+						_, err = rotator.run()
+						panic_the_err(err)
+						return
+					}
+					interval, err := parseDuration(c.String("interval"))
+					panic_the_err(err)
+					if interval == 0 {
+						interval = DEFAULT_ROTATE_INTERVAL
+					}
+					if interval < 0 {
+						panic_the_err(errors.New("The rotation interval cannot be negative"))
+					}
+					signals := make(chan os.Signal, 1)
+					signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+					err = rotator.runEvery(interval, signals)
+					panic_the_err(err)
+					return
+				}
+
+				data, err := parseRotateArgs(c)
 				panic_the_err(err)
-				username, account, err := getAWSUsernameAndAlias(cred)
+				err = rotateCredentials(data)
 				panic_the_err(err)
-				err = (&cred).rotateCredentials(username)
+				syncAfterSave(data.repo)
+			},
+		},
+
+		{
+			Name:  "rekey",
+			Usage: "Encrypt stored credentials for a new set of recipients\n        rekey [options] [username@account ...]",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "add, A",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Recipients or groups in the repository's keyring, or SSH public keys, to encrypt for as well",
+				},
+				cli.StringSliceFlag{
+					Name:  "remove, D",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Recipients or groups in the repository's keyring, or fingerprints, to no longer encrypt for",
+				},
+				cli.StringSliceFlag{
+					Name:  "key, k",
+					Value: &cli.StringSlice{},
+					Usage: "\n        SSH public keys to encrypt for, instead of those the credentials are encrypted for",
+				},
+				cli.StringSliceFlag{
+					Name:  "recipient, R",
+					Value: &cli.StringSlice{},
+					Usage: "\n        Recipients or groups in the repository's keyring to encrypt for (as for --key)",
+				},
+				cli.StringFlag{
+					Name:  "identity, i",
+					Value: "",
+					Usage: "\n        SSH private key to decrypt stored credentials with",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run, n",
+					Usage: "\n        Only show what would be rekeyed",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Value: "",
+					Usage: "\n        Repository name or path (the default repository if not given)",
+				},
+			},
+			Action: func(c *cli.Context) {
+				r, err := parseRekeyArgs(c)
 				panic_the_err(err)
-				err = SaveCredentials(SaveData{
-					cred:     cred,
-					username: username,
-					alias:    account,
-					pubkeys:  pubkeys,
-					lifetime: lifetime,
-					force:    c.Bool("force"),
-					repo:     repo,
-				})
+				_, err = r.run(c.Args())
 				panic_the_err(err)
 			},
 		},
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rsa"
@@ -11,15 +14,14 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"math/big"
-	"reflect"
 	"strings"
 
-	"code.google.com/p/go.crypto/ssh"
+	"golang.org/x/crypto/ssh"
 )
 
 type Salter interface {
@@ -50,21 +52,26 @@ func (sg *RandomSaltGenerator) GenerateSalt() (string, error) {
 	return string(encoded), nil
 }
 
-func sshPubkeyToRsaPubkey(pubkey ssh.PublicKey) rsa.PublicKey {
-	s := reflect.ValueOf(pubkey).Elem()
-	rsaKey := rsa.PublicKey{
-		N: s.Field(0).Interface().(*big.Int),
-		E: s.Field(1).Interface().(int),
+func sshPubkeyToRsaPubkey(pubkey ssh.PublicKey) (*rsa.PublicKey, error) {
+	cryptoKey, ok := pubkey.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported SSH key type %s", pubkey.Type())
 	}
-	return rsaKey
+	rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("SSH key of type %s is not an RSA key", pubkey.Type())
+	}
+	return rsaKey, nil
 }
 
-func rsaPubkeyToSSHPubkey(rsakey rsa.PublicKey) (sshkey ssh.PublicKey, err error) {
-	sshkey, err = ssh.NewPublicKey(&rsakey)
-	if err != nil {
-		return nil, err
+// rsaPrivateKey is for the older credential formats, which could only
+// ever be encrypted with RSA keys
+func rsaPrivateKey(privkey crypto.Signer) (*rsa.PrivateKey, error) {
+	rsaKey, ok := privkey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("Credentials in this format can only be decrypted with an RSA key")
 	}
-	return sshkey, nil
+	return rsaKey, nil
 }
 
 type AESEncryption struct {
@@ -111,45 +118,175 @@ func decodeAES(key []byte, ciphertext string) (string, error) {
 	return string(msg), nil
 }
 
+// encodeAESGCM encrypts and authenticates the plaintext, and authenticates
+// (but does not encrypt) the additionalData. The random nonce goes at the
+// front of the base64-encoded ciphertext.
+func encodeAESGCM(key []byte, plaintext string, additionalData []byte) (ciphertext string, err error) {
+	cipherBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := cipher.NewGCM(cipherBlock)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	out := aead.Seal(nonce, nonce, []byte(plaintext), additionalData)
+	encoded := base64.StdEncoding.EncodeToString(out)
+	return encoded, nil
+}
+
+// takes a base64-encoded AES-GCM ciphertext; fails if either the ciphertext
+// or the additionalData have been tampered with
+func decodeAESGCM(key []byte, ciphertext string, additionalData []byte) (string, error) {
+	encrypted, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	decrypter, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := cipher.NewGCM(decrypter)
+	if err != nil {
+		return "", err
+	}
+
+	if len(encrypted) < aead.NonceSize() {
+		return "", errors.New("Ciphertext is too short to have been produced by credulous")
+	}
+
+	nonce := encrypted[:aead.NonceSize()]
+	msg, err := aead.Open(nil, nonce, encrypted[aead.NonceSize():], additionalData)
+	if err != nil {
+		return "", errors.New("Unable to decrypt credentials: ciphertext or metadata has been modified")
+	}
+	return string(msg), nil
+}
+
 // returns a base64 encoded ciphertext.
-// OAEP can only encrypt plaintexts that are smaller than the key length; for
-// a 1024-bit key, about 117 bytes. So instead, this function:
+// RSA keys: OAEP can only encrypt plaintexts that are smaller than the key
+// length; for a 1024-bit key, about 117 bytes. So instead, this function:
 // * generates a random 32-byte symmetric key (randKey)
-// * encrypts the plaintext with AES256 using that random symmetric key -> cipherText
+// * encrypts the plaintext with AES256-GCM using that random symmetric key -> cipherText
+// * authenticates the additionalData alongside cipherText, so neither can be modified
 // * encrypts the random symmetric key with the ssh PublicKey -> cipherKey
 // * returns the base64-encoded marshalled JSON for the ciphertext and key
-func CredulousEncode(plaintext string, pubkey ssh.PublicKey) (ciphertext string, err error) {
-	rsaKey := sshPubkeyToRsaPubkey(pubkey)
-	randKey := make([]byte, 32)
-	_, err = rand.Read(randKey)
+// ed25519 and ECDSA keys: the symmetric key comes from an ephemeral
+// Diffie-Hellman exchange instead; see encodeECDH.
+func CredulousEncode(plaintext string, pubkey ssh.PublicKey, additionalData []byte) (ciphertext string, err error) {
+	var cipherStruct interface{}
+	switch pubkey.Type() {
+	case ssh.KeyAlgoRSA:
+		cipherStruct, err = encodeRSA(plaintext, pubkey, additionalData)
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		cipherStruct, err = encodeECDH(plaintext, pubkey, additionalData)
+	default:
+		err = fmt.Errorf("Unsupported SSH key type %s", pubkey.Type())
+	}
 	if err != nil {
 		return "", err
 	}
 
-	encoded, err := encodeAES(randKey, plaintext)
+	tmp, err := json.Marshal(cipherStruct)
 	if err != nil {
 		return "", err
 	}
 
-	out, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, &rsaKey, []byte(randKey), []byte("Credulous"))
+	ciphertext = base64.StdEncoding.EncodeToString(tmp)
+
+	return ciphertext, nil
+}
+
+func encodeRSA(plaintext string, pubkey ssh.PublicKey, additionalData []byte) (*AESEncryption, error) {
+	rsaKey, err := sshPubkeyToRsaPubkey(pubkey)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	randKey := make([]byte, 32)
+	_, err = rand.Read(randKey)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := encodeAESGCM(randKey, plaintext, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, rsaKey, []byte(randKey), []byte("Credulous"))
+	if err != nil {
+		return nil, err
 	}
 	cipherKey := base64.StdEncoding.EncodeToString(out)
 
-	cipherStruct := AESEncryption{
+	return &AESEncryption{
 		EncodedKey: cipherKey,
 		Ciphertext: encoded,
+	}, nil
+}
+
+// decodeAESKey pulls apart the layers of a ciphertext produced by
+// CredulousEncode, returning the AES key and the AES ciphertext
+func decodeAESKey(ciphertext string, privkey *rsa.PrivateKey) (aesKey []byte, aesCiphertext string, err error) {
+	in, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, "", err
 	}
 
-	tmp, err := json.Marshal(cipherStruct)
+	// pull apart the layers of base64-encoded JSON
+	var encrypted AESEncryption
+	err = json.Unmarshal(in, &encrypted)
+	if err != nil {
+		return nil, "", err
+	}
+
+	encryptedKey, err := base64.StdEncoding.DecodeString(encrypted.EncodedKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// decrypt the AES key using the ssh private key
+	aesKey, err = rsa.DecryptOAEP(sha1.New(), rand.Reader, privkey, encryptedKey, []byte("Credulous"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return aesKey, encrypted.Ciphertext, nil
+}
+
+// CredulousDecodeAESGCM decrypts a ciphertext produced by CredulousEncode,
+// verifying that neither it nor the additionalData have been modified
+func CredulousDecodeAESGCM(ciphertext string, privkey crypto.Signer, additionalData []byte) (plaintext string, err error) {
+	if rsaKey, ok := privkey.(*rsa.PrivateKey); ok {
+		aesKey, aesCiphertext, err := decodeAESKey(ciphertext, rsaKey)
+		if err != nil {
+			return "", err
+		}
+		return decodeAESGCM(aesKey, aesCiphertext, additionalData)
+	}
+
+	in, err := base64.StdEncoding.DecodeString(ciphertext)
 	if err != nil {
 		return "", err
 	}
 
-	ciphertext = base64.StdEncoding.EncodeToString(tmp)
+	var encrypted ECDHEncryption
+	err = json.Unmarshal(in, &encrypted)
+	if err != nil {
+		return "", err
+	}
 
-	return ciphertext, nil
+	return decodeECDH(encrypted, privkey, additionalData)
 }
 
 func CredulousDecodeAES(ciphertext string, privkey *rsa.PrivateKey) (plaintext string, err error) {
@@ -207,31 +344,91 @@ func CredulousDecodeWithSalt(ciphertext string, salt string, privkey *rsa.Privat
 	return plaintext, nil
 }
 
-func loadPrivateKey(filename string) (privateKey *rsa.PrivateKey, err error) {
+// loadPrivateKey returns an *rsa.PrivateKey, an *ecdsa.PrivateKey or an
+// ed25519.PrivateKey, prompting for the passphrase if the key is encrypted
+func loadPrivateKey(filename string) (privateKey crypto.Signer, err error) {
 	var tmp []byte
 
 	if tmp, err = ioutil.ReadFile(filename); err != nil {
-		return &rsa.PrivateKey{}, err
+		return nil, err
 	}
 
-	pemblock, _ := pem.Decode([]byte(tmp))
-	if x509.IsEncryptedPEMBlock(pemblock) {
-		if tmp, err = decryptPEM(pemblock, filename); err != nil {
-			return &rsa.PrivateKey{}, err
-		}
-	} else {
-		log.Print("WARNING: Your private SSH key has no passphrase!")
+	privateKey, err = parsePrivateKey(tmp, func() ([]byte, error) {
+		return readPassphrase(filename)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
 	}
+	return privateKey, nil
+}
 
-	key, err := ssh.ParseRawPrivateKey(tmp)
+// parsePrivateKey understands legacy PEM ("RSA PRIVATE KEY" and
+// "EC PRIVATE KEY"), OpenSSH's own format ("OPENSSH PRIVATE KEY") and
+// PKCS#8 ("PRIVATE KEY" and "ENCRYPTED PRIVATE KEY") keys. passphrase is
+// only called if the key turns out to be encrypted.
+func parsePrivateKey(pemBytes []byte, passphrase func() ([]byte, error)) (crypto.Signer, error) {
+	pemblock, _ := pem.Decode(pemBytes)
+	if pemblock == nil {
+		return nil, errors.New("No PEM-encoded private key found")
+	}
+
+	var key interface{}
+	var err error
+	switch {
+	case pemblock.Type == "ENCRYPTED PRIVATE KEY":
+		var passwd, der []byte
+		if passwd, err = passphrase(); err != nil {
+			return nil, err
+		}
+		if der, err = decryptPKCS8(pemblock.Bytes, passwd); err != nil {
+			return nil, err
+		}
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	case x509.IsEncryptedPEMBlock(pemblock):
+		var passwd []byte
+		if passwd, err = passphrase(); err != nil {
+			return nil, err
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, passwd)
+	default:
+		key, err = ssh.ParseRawPrivateKey(pemBytes)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			// OpenSSH-format keys only reveal they're encrypted on parsing
+			var passwd []byte
+			if passwd, err = passphrase(); err != nil {
+				return nil, err
+			}
+			key, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, passwd)
+		} else if err == nil {
+			log.Print("WARNING: Your private SSH key has no passphrase!")
+		}
+	}
 	if err != nil {
-		return &rsa.PrivateKey{}, err
+		return nil, err
 	}
-	privateKey = key.(*rsa.PrivateKey)
-	return privateKey, nil
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case *ed25519.PrivateKey:
+		return *key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unsupported private key type %T", key)
 }
 
+// SSHFingerprint returns the fingerprint in the form 'ssh-keygen -l'
+// prints by default, eg. "SHA256:Pm6krQJitfCTPVIYgpm1jG7hnmIPzCbc/AoaV12dW6s"
 func SSHFingerprint(pubkey ssh.PublicKey) (fingerprint string) {
+	return ssh.FingerprintSHA256(pubkey)
+}
+
+// SSHFingerprintMD5 returns the colon-separated hex MD5 fingerprint which
+// credentials saved by older versions of credulous are labelled with
+func SSHFingerprintMD5(pubkey ssh.PublicKey) (fingerprint string) {
 	binary := pubkey.Marshal()
 	hash := md5.Sum(binary)
 	// now add the colons
@@ -242,8 +439,20 @@ func SSHFingerprint(pubkey ssh.PublicKey) (fingerprint string) {
 	return fingerprint
 }
 
-func SSHPrivateFingerprint(privkey rsa.PrivateKey) (fingerprint string, err error) {
-	sshPubkey, err := rsaPubkeyToSSHPubkey(privkey.PublicKey)
+// fingerprintMatches accepts either kind of fingerprint
+func fingerprintMatches(fingerprint string, pubkey ssh.PublicKey) bool {
+	if strings.HasPrefix(fingerprint, "SHA256:") {
+		return fingerprint == SSHFingerprint(pubkey)
+	}
+	return fingerprint == SSHFingerprintMD5(pubkey)
+}
+
+func sshPublicKey(privkey crypto.Signer) (ssh.PublicKey, error) {
+	return ssh.NewPublicKey(privkey.Public())
+}
+
+func SSHPrivateFingerprint(privkey crypto.Signer) (fingerprint string, err error) {
+	sshPubkey, err := sshPublicKey(privkey)
 	if err != nil {
 		return "", err
 	}
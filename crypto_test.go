@@ -1,13 +1,16 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
 	"io/ioutil"
 	"testing"
 
 	"crypto/rsa"
 
-	"code.google.com/p/go.crypto/ssh"
 	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestEncode(t *testing.T) {
@@ -15,9 +18,61 @@ func TestEncode(t *testing.T) {
 		pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte("ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQDXg9Vmhy9YSB8BcN3yHgQjdX9lN3j2KRpv7kVDXSiIana2WbKP7IiTS0uJcJWUM3vlHjdL9KOO0jCWWzVFIcmLhiVVG+Fy2tothBp/NhjR8WWG/6Jg/6tXvVkLG6bDgfbDaLWdE5xzjL0YG8TrIluqnu0J5GHKrQcXF650PlqkGo+whpXrS8wOG+eUmsHX9L1w/Z3TkQlMjQNJEoRbqqSrp7yGj4JqzbtLpsglPRlobD7LHp+5ZDxzpk9i+6hoMxp2muDFxnEtZyED6IMQlNNEGkc3sdmGPOo26oW2+ePkBcjpOpdVif/Iya/jDLuLFHAOol6G34Tr4IdTgaL0qCCr TEST KEY"))
 		panic_the_err(err)
 		plaintext := "some plaintext"
-		ciphertext, err := CredulousEncode(plaintext, pubkey)
+		ciphertext, err := CredulousEncode(plaintext, pubkey, []byte("metadata"))
 		So(err, ShouldEqual, nil)
-		So(len(ciphertext), ShouldEqual, 556)
+		So(len(ciphertext), ShouldEqual, 580)
+	})
+}
+
+func TestEncodeDecodeAESGCM(t *testing.T) {
+	Convey("Test encoding and decoding with AES-GCM", t, func() {
+		plaintext := "some plaintext"
+		key := "12345678901234567890123456789012"
+		ciphertext, err := encodeAESGCM([]byte(key), plaintext, []byte("metadata"))
+		So(err, ShouldEqual, nil)
+		So(len(ciphertext), ShouldEqual, 56)
+
+		Convey("Round-trips with the same metadata", func() {
+			decoded, err := decodeAESGCM([]byte(key), ciphertext, []byte("metadata"))
+			So(err, ShouldEqual, nil)
+			So(decoded, ShouldEqual, plaintext)
+		})
+
+		Convey("Fails with different metadata", func() {
+			_, err := decodeAESGCM([]byte(key), ciphertext, []byte("other metadata"))
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Fails with a tampered ciphertext", func() {
+			raw, _ := base64.StdEncoding.DecodeString(ciphertext)
+			raw[len(raw)-1] ^= 0x01
+			_, err := decodeAESGCM([]byte(key), base64.StdEncoding.EncodeToString(raw), []byte("metadata"))
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Fails with a truncated ciphertext", func() {
+			_, err := decodeAESGCM([]byte(key), "AAAA", []byte("metadata"))
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestDecodeAESGCMCredential(t *testing.T) {
+	Convey("Test decoding an AES-GCM-encrypted ciphertext", t, func() {
+		pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+		panic_the_err(err)
+		tmp, err := ioutil.ReadFile("testdata/testkey")
+		panic_the_err(err)
+		key, err := ssh.ParseRawPrivateKey(tmp)
+		privkey := key.(*rsa.PrivateKey)
+		panic_the_err(err)
+		ciphertext, err := CredulousEncode("some plaintext", pubkey, []byte("metadata"))
+		So(err, ShouldEqual, nil)
+		plaintext, err := CredulousDecodeAESGCM(ciphertext, privkey, []byte("metadata"))
+		So(err, ShouldEqual, nil)
+		So(plaintext, ShouldEqual, "some plaintext")
+		_, err = CredulousDecodeAESGCM(ciphertext, privkey, []byte("tampered"))
+		So(err, ShouldNotEqual, nil)
 	})
 }
 
@@ -75,10 +130,25 @@ func TestSSHFingerprint(t *testing.T) {
 		pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte("ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQDXg9Vmhy9YSB8BcN3yHgQjdX9lN3j2KRpv7kVDXSiIana2WbKP7IiTS0uJcJWUM3vlHjdL9KOO0jCWWzVFIcmLhiVVG+Fy2tothBp/NhjR8WWG/6Jg/6tXvVkLG6bDgfbDaLWdE5xzjL0YG8TrIluqnu0J5GHKrQcXF650PlqkGo+whpXrS8wOG+eUmsHX9L1w/Z3TkQlMjQNJEoRbqqSrp7yGj4JqzbtLpsglPRlobD7LHp+5ZDxzpk9i+6hoMxp2muDFxnEtZyED6IMQlNNEGkc3sdmGPOo26oW2+ePkBcjpOpdVif/Iya/jDLuLFHAOol6G34Tr4IdTgaL0qCCr TEST KEY"))
 		panic_the_err(err)
 		fingerprint := SSHFingerprint(pubkey)
+		So(fingerprint, ShouldEqual, "SHA256:Pm6krQJitfCTPVIYgpm1jG7hnmIPzCbc/AoaV12dW6s")
+		fingerprint = SSHFingerprintMD5(pubkey)
 		So(fingerprint, ShouldEqual, "c0:61:84:fc:e8:c9:52:dc:cd:a9:8e:82:a2:70:0a:30")
 	})
 }
 
+func TestFingerprintMatches(t *testing.T) {
+	Convey("Test matching either kind of SSH fingerprint", t, func() {
+		pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+		panic_the_err(err)
+		other, err := readSSHPubkeyFile("testdata/testkey_ed25519.pub")
+		panic_the_err(err)
+		So(fingerprintMatches("SHA256:Pm6krQJitfCTPVIYgpm1jG7hnmIPzCbc/AoaV12dW6s", pubkey), ShouldBeTrue)
+		So(fingerprintMatches("c0:61:84:fc:e8:c9:52:dc:cd:a9:8e:82:a2:70:0a:30", pubkey), ShouldBeTrue)
+		So(fingerprintMatches("SHA256:Pm6krQJitfCTPVIYgpm1jG7hnmIPzCbc/AoaV12dW6s", other), ShouldBeFalse)
+		So(fingerprintMatches("c0:61:84:fc:e8:c9:52:dc:cd:a9:8e:82:a2:70:0a:30", other), ShouldBeFalse)
+	})
+}
+
 func TestSSHPrivateFingerprint(t *testing.T) {
 	Convey("Test generating SSH private key fingerprint", t, func() {
 		tmp, err := ioutil.ReadFile("testdata/testkey")
@@ -86,8 +156,109 @@ func TestSSHPrivateFingerprint(t *testing.T) {
 		key, err := ssh.ParseRawPrivateKey(tmp)
 		privkey := key.(*rsa.PrivateKey)
 		panic_the_err(err)
-		fingerprint, err := SSHPrivateFingerprint(*privkey)
+		fingerprint, err := SSHPrivateFingerprint(privkey)
 		So(err, ShouldEqual, nil)
-		So(fingerprint, ShouldEqual, "c0:61:84:fc:e8:c9:52:dc:cd:a9:8e:82:a2:70:0a:30")
+		So(fingerprint, ShouldEqual, "SHA256:Pm6krQJitfCTPVIYgpm1jG7hnmIPzCbc/AoaV12dW6s")
+	})
+}
+
+func TestEncodeDecodeECDH(t *testing.T) {
+	Convey("Test encoding and decoding for non-RSA keys", t, func() {
+		for _, name := range []string{"testdata/testkey_ed25519", "testdata/testkey_ecdsa"} {
+			pubkey, err := readSSHPubkeyFile(name + ".pub")
+			panic_the_err(err)
+			privkey, err := loadPrivateKey(name)
+			panic_the_err(err)
+
+			ciphertext, err := CredulousEncode("some plaintext", pubkey, []byte("metadata"))
+			So(err, ShouldEqual, nil)
+
+			plaintext, err := CredulousDecodeAESGCM(ciphertext, privkey, []byte("metadata"))
+			So(err, ShouldEqual, nil)
+			So(plaintext, ShouldEqual, "some plaintext")
+
+			_, err = CredulousDecodeAESGCM(ciphertext, privkey, []byte("tampered"))
+			So(err, ShouldNotEqual, nil)
+
+			fingerprint, err := SSHPrivateFingerprint(privkey)
+			So(err, ShouldEqual, nil)
+			So(fingerprint, ShouldEqual, SSHFingerprint(pubkey))
+		}
+	})
+}
+
+func TestEd25519ToX25519(t *testing.T) {
+	Convey("Test converting ed25519 keys to X25519", t, func() {
+		pubkey, err := readSSHPubkeyFile("testdata/testkey_ed25519.pub")
+		panic_the_err(err)
+		privkey, err := loadPrivateKey("testdata/testkey_ed25519")
+		panic_the_err(err)
+
+		fromPublic, err := sshPubkeyToECDHPubkey(pubkey)
+		So(err, ShouldEqual, nil)
+		fromPrivate, err := ed25519PrivateKeyToX25519(privkey.(ed25519.PrivateKey))
+		So(err, ShouldEqual, nil)
+		So(fromPublic.Equal(fromPrivate.PublicKey()), ShouldBeTrue)
+	})
+}
+
+func TestDecodeWithWrongKeyType(t *testing.T) {
+	Convey("Test that an RSA ciphertext can't be decoded with an ed25519 key", t, func() {
+		pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+		panic_the_err(err)
+		privkey, err := loadPrivateKey("testdata/testkey_ed25519")
+		panic_the_err(err)
+		ciphertext, err := CredulousEncode("some plaintext", pubkey, []byte("metadata"))
+		So(err, ShouldEqual, nil)
+		_, err = CredulousDecodeAESGCM(ciphertext, privkey, []byte("metadata"))
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
+func TestParsePrivateKeyFormats(t *testing.T) {
+	Convey("Test reading the test key in each supported format", t, func() {
+		passphrase := func() ([]byte, error) {
+			return []byte("credulous"), nil
+		}
+		noPassphrase := func() ([]byte, error) {
+			return nil, errors.New("should not have asked for a passphrase")
+		}
+		wrongPassphrase := func() ([]byte, error) {
+			return []byte("incredulous"), nil
+		}
+
+		for _, name := range []string{"testdata/testkey", "testdata/testkey.openssh", "testdata/testkey.pkcs8"} {
+			Convey("Unencrypted "+name, func() {
+				tmp, err := ioutil.ReadFile(name)
+				panic_the_err(err)
+				privkey, err := parsePrivateKey(tmp, noPassphrase)
+				So(err, ShouldEqual, nil)
+				fingerprint, err := SSHPrivateFingerprint(privkey)
+				So(err, ShouldEqual, nil)
+				So(fingerprint, ShouldEqual, "SHA256:Pm6krQJitfCTPVIYgpm1jG7hnmIPzCbc/AoaV12dW6s")
+			})
+		}
+
+		for _, name := range []string{"testdata/testkey_encrypted.pem", "testdata/testkey_encrypted.openssh", "testdata/testkey_encrypted.pkcs8"} {
+			Convey("Encrypted "+name, func() {
+				tmp, err := ioutil.ReadFile(name)
+				panic_the_err(err)
+				privkey, err := parsePrivateKey(tmp, passphrase)
+				So(err, ShouldEqual, nil)
+				fingerprint, err := SSHPrivateFingerprint(privkey)
+				So(err, ShouldEqual, nil)
+				So(fingerprint, ShouldEqual, "SHA256:Pm6krQJitfCTPVIYgpm1jG7hnmIPzCbc/AoaV12dW6s")
+
+				_, err = parsePrivateKey(tmp, wrongPassphrase)
+				So(err, ShouldNotEqual, nil)
+			})
+		}
+
+		Convey("Not a private key", func() {
+			tmp, err := ioutil.ReadFile("testdata/testkey.pub")
+			panic_the_err(err)
+			_, err = parsePrivateKey(tmp, noPassphrase)
+			So(err, ShouldNotEqual, nil)
+		})
 	})
 }
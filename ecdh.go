@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ECDSA and ed25519 keys can't encrypt anything directly, so for those
+// we generate an ephemeral key on the same curve, and derive the AES key
+// from the Diffie-Hellman shared secret. ed25519 keys are first converted
+// to their X25519 equivalents.
+type ECDHEncryption struct {
+	EphemeralKey string
+	Ciphertext   string
+}
+
+// the field prime for curve25519, 2^255 - 19
+var curve25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// reverse returns a reversed copy of b, to convert between the
+// little-endian encodings used by curve25519 and big.Int
+func reverse(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return out
+}
+
+// ed25519PublicKeyToX25519 maps an ed25519 point onto the birationally
+// equivalent Montgomery curve: u = (1 + y) / (1 - y) mod p
+func ed25519PublicKeyToX25519(pubkey ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(pubkey) != ed25519.PublicKeySize {
+		return nil, errors.New("Invalid ed25519 public key")
+	}
+	// y is little-endian, and the top bit holds the sign of x
+	yBytes := reverse(pubkey)
+	yBytes[0] &= 0x7f
+	y := new(big.Int).SetBytes(yBytes)
+
+	one := big.NewInt(1)
+	numerator := new(big.Int).Add(one, y)
+	denominator := new(big.Int).Sub(one, y)
+	denominator.Mod(denominator, curve25519P)
+	if denominator.Sign() == 0 {
+		return nil, errors.New("Invalid ed25519 public key")
+	}
+	u := new(big.Int).ModInverse(denominator, curve25519P)
+	u.Mul(u, numerator)
+	u.Mod(u, curve25519P)
+
+	uBytes := make([]byte, 32)
+	u.FillBytes(uBytes)
+	return ecdh.X25519().NewPublicKey(reverse(uBytes))
+}
+
+// ed25519PrivateKeyToX25519 uses the same scalar ed25519 derives from the
+// private key seed; X25519 clamps it the same way
+func ed25519PrivateKeyToX25519(privkey ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	hash := sha512.Sum512(privkey.Seed())
+	return ecdh.X25519().NewPrivateKey(hash[:32])
+}
+
+func sshPubkeyToECDHPubkey(pubkey ssh.PublicKey) (*ecdh.PublicKey, error) {
+	cryptoKey, ok := pubkey.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported SSH key type %s", pubkey.Type())
+	}
+	switch key := cryptoKey.CryptoPublicKey().(type) {
+	case ed25519.PublicKey:
+		return ed25519PublicKeyToX25519(key)
+	case *ecdsa.PublicKey:
+		return key.ECDH()
+	}
+	return nil, fmt.Errorf("Unsupported SSH key type %s", pubkey.Type())
+}
+
+func privateKeyToECDHKey(privkey interface{}) (*ecdh.PrivateKey, error) {
+	switch key := privkey.(type) {
+	case ed25519.PrivateKey:
+		return ed25519PrivateKeyToX25519(key)
+	case *ecdsa.PrivateKey:
+		return key.ECDH()
+	}
+	return nil, errors.New("Private key cannot be used for Diffie-Hellman key agreement")
+}
+
+// deriveECDHKey turns the shared secret into an AES key, binding in both
+// public keys so the ciphertext can't be replayed against another recipient
+func deriveECDHKey(shared []byte, ephemeral, recipient *ecdh.PublicKey) ([]byte, error) {
+	salt := append(ephemeral.Bytes(), recipient.Bytes()...)
+	return hkdf.Key(sha256.New, shared, salt, "Credulous", 32)
+}
+
+func encodeECDH(plaintext string, pubkey ssh.PublicKey, additionalData []byte) (*ECDHEncryption, error) {
+	recipient, err := sshPubkeyToECDHPubkey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	aesKey, err := deriveECDHKey(shared, ephemeral.PublicKey(), recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := encodeAESGCM(aesKey, plaintext, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ECDHEncryption{
+		EphemeralKey: base64.StdEncoding.EncodeToString(ephemeral.PublicKey().Bytes()),
+		Ciphertext:   encoded,
+	}, nil
+}
+
+func decodeECDH(encrypted ECDHEncryption, privkey interface{}, additionalData []byte) (string, error) {
+	key, err := privateKeyToECDHKey(privkey)
+	if err != nil {
+		return "", err
+	}
+
+	ephemeralBytes, err := base64.StdEncoding.DecodeString(encrypted.EphemeralKey)
+	if err != nil {
+		return "", err
+	}
+	ephemeral, err := key.Curve().NewPublicKey(ephemeralBytes)
+	if err != nil {
+		return "", err
+	}
+
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return "", err
+	}
+
+	aesKey, err := deriveECDHKey(shared, ephemeral, key.PublicKey())
+	if err != nil {
+		return "", err
+	}
+
+	return decodeAESGCM(aesKey, encrypted.Ciphertext, additionalData)
+}
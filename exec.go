@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// The variables which are always removed from the environment of a
+// command run by 'exec', so that it can't pick up stale credentials
+// left over from the calling shell
+var AWS_ENV_VARS = []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_SECURITY_TOKEN"}
+
+// splitExecArgs separates the optional username@account from the command
+// to run. The command should follow '--', but if it doesn't, the first
+// argument is taken to be the credentials only if it contains an '@'.
+func splitExecArgs(args []string) (credential string, command []string, err error) {
+	for i, arg := range args {
+		if arg != "--" {
+			continue
+		}
+		if i > 1 {
+			return "", nil, errors.New("Only one set of credentials may be specified before '--'")
+		}
+		if i == 1 {
+			credential = args[0]
+		}
+		command = args[i+1:]
+		break
+	}
+
+	if command == nil {
+		if len(args) > 0 && strings.Contains(args[0], "@") {
+			credential = args[0]
+			command = args[1:]
+		} else {
+			command = args
+		}
+	}
+
+	if len(command) == 0 {
+		return "", nil, errors.New("No command specified; try 'credulous exec username@account -- command'")
+	}
+	return credential, command, nil
+}
+
+// credentialEnvironment returns environ, with the credentials (and any
+// variables saved along with them) replacing any existing values
+func credentialEnvironment(environ []string, creds Credentials) []string {
+	vars := creds.environment()
+	replaced := make(map[string]bool)
+	for _, name := range AWS_ENV_VARS {
+		replaced[name] = true
+	}
+	for _, v := range vars {
+		replaced[v.name] = true
+	}
+
+	env := []string{}
+	for _, entry := range environ {
+		name := strings.SplitN(entry, "=", 2)[0]
+		if !replaced[name] {
+			env = append(env, entry)
+		}
+	}
+	for _, v := range vars {
+		env = append(env, v.name+"="+v.value)
+	}
+	return env
+}
+
+// runWithCredentials runs command with the credentials in its environment,
+// passing on any signals we receive, and returns its exit status
+func runWithCredentials(creds Credentials, command []string) (int, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = credentialEnvironment(os.Environ(), creds)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return 1, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// mimic the shell's convention for commands killed by a signal
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testCredentials() Credentials {
+	return Credentials{
+		IamUsername:      "testuser",
+		AccountAliasOrId: "testalias",
+		Encryptions: []Encryption{{
+			decoded: Credential{
+				KeyId:     "plaintextkeyid",
+				SecretKey: "plaintextsecret",
+				EnvVars:   map[string]string{"FOO": "bar", "BACON": "yummy"},
+			},
+		}},
+	}
+}
+
+func TestSplitExecArgs(t *testing.T) {
+	Convey("Test splitting exec arguments", t, func() {
+		Convey("Credentials and command separated by --", func() {
+			cred, command, err := splitExecArgs([]string{"user@account", "--", "terraform", "plan"})
+			So(err, ShouldEqual, nil)
+			So(cred, ShouldEqual, "user@account")
+			So(command, ShouldResemble, []string{"terraform", "plan"})
+		})
+		Convey("Command only", func() {
+			cred, command, err := splitExecArgs([]string{"terraform", "plan"})
+			So(err, ShouldEqual, nil)
+			So(cred, ShouldEqual, "")
+			So(command, ShouldResemble, []string{"terraform", "plan"})
+		})
+		Convey("Credentials and command without --", func() {
+			cred, command, err := splitExecArgs([]string{"user@account", "terraform", "plan"})
+			So(err, ShouldEqual, nil)
+			So(cred, ShouldEqual, "user@account")
+			So(command, ShouldResemble, []string{"terraform", "plan"})
+		})
+		Convey("Only the first -- separates", func() {
+			_, command, err := splitExecArgs([]string{"--", "env", "--", "foo"})
+			So(err, ShouldEqual, nil)
+			So(command, ShouldResemble, []string{"env", "--", "foo"})
+		})
+		Convey("No command", func() {
+			_, _, err := splitExecArgs([]string{"user@account", "--"})
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("Too many arguments before --", func() {
+			_, _, err := splitExecArgs([]string{"user@account", "other@account", "--", "ls"})
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestCredentialEnvironment(t *testing.T) {
+	Convey("Test building the environment for exec", t, func() {
+		environ := []string{"PATH=/bin", "FOO=old", "AWS_SESSION_TOKEN=stale", "AWS_ACCESS_KEY_ID=old"}
+		env := credentialEnvironment(environ, testCredentials())
+		So(env, ShouldResemble, []string{
+			"PATH=/bin",
+			"AWS_ACCESS_KEY_ID=plaintextkeyid",
+			"AWS_SECRET_ACCESS_KEY=plaintextsecret",
+			"BACON=yummy",
+			"FOO=bar",
+		})
+	})
+}
+
+func TestRunWithCredentials(t *testing.T) {
+	Convey("Test running a command with credentials", t, func() {
+		Convey("The command sees the credentials", func() {
+			status, err := runWithCredentials(testCredentials(),
+				[]string{"sh", "-c", `test "$AWS_ACCESS_KEY_ID" = plaintextkeyid -a "$FOO" = bar`})
+			So(err, ShouldEqual, nil)
+			So(status, ShouldEqual, 0)
+		})
+		Convey("The exit status is passed on", func() {
+			status, err := runWithCredentials(testCredentials(), []string{"sh", "-c", "exit 3"})
+			So(err, ShouldEqual, nil)
+			So(status, ShouldEqual, 3)
+		})
+		Convey("A command killed by a signal", func() {
+			status, err := runWithCredentials(testCredentials(), []string{"sh", "-c", "kill -TERM $$"})
+			So(err, ShouldEqual, nil)
+			So(status, ShouldEqual, 128+15)
+		})
+		Convey("A command that doesn't exist", func() {
+			_, err := runWithCredentials(testCredentials(), []string{"/no/such/command"})
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
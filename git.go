@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"os"
 	"path"
 	"time"
 
@@ -53,13 +54,57 @@ func getRepoConfig(repo *git.Repository) (RepoConfig, error) {
 	return repoconf, nil
 }
 
-func gitAddCommitFile(repopath, filename, message string) (commitId string, err error) {
-	repo, err := git.OpenRepository(repopath)
+// gitDefaultUser is the user.name and user.email in the global git
+// configuration, or else made up from the login and host names
+func gitDefaultUser() RepoConfig {
+	user := RepoConfig{}
+	if config, err := git.OpenDefault(); err == nil {
+		user.Name, _ = config.LookupString("user.name")
+		user.Email, _ = config.LookupString("user.email")
+	}
+	if user.Name == "" {
+		user.Name = os.Getenv("USER")
+	}
+	if user.Email == "" {
+		host, _ := os.Hostname()
+		user.Email = os.Getenv("USER") + "@" + host
+	}
+	return user
+}
+
+func setRepoConfig(repo *git.Repository, user RepoConfig) error {
+	config, err := repo.Config()
 	if err != nil {
-		return "", err
+		return err
+	}
+	err = config.SetString("user.name", user.Name)
+	if err != nil {
+		return err
 	}
+	return config.SetString("user.email", user.Email)
+}
 
-	config, err := getRepoConfig(repo)
+// gitInit makes dir a git repository that commits as user, and commits
+// the files given to it
+func gitInit(dir string, user RepoConfig, filenames []string, message string) error {
+	repo, err := git.InitRepository(dir, false)
+	if err != nil {
+		return err
+	}
+	err = setRepoConfig(repo, user)
+	if err != nil {
+		return err
+	}
+	_, err = gitAddCommitFiles(dir, filenames, message)
+	return err
+}
+
+func gitAddCommitFile(repopath, filename, message string) (commitId string, err error) {
+	return gitAddCommitFiles(repopath, []string{filename}, message)
+}
+
+func gitAddCommitFiles(repopath string, filenames []string, message string) (commitId string, err error) {
+	repo, err := git.OpenRepository(repopath)
 	if err != nil {
 		return "", err
 	}
@@ -69,28 +114,67 @@ func gitAddCommitFile(repopath, filename, message string) (commitId string, err
 		return "", err
 	}
 
-	err = index.AddByPath(filename)
+	for _, filename := range filenames {
+		err = index.AddByPath(filename)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return gitCommitIndex(repo, index, message)
+}
+
+func gitRemoveCommitFile(repopath, filename, message string) (commitId string, err error) {
+	repo, err := git.OpenRepository(repopath)
 	if err != nil {
 		return "", err
 	}
 
-	err = index.Write()
+	index, err := repo.Index()
 	if err != nil {
 		return "", err
 	}
 
-	treeId, err := index.WriteTree()
+	err = index.RemoveByPath(filename)
 	if err != nil {
 		return "", err
 	}
 
-	// new file is now staged, so we have to create a commit
-	sig := &git.Signature{
+	return gitCommitIndex(repo, index, message)
+}
+
+// gitSignature signs commits as the user.name and user.email configured
+// for the repository
+func gitSignature(repo *git.Repository) (*git.Signature, error) {
+	config, err := getRepoConfig(repo)
+	if err != nil {
+		return nil, err
+	}
+	return &git.Signature{
 		Name:  config.Name,
 		Email: config.Email,
 		When:  time.Now(),
+	}, nil
+}
+
+// gitCommitIndex commits whatever has been staged in index on top of HEAD
+func gitCommitIndex(repo *git.Repository, index *git.Index, message string) (commitId string, err error) {
+	sig, err := gitSignature(repo)
+	if err != nil {
+		return "", err
+	}
+
+	err = index.Write()
+	if err != nil {
+		return "", err
+	}
+
+	treeId, err := index.WriteTree()
+	if err != nil {
+		return "", err
 	}
 
+	// changes are now staged, so we have to create a commit
 	tree, err := repo.LookupTree(treeId)
 	if err != nil {
 		return "", err
@@ -103,7 +187,7 @@ func gitAddCommitFile(repopath, filename, message string) (commitId string, err
 	}
 	if !haslog {
 		// In this case, the repo has been initialized, but nothing has ever been committed
-		commit, err = repo.CreateCommit("HEAD", sig, sig, message, tree)
+		commit, err = gitCreateCommit(repo, sig, message, tree)
 		if err != nil {
 			return "", err
 		}
@@ -117,7 +201,7 @@ func gitAddCommitFile(repopath, filename, message string) (commitId string, err
 		if err != nil {
 			return "", err
 		}
-		commit, err = repo.CreateCommit("HEAD", sig, sig, message, tree, currentTip)
+		commit, err = gitCreateCommit(repo, sig, message, tree, currentTip)
 		if err != nil {
 			return "", err
 		}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -57,6 +58,12 @@ func TestGitAdd(t *testing.T) {
 			So(commitId, ShouldNotBeBlank)
 		})
 
+		Convey("Test remove a file from the repo", func() {
+			commitId, err := gitRemoveCommitFile(repo.Path(), "testfile", "third commit")
+			So(err, ShouldEqual, nil)
+			So(commitId, ShouldNotBeBlank)
+		})
+
 		Convey("Test checking whether a repo is a repo", func() {
 			fullpath, _ := filepath.Abs(repopath)
 			isrepo, err := isGitRepo(fullpath)
@@ -72,3 +79,202 @@ func TestGitAdd(t *testing.T) {
 
 	})
 }
+
+func TestGitSync(t *testing.T) {
+	Convey("Test syncing repositories through a bare remote", t, func() {
+		dir, err := ioutil.TempDir("", "credulous-sync")
+		panic_the_err(err)
+		defer os.RemoveAll(dir)
+		remote := filepath.Join(dir, "remote.git")
+		_, err = git.InitRepository(remote, true)
+		panic_the_err(err)
+
+		clone := func(name string) string {
+			repopath := filepath.Join(dir, name)
+			panic_the_err(gitClone(remote, repopath))
+			repo, err := git.OpenRepository(repopath)
+			panic_the_err(err)
+			config, _ := repo.Config()
+			_ = config.SetString("user.name", "Test User")
+			_ = config.SetString("user.email", "test.user@nowhere")
+			return repopath
+		}
+		commit := func(repopath, filename, content string) {
+			panic_the_err(ioutil.WriteFile(filepath.Join(repopath, filename), []byte(content), 0600))
+			_, err := gitAddCommitFile(repopath, filename, "Added "+filename)
+			panic_the_err(err)
+		}
+		read := func(repopath, filename string) string {
+			b, _ := ioutil.ReadFile(filepath.Join(repopath, filename))
+			return string(b)
+		}
+		alice := clone("alice")
+		bob := clone("bob")
+
+		So(gitClone(remote, alice), ShouldNotEqual, nil)
+		commit(alice, "one", "1")
+		So(gitSync(alice), ShouldEqual, nil)
+		So(gitSync(bob), ShouldEqual, nil)
+		So(read(bob, "one"), ShouldEqual, "1")
+
+		Convey("Changes on both sides are merged together", func() {
+			commit(alice, "two", "2")
+			commit(bob, "three", "3")
+			So(gitSync(alice), ShouldEqual, nil)
+			So(gitSync(bob), ShouldEqual, nil)
+			So(read(bob, "two"), ShouldEqual, "2")
+			So(gitSync(alice), ShouldEqual, nil)
+			So(read(alice, "three"), ShouldEqual, "3")
+		})
+
+		Convey("Files are merged whole, not line by line", func() {
+			commit(alice, "lines", "a\nb\nc\nd\ne\n")
+			So(gitSync(alice), ShouldEqual, nil)
+			So(gitSync(bob), ShouldEqual, nil)
+			commit(alice, "lines", "A\nb\nc\nd\ne\n")
+			commit(bob, "lines", "a\nb\nc\nd\nE\n")
+			So(gitSync(alice), ShouldEqual, nil)
+			err := gitSync(bob)
+			So(err, ShouldHaveSameTypeAs, &SyncConflictError{})
+			So(read(bob, "lines"), ShouldEqual, "a\nb\nc\nd\nE\n")
+		})
+
+		Convey("Conflicting changes are left for the user to resolve", func() {
+			commit(alice, "one", "alice")
+			commit(bob, "one", "bob")
+			So(gitSync(alice), ShouldEqual, nil)
+			err := gitSync(bob)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "one: changed differently on both sides")
+			So(read(bob, "one"), ShouldEqual, "bob")
+			// and the remote is left as it was
+			So(gitSync(alice), ShouldEqual, nil)
+			So(read(alice, "one"), ShouldEqual, "alice")
+		})
+
+		Convey("Repositories can be synced whenever anything is saved", func() {
+			So(gitAutoSync(alice), ShouldBeFalse)
+			So(gitSetAutoSync(alice, true), ShouldEqual, nil)
+			So(gitAutoSync(alice), ShouldBeTrue)
+			commit(alice, "four", "4")
+			syncAfterSave(alice)
+			So(gitSync(bob), ShouldEqual, nil)
+			So(read(bob, "four"), ShouldEqual, "4")
+		})
+	})
+}
+
+func TestGitInit(t *testing.T) {
+	Convey("Test creating a repository", t, func() {
+		home, err := ioutil.TempDir("", "credulous-init")
+		panic_the_err(err)
+		defer os.RemoveAll(home)
+		defer os.Setenv("HOME", os.Getenv("HOME"))
+		os.Setenv("HOME", home)
+
+		user := RepoConfig{Name: "Ford Prefect", Email: "ford@example.com"}
+		So(initRepo("ops", "Production", user), ShouldEqual, nil)
+		So(initRepo("ops", "Production", user), ShouldNotEqual, nil)
+
+		repopath := repoPath("ops")
+		isrepo, err := isGitRepo(repopath)
+		So(err, ShouldEqual, nil)
+		So(isrepo, ShouldBeTrue)
+		repo, err := git.OpenRepository(repopath)
+		So(err, ShouldEqual, nil)
+		config, err := getRepoConfig(repo)
+		So(err, ShouldEqual, nil)
+		So(config, ShouldResemble, user)
+
+		metadata, err := readRepoMetadata(repopath)
+		So(err, ShouldEqual, nil)
+		So(metadata.Description, ShouldEqual, "Production")
+		_, err = os.Stat(filepath.Join(repopath, GITATTRIBUTES))
+		So(err, ShouldEqual, nil)
+	})
+}
+
+func TestGitSigning(t *testing.T) {
+	Convey("Test signing commits, and verifying credentials with them", t, func() {
+		defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+		os.Setenv("SSH_AUTH_SOCK", "")
+		repopath, err := ioutil.TempDir("", "credulous-signing")
+		panic_the_err(err)
+		defer os.RemoveAll(repopath)
+		repo, err := git.InitRepository(repopath, false)
+		panic_the_err(err)
+		panic_the_err(setRepoConfig(repo, RepoConfig{Name: "Ford Prefect", Email: "ford@example.com"}))
+		keyfile, err := filepath.Abs("testdata/testkey_ed25519.pub")
+		panic_the_err(err)
+		So(gitSetSigning(repopath, "ssh", keyfile), ShouldEqual, nil)
+
+		recipient, err := newRecipient("ford", "", keyfile)
+		panic_the_err(err)
+		keyring := Keyring{Recipients: []Recipient{recipient}}
+		So(keyring.WriteToDisk(repopath, "Recipient ford added by Credulous"), ShouldEqual, nil)
+
+		relpath := filepath.Join("frood", "hoopy", "1402531200-abcd1234.json")
+		save := func(content string) error {
+			os.MkdirAll(filepath.Join(repopath, "frood", "hoopy"), 0700)
+			panic_the_err(ioutil.WriteFile(filepath.Join(repopath, relpath), []byte(content), 0600))
+			_, err := gitAddCommitFile(repopath, relpath, "Saved by Credulous")
+			return err
+		}
+		So(save(`{"Version": "2014-06-12"}`), ShouldEqual, nil)
+		So(gitVerifySignatures(repopath), ShouldBeFalse)
+		So(gitSetVerifySignatures(repopath, true), ShouldEqual, nil)
+		So(gitVerifySignatures(repopath), ShouldBeTrue)
+
+		signer, err := verifyCredentialFile(repopath, relpath)
+		So(err, ShouldEqual, nil)
+		So(signer, ShouldEqual, "ford")
+
+		Convey("Files changed since they were committed aren't trusted", func() {
+			panic_the_err(ioutil.WriteFile(filepath.Join(repopath, relpath), []byte("{}"), 0600))
+			_, err := verifyCredentialFile(repopath, relpath)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Nor are files committed without a signature", func() {
+			So(gitSetSigning(repopath, "", ""), ShouldEqual, nil)
+			So(save(`{"Version": "2014-06-12", "Replaced": true}`), ShouldEqual, nil)
+			_, err := verifyCredentialFile(repopath, relpath)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "is not signed")
+		})
+
+		Convey("Nor is a keyring changed by someone who wasn't in it", func() {
+			So(gitSetSigning(repopath, "ssh", "testdata/testkey.pub"), ShouldEqual, nil)
+			intruder, err := newRecipient("intruder", "", "testdata/testkey.pub")
+			panic_the_err(err)
+			keyring.Recipients = append(keyring.Recipients, intruder)
+			So(keyring.WriteToDisk(repopath, "Recipient intruder added by Credulous"), ShouldEqual, nil)
+			_, err = verifyCredentialFile(repopath, relpath)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "The keyring can't be trusted")
+		})
+
+		Convey("Nor is a keyring deleted and then added again by someone who wasn't in it", func() {
+			So(gitSetSigning(repopath, "ssh", "testdata/testkey.pub"), ShouldEqual, nil)
+			_, err := gitRemoveCommitFile(repopath, filepath.Join(KEYRING_DIR, KEYRING_FILE), "Keyring removed")
+			So(err, ShouldEqual, nil)
+			intruder, err := newRecipient("intruder", "", "testdata/testkey.pub")
+			panic_the_err(err)
+			intruders := Keyring{Recipients: []Recipient{intruder}}
+			So(intruders.WriteToDisk(repopath, "Recipient intruder added by Credulous"), ShouldEqual, nil)
+			So(save(`{"Version": "2014-06-12", "Replaced": true}`), ShouldEqual, nil)
+			_, err = verifyCredentialFile(repopath, relpath)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "The keyring can't be trusted")
+		})
+
+		Convey("But a keyring deleted and added again by someone in it is", func() {
+			_, err := gitRemoveCommitFile(repopath, filepath.Join(KEYRING_DIR, KEYRING_FILE), "Keyring removed")
+			So(err, ShouldEqual, nil)
+			So(keyring.WriteToDisk(repopath, "Recipient ford added by Credulous"), ShouldEqual, nil)
+			signer, err := verifyCredentialFile(repopath, relpath)
+			So(err, ShouldEqual, nil)
+			So(signer, ShouldEqual, "ford")
+		})
+	})
+}
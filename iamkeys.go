@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/url"
+)
+
+// Rotation manages access keys through IAM's Query API directly, as for
+// STS, since goamz can't deactivate a key
+const IAM_API_VERSION string = "2010-05-08"
+
+const (
+	ACCESS_KEY_ACTIVE   string = "Active"
+	ACCESS_KEY_INACTIVE string = "Inactive"
+)
+
+func newIAMClient(cred Credential, config AWSConfig) awsQuery {
+	return awsQuery{
+		cred:     cred,
+		service:  "iam",
+		region:   config.iamRegion(),
+		endpoint: config.IAMEndpoint,
+		version:  IAM_API_VERSION,
+	}
+}
+
+type accessKeyMetadata struct {
+	AccessKeyId string
+	Status      string
+	CreateDate  string
+}
+
+type listAccessKeysResponse struct {
+	Keys []accessKeyMetadata `xml:"ListAccessKeysResult>AccessKeyMetadata>member"`
+}
+
+type createAccessKeyResponse struct {
+	Key struct {
+		AccessKeyId     string
+		SecretAccessKey string
+	} `xml:"CreateAccessKeyResult>AccessKey"`
+}
+
+// IAM takes no username to mean the user whose key signed the request
+func iamUserParams(username string) url.Values {
+	params := url.Values{}
+	if username != "" {
+		params.Set("UserName", username)
+	}
+	return params
+}
+
+func listAccessKeys(client awsQuery, username string) ([]accessKeyMetadata, error) {
+	var resp listAccessKeysResponse
+	err := client.call("ListAccessKeys", iamUserParams(username), &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+func createAccessKey(client awsQuery, username string) (Credential, error) {
+	var resp createAccessKeyResponse
+	err := client.call("CreateAccessKey", iamUserParams(username), &resp)
+	if err != nil {
+		return Credential{}, err
+	}
+	return Credential{KeyId: resp.Key.AccessKeyId, SecretKey: resp.Key.SecretAccessKey}, nil
+}
+
+func updateAccessKey(client awsQuery, username, keyId, status string) error {
+	params := iamUserParams(username)
+	params.Set("AccessKeyId", keyId)
+	params.Set("Status", status)
+	return client.call("UpdateAccessKey", params, &struct{}{})
+}
+
+func deleteAccessKey(client awsQuery, username, keyId string) error {
+	params := iamUserParams(username)
+	params.Set("AccessKeyId", keyId)
+	return client.call("DeleteAccessKey", params, &struct{}{})
+}
+
+// isNoSuchEntity is true of the error for a key that's already gone
+func isNoSuchEntity(err error) bool {
+	awsErr, ok := err.(*AWSError)
+	return ok && awsErr.Code == "NoSuchEntity"
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rotating an access key takes several calls to IAM, any of which can
+// fail, and makes a secret key that exists only in memory until it has
+// been saved. So rotation goes a step at a time, in an order where a key
+// that works is always saved: the new key is created, saved and checked
+// before the old one is deactivated and, finally, deleted. Each step is
+// recorded in a journal before it's taken, so that 'rotate --resume' can
+// finish a rotation that was interrupted, and 'rotate --rollback' can
+// undo one, up until the old key has been deleted.
+const JOURNAL_DIR string = ".journal"
+
+const (
+	ROTATE_CREATE     string = "create"
+	ROTATE_SAVE       string = "save"
+	ROTATE_VERIFY     string = "verify"
+	ROTATE_DEACTIVATE string = "deactivate"
+	ROTATE_DELETE     string = "delete"
+)
+
+// how far IAM's clock may be behind ours, when telling whether a key was
+// made by an interrupted rotation
+const ROTATE_CLOCK_SKEW time.Duration = time.Minute
+
+type rotationJournal struct {
+	Repo     string
+	Alias    string
+	Username string
+	Step     string
+	OldKeyId string
+	NewKeyId string `json:",omitempty"`
+	// the file in the repository the new key was saved in
+	NewFile string `json:",omitempty"`
+	Started time.Time
+}
+
+func (journal rotationJournal) name() string {
+	return journal.Username + "@" + journal.Alias
+}
+
+// iamUsername is the user named in IAM requests; the root user's keys
+// are its own, so it's not named at all
+func (journal rotationJournal) iamUsername() string {
+	if journal.Username == journal.Alias {
+		return ""
+	}
+	return journal.Username
+}
+
+func journalDir() string {
+	return filepath.Join(getRootPath(), JOURNAL_DIR)
+}
+
+// readJournals finds the rotations that were interrupted
+func readJournals(dir string) ([]rotationJournal, error) {
+	filenames, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(filenames)
+	journals := []rotationJournal{}
+	for _, filename := range filenames {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		var journal rotationJournal
+		if err = json.Unmarshal(b, &journal); err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		journals = append(journals, journal)
+	}
+	return journals, nil
+}
+
+type keyRotation struct {
+	dir     string
+	journal rotationJournal
+	// what the new key is saved with, apart from the key itself
+	data SaveData
+	// the secrets found so far, by access key ID
+	keys map[string]Credential
+	// what the keys saved in the repository are decrypted with
+	keyfile string
+
+	now func() time.Time
+	// how long to wait for a new key to work, and how often to try it
+	timeout time.Duration
+	delay   time.Duration
+}
+
+func newKeyRotation(dir string, journal rotationJournal, data SaveData) *keyRotation {
+	return &keyRotation{
+		dir:     dir,
+		journal: journal,
+		data:    data,
+		keys:    map[string]Credential{},
+		now:     time.Now,
+		timeout: time.Duration(ROTATE_TIMEOUT) * time.Second,
+		delay:   time.Second,
+	}
+}
+
+// rotateCredentials replaces the access key in data.cred with a new one,
+// which is saved as data says, keeping the same environment variables
+func rotateCredentials(data SaveData) error {
+	journal := rotationJournal{
+		Repo:     data.repo,
+		Alias:    data.alias,
+		Username: data.username,
+		OldKeyId: data.cred.KeyId,
+	}
+	return newKeyRotation(journalDir(), journal, data).start()
+}
+
+// resumeRotation picks up an interrupted rotation from its journal;
+// keyfile decrypts the keys that were saved before it was interrupted
+func resumeRotation(dir string, journal rotationJournal, keyfile string, config AWSConfig) *keyRotation {
+	r := newKeyRotation(dir, journal, SaveData{repo: journal.Repo, config: config})
+	r.keyfile = keyfile
+	return r
+}
+
+func (r *keyRotation) path() string {
+	return filepath.Join(r.dir, r.journal.name()+".json")
+}
+
+func (r *keyRotation) write() error {
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(r.journal, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := r.path() + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path())
+}
+
+func (r *keyRotation) advance(step string) error {
+	r.journal.Step = step
+	return r.write()
+}
+
+func (r *keyRotation) start() error {
+	if _, err := os.Stat(r.path()); err == nil {
+		return errors.New("A rotation of the access key for " + r.journal.name() + " was interrupted; " +
+			"please finish it with 'credulous rotate --resume', or undo it with 'credulous rotate --rollback'")
+	}
+	r.keys[r.data.cred.KeyId] = r.data.cred
+	r.journal.Started = r.now().UTC()
+	if err := r.advance(ROTATE_CREATE); err != nil {
+		return err
+	}
+	return r.run()
+}
+
+// resume finishes the rotation, or if the new key was never saved (and so
+// is of no use to anyone) undoes it
+func (r *keyRotation) resume() error {
+	if r.journal.Step == ROTATE_CREATE || (r.journal.Step == ROTATE_SAVE && r.storedFile(r.journal.NewKeyId) == "") {
+		log.Print("WARNING: The rotation of the access key for " + r.journal.name() +
+			" was interrupted before the new key was saved; undoing it, so it can be rotated again")
+		return r.rollback()
+	}
+	return r.run()
+}
+
+func (r *keyRotation) run() error {
+	for {
+		var err error
+		switch r.journal.Step {
+		case ROTATE_CREATE:
+			err = r.create()
+		case ROTATE_SAVE:
+			err = r.save()
+		case ROTATE_VERIFY:
+			err = r.verify()
+		case ROTATE_DEACTIVATE:
+			err = r.deactivate()
+		case ROTATE_DELETE:
+			if err = r.deleteOld(); err == nil {
+				return os.Remove(r.path())
+			}
+		default:
+			err = errors.New("Unknown rotation step '" + r.journal.Step + "'")
+		}
+		if err == nil {
+			continue
+		}
+		// a rotation that was refused before it began leaves no journal
+		if _, statErr := os.Stat(r.path()); statErr != nil {
+			return err
+		}
+		return errors.New("Rotating the access key for " + r.journal.name() + " stopped at the " +
+			r.journal.Step + " step: " + err.Error() + "; please finish it with 'credulous rotate --resume'" +
+			", or undo it with 'credulous rotate --rollback'")
+	}
+}
+
+// refuse gives up on a rotation before anything has been changed
+func (r *keyRotation) refuse(err error) error {
+	os.Remove(r.path())
+	return err
+}
+
+// createdSinceStart is true of keys that an interrupted rotation made,
+// and whose secrets were lost
+func (r *keyRotation) createdSinceStart(key accessKeyMetadata) bool {
+	created, err := time.Parse(time.RFC3339, key.CreateDate)
+	return err == nil && !created.Before(r.journal.Started.Add(-ROTATE_CLOCK_SKEW))
+}
+
+// create makes the new key; until it has, nothing needs undoing
+func (r *keyRotation) create() error {
+	old, err := r.key(r.journal.OldKeyId)
+	if err != nil {
+		return r.refuse(err)
+	}
+	client := newIAMClient(old, r.data.config)
+	username := r.journal.iamUsername()
+	keys, err := listAccessKeys(client, username)
+	if err != nil {
+		return r.refuse(err)
+	}
+
+	// IAM users can only have two keys, so the other has to go; but only
+	// if it's not in use
+	found := false
+	for _, key := range keys {
+		switch {
+		case key.AccessKeyId == r.journal.OldKeyId:
+			found = true
+		case key.Status == ACCESS_KEY_INACTIVE:
+			if err = deleteAccessKey(client, username, key.AccessKeyId); err != nil && !isNoSuchEntity(err) {
+				return r.refuse(err)
+			}
+		default:
+			return r.refuse(errors.New(r.journal.name() + " already has another active access key, " +
+				key.AccessKeyId + "; please delete whichever is not in use before rotating"))
+		}
+	}
+	if !found {
+		return r.refuse(errors.New("The access key " + r.journal.OldKeyId + " does not belong to " + r.journal.name()))
+	}
+
+	cred, err := createAccessKey(client, username)
+	if _, refused := err.(*AWSError); refused {
+		return r.refuse(err)
+	}
+	// otherwise, the key may have been made without our hearing of it
+	if err != nil {
+		return err
+	}
+	cred.EnvVars = old.EnvVars
+	r.keys[cred.KeyId] = cred
+	r.journal.NewKeyId = cred.KeyId
+	return r.advance(ROTATE_SAVE)
+}
+
+func (r *keyRotation) save() error {
+	// it may have been saved just before the rotation was interrupted
+	if filename := r.storedFile(r.journal.NewKeyId); filename != "" {
+		r.journal.NewFile = filename
+		return r.advance(ROTATE_VERIFY)
+	}
+	cred, ok := r.keys[r.journal.NewKeyId]
+	if !ok {
+		return errors.New("The secret for the new access key " + r.journal.NewKeyId + " was lost before it was saved")
+	}
+
+	// the new key has only just been created, and whose it is is known,
+	// so there's nothing to look up
+	data := r.data
+	data.cred = cred
+	data.username = r.journal.Username
+	data.alias = r.journal.Alias
+	data.force = true
+	if err := SaveCredentials(data); err != nil {
+		return err
+	}
+	r.journal.NewFile = r.storedFile(r.journal.NewKeyId)
+	return r.advance(ROTATE_VERIFY)
+}
+
+// verify waits until the new key works, since IAM takes a while to
+// notice new keys
+func (r *keyRotation) verify() error {
+	cred, err := r.key(r.journal.NewKeyId)
+	if err != nil {
+		return err
+	}
+	client := newIAMClient(cred, r.data.config)
+	deadline := r.now().Add(r.timeout)
+	for {
+		var keys []accessKeyMetadata
+		keys, err = listAccessKeys(client, r.journal.iamUsername())
+		if err == nil {
+			for _, key := range keys {
+				if key.AccessKeyId == r.journal.NewKeyId {
+					return r.advance(ROTATE_DEACTIVATE)
+				}
+			}
+			return errors.New("The new access key " + r.journal.NewKeyId + " does not belong to " + r.journal.name())
+		}
+		if !r.now().Before(deadline) {
+			return errors.New("Timed out waiting for the new access key to work: " + err.Error())
+		}
+		time.Sleep(r.delay)
+	}
+}
+
+// deactivate stops the old key working before it's deleted; from here
+// on, the new key is used
+func (r *keyRotation) deactivate() error {
+	cred, err := r.key(r.journal.NewKeyId)
+	if err != nil {
+		return err
+	}
+	err = updateAccessKey(newIAMClient(cred, r.data.config), r.journal.iamUsername(), r.journal.OldKeyId, ACCESS_KEY_INACTIVE)
+	if err != nil && !isNoSuchEntity(err) {
+		return err
+	}
+	return r.advance(ROTATE_DELETE)
+}
+
+func (r *keyRotation) deleteOld() error {
+	cred, err := r.key(r.journal.NewKeyId)
+	if err != nil {
+		return err
+	}
+	err = deleteAccessKey(newIAMClient(cred, r.data.config), r.journal.iamUsername(), r.journal.OldKeyId)
+	if err != nil && !isNoSuchEntity(err) {
+		return err
+	}
+	return nil
+}
+
+// rollback undoes the rotation, so long as the old key hasn't been
+// deleted: the old key is made active again, and the new key deleted,
+// along with the file it was saved in
+func (r *keyRotation) rollback() error {
+	filename := r.journal.NewFile
+	if filename == "" && r.journal.NewKeyId != "" {
+		filename = r.storedFile(r.journal.NewKeyId)
+	}
+
+	if filename == "" {
+		// nothing was saved, so the old key is still the one in use
+		old, err := r.key(r.journal.OldKeyId)
+		if err != nil {
+			return err
+		}
+		client := newIAMClient(old, r.data.config)
+		username := r.journal.iamUsername()
+		keys, err := listAccessKeys(client, username)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if key.AccessKeyId == r.journal.OldKeyId {
+				continue
+			}
+			if key.AccessKeyId == r.journal.NewKeyId || r.createdSinceStart(key) {
+				if err = deleteAccessKey(client, username, key.AccessKeyId); err != nil && !isNoSuchEntity(err) {
+					return err
+				}
+			}
+		}
+		return os.Remove(r.path())
+	}
+
+	cred, err := r.key(r.journal.NewKeyId)
+	if err != nil {
+		return err
+	}
+	client := newIAMClient(cred, r.data.config)
+	username := r.journal.iamUsername()
+	keys, err := listAccessKeys(client, username)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, key := range keys {
+		found = found || key.AccessKeyId == r.journal.OldKeyId
+	}
+	if !found {
+		return errors.New("The old access key " + r.journal.OldKeyId + " for " + r.journal.name() +
+			" has already been deleted; the rotation can only be finished, with 'credulous rotate --resume'")
+	}
+	if err = updateAccessKey(client, username, r.journal.OldKeyId, ACCESS_KEY_ACTIVE); err != nil {
+		return err
+	}
+	if err = deleteAccessKey(client, username, r.journal.NewKeyId); err != nil && !isNoSuchEntity(err) {
+		return err
+	}
+	if err = r.removeStoredFile(filename); err != nil {
+		return err
+	}
+	return os.Remove(r.path())
+}
+
+// storedFile finds the newest file the key may be saved in, going by the
+// name it was saved under
+func (r *keyRotation) storedFile(keyId string) string {
+	if len(keyId) <= 12 {
+		return ""
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(r.journal.Repo, r.journal.Alias, r.journal.Username))
+	if err != nil {
+		return ""
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if strings.HasSuffix(entries[i].Name(), "-"+keyId[12:]+".json") {
+			return entries[i].Name()
+		}
+	}
+	return ""
+}
+
+func (r *keyRotation) removeStoredFile(filename string) error {
+	relpath := filepath.Join(r.journal.Alias, r.journal.Username, filename)
+	err := os.Remove(filepath.Join(r.journal.Repo, relpath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	isrepo, err := isGitRepo(r.journal.Repo)
+	if err != nil || !isrepo {
+		return err
+	}
+	_, err = gitRemoveCommitFile(r.journal.Repo, relpath, "Rotation rolled back by Credulous")
+	return err
+}
+
+// key finds the secret for an access key: one this rotation was given
+// or made, one saved in the repository, or the one in the environment
+func (r *keyRotation) key(keyId string) (Credential, error) {
+	if cred, ok := r.keys[keyId]; ok {
+		return cred, nil
+	}
+	if filename := r.storedFile(keyId); filename != "" {
+		relpath := filepath.Join(r.journal.Alias, r.journal.Username, filename)
+		if err := verifyIfRequired(r.journal.Repo, relpath); err != nil {
+			return Credential{}, err
+		}
+		creds, err := readCredentialFile(filepath.Join(r.journal.Repo, relpath), r.keyfile)
+		if err != nil {
+			return Credential{}, err
+		}
+		if cred := creds.Encryptions[0].decoded; cred.KeyId == keyId {
+			r.keys[keyId] = cred
+			return cred, nil
+		}
+	}
+	if cred, err := credentialFromEnvironment(); err == nil && cred.KeyId == keyId {
+		r.keys[keyId] = cred
+		return cred, nil
+	}
+	return Credential{}, errors.New("The secret for the access key " + keyId + " cannot be found")
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+type fakeAccessKey struct {
+	secret  string
+	status  string
+	created time.Time
+}
+
+// fakeIAM keeps one user's access keys, as IAM would
+type fakeIAM struct {
+	mutex sync.Mutex
+	keys  map[string]*fakeAccessKey
+	count int
+	// an action to fail, as though the connection had dropped
+	fail string
+}
+
+func (f *fakeIAM) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error><RequestId>fake</RequestId></ErrorResponse>`, code, code)
+}
+
+func (f *fakeIAM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	r.ParseForm()
+	action := r.PostForm.Get("Action")
+	signer := strings.SplitN(strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="), "/", 2)[0]
+	if key, ok := f.keys[signer]; !ok || key.status != ACCESS_KEY_ACTIVE {
+		f.error(w, http.StatusForbidden, "InvalidClientTokenId")
+		return
+	}
+	if action == f.fail {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	key := f.keys[r.PostForm.Get("AccessKeyId")]
+	switch action {
+	case "ListAccessKeys":
+		ids := []string{}
+		for id := range f.keys {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		fmt.Fprint(w, "<ListAccessKeysResponse><ListAccessKeysResult><AccessKeyMetadata>")
+		for _, id := range ids {
+			fmt.Fprintf(w, "<member><AccessKeyId>%s</AccessKeyId><Status>%s</Status><CreateDate>%s</CreateDate></member>",
+				id, f.keys[id].status, f.keys[id].created.Format(time.RFC3339))
+		}
+		fmt.Fprint(w, "</AccessKeyMetadata></ListAccessKeysResult></ListAccessKeysResponse>")
+	case "CreateAccessKey":
+		if len(f.keys) >= 2 {
+			f.error(w, http.StatusConflict, "LimitExceeded")
+			return
+		}
+		f.count++
+		id := fmt.Sprintf("AKIANEWKEYEXAMPLE%03d", f.count)
+		f.keys[id] = &fakeAccessKey{secret: "newsecret", status: ACCESS_KEY_ACTIVE, created: time.Now()}
+		fmt.Fprintf(w, "<CreateAccessKeyResponse><CreateAccessKeyResult><AccessKey><AccessKeyId>%s</AccessKeyId><SecretAccessKey>newsecret</SecretAccessKey></AccessKey></CreateAccessKeyResult></CreateAccessKeyResponse>", id)
+	case "UpdateAccessKey":
+		if key == nil {
+			f.error(w, http.StatusNotFound, "NoSuchEntity")
+			return
+		}
+		key.status = r.PostForm.Get("Status")
+		fmt.Fprint(w, "<UpdateAccessKeyResponse></UpdateAccessKeyResponse>")
+	case "DeleteAccessKey":
+		if key == nil {
+			f.error(w, http.StatusNotFound, "NoSuchEntity")
+			return
+		}
+		delete(f.keys, r.PostForm.Get("AccessKeyId"))
+		fmt.Fprint(w, "<DeleteAccessKeyResponse></DeleteAccessKeyResponse>")
+	default:
+		f.error(w, http.StatusBadRequest, "InvalidAction")
+	}
+}
+
+func (f *fakeIAM) keyIds() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ids := []string{}
+	for id, key := range f.keys {
+		ids = append(ids, id+":"+key.status)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestKeyRotation(t *testing.T) {
+	Convey("Test rotating an access key a step at a time", t, func() {
+		defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+		defer os.Setenv(AGENT_SOCK_ENV, os.Getenv(AGENT_SOCK_ENV))
+		os.Setenv("SSH_AUTH_SOCK", "")
+		dir, err := ioutil.TempDir("", "credulous-journal")
+		panic_the_err(err)
+		defer os.RemoveAll(dir)
+		os.Setenv(AGENT_SOCK_ENV, filepath.Join(dir, "agent.sock"))
+		journals := filepath.Join(dir, JOURNAL_DIR)
+		repo := filepath.Join(dir, "repo")
+
+		fake := &fakeIAM{keys: map[string]*fakeAccessKey{
+			"AKIAOLDKEYEXAMPLE123": {secret: "oldsecret", status: ACCESS_KEY_ACTIVE, created: time.Now().Add(-time.Hour)},
+		}}
+		server := httptest.NewServer(fake)
+		defer server.Close()
+		config := AWSConfig{Partition: "aws", Region: "us-east-1", IAMEndpoint: server.URL}
+
+		pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+		panic_the_err(err)
+		old := Credential{KeyId: "AKIAOLDKEYEXAMPLE123", SecretKey: "oldsecret", EnvVars: map[string]string{"FOO": "bar"}}
+		saveTestCredentials(repo, "frood", "hoopy", time.Now().Add(-time.Hour), 0, old, []ssh.PublicKey{pubkey})
+		data := SaveData{
+			cred:     old,
+			username: "hoopy",
+			alias:    "frood",
+			pubkeys:  []ssh.PublicKey{pubkey},
+			repo:     repo,
+			config:   config,
+		}
+		rotation := func() *keyRotation {
+			r := newKeyRotation(journals, rotationJournal{Repo: repo, Alias: "frood", Username: "hoopy", OldKeyId: old.KeyId}, data)
+			r.delay = time.Millisecond
+			return r
+		}
+		resumed := func() *keyRotation {
+			found, err := readJournals(journals)
+			panic_the_err(err)
+			So(len(found), ShouldEqual, 1)
+			r := resumeRotation(journals, found[0], "testdata/testkey", config)
+			r.delay = time.Millisecond
+			return r
+		}
+		latest := func() Credential {
+			creds, err := RetrieveCredentials(repo, "frood", "hoopy", "testdata/testkey")
+			panic_the_err(err)
+			return creds.Encryptions[0].decoded
+		}
+
+		Convey("The new key is saved before the old one is deleted", func() {
+			err := rotation().start()
+			So(err, ShouldEqual, nil)
+			So(fake.keyIds(), ShouldResemble, []string{"AKIANEWKEYEXAMPLE001:Active"})
+			So(latest().KeyId, ShouldEqual, "AKIANEWKEYEXAMPLE001")
+			So(latest().EnvVars["FOO"], ShouldEqual, "bar")
+			found, err := readJournals(journals)
+			So(err, ShouldEqual, nil)
+			So(len(found), ShouldEqual, 0)
+		})
+
+		Convey("A key that may be in use is never deleted", func() {
+			fake.keys["AKIAOTHERKEYEXAMPLE1"] = &fakeAccessKey{status: ACCESS_KEY_ACTIVE}
+			err := rotation().start()
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "AKIAOTHERKEYEXAMPLE1")
+			So(len(fake.keyIds()), ShouldEqual, 2)
+			found, _ := readJournals(journals)
+			So(len(found), ShouldEqual, 0)
+
+			Convey("But an inactive one is", func() {
+				fake.keys["AKIAOTHERKEYEXAMPLE1"].status = ACCESS_KEY_INACTIVE
+				err := rotation().start()
+				So(err, ShouldEqual, nil)
+				So(fake.keyIds(), ShouldResemble, []string{"AKIANEWKEYEXAMPLE001:Active"})
+			})
+		})
+
+		Convey("An interrupted rotation", func() {
+			fake.fail = "UpdateAccessKey"
+			err := rotation().start()
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "--resume")
+			So(fake.keyIds(), ShouldResemble, []string{"AKIANEWKEYEXAMPLE001:Active", "AKIAOLDKEYEXAMPLE123:Active"})
+			fake.fail = ""
+
+			// only one rotation at a time
+			err = rotation().start()
+			So(err, ShouldNotEqual, nil)
+
+			Convey("Can be resumed", func() {
+				r := resumed()
+				So(r.journal.Step, ShouldEqual, ROTATE_DEACTIVATE)
+				err := r.resume()
+				So(err, ShouldEqual, nil)
+				So(fake.keyIds(), ShouldResemble, []string{"AKIANEWKEYEXAMPLE001:Active"})
+				So(latest().KeyId, ShouldEqual, "AKIANEWKEYEXAMPLE001")
+			})
+
+			Convey("Or rolled back", func() {
+				err := resumed().rollback()
+				So(err, ShouldEqual, nil)
+				So(fake.keyIds(), ShouldResemble, []string{"AKIAOLDKEYEXAMPLE123:Active"})
+				So(latest().KeyId, ShouldEqual, "AKIAOLDKEYEXAMPLE123")
+				found, _ := readJournals(journals)
+				So(len(found), ShouldEqual, 0)
+			})
+
+			Convey("But not once the old key is gone", func() {
+				fake.fail = "DeleteAccessKey"
+				r := resumed()
+				So(r.resume(), ShouldNotEqual, nil)
+				So(r.journal.Step, ShouldEqual, ROTATE_DELETE)
+				delete(fake.keys, "AKIAOLDKEYEXAMPLE123")
+				fake.fail = ""
+				So(resumed().rollback(), ShouldNotEqual, nil)
+				So(resumed().resume(), ShouldEqual, nil)
+			})
+		})
+
+		Convey("A new key lost before it was saved is deleted", func() {
+			// as though the new key had been made, but the rotation
+			// stopped before it could be saved
+			r := rotation()
+			r.journal.Started = time.Now().UTC()
+			panic_the_err(r.advance(ROTATE_CREATE))
+			fake.keys["AKIANEWKEYEXAMPLE009"] = &fakeAccessKey{status: ACCESS_KEY_ACTIVE, created: time.Now()}
+
+			err := resumed().resume()
+			So(err, ShouldEqual, nil)
+			So(fake.keyIds(), ShouldResemble, []string{"AKIAOLDKEYEXAMPLE123:Active"})
+			So(latest().KeyId, ShouldEqual, "AKIAOLDKEYEXAMPLE123")
+			found, _ := readJournals(journals)
+			So(len(found), ShouldEqual, 0)
+		})
+	})
+}
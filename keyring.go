@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The keyring lists the people (and machines) that credentials in the
+// repository are encrypted for, so that everyone sharing it can tell
+// whose key a fingerprint is, and encrypt for the same people by name.
+// Groups name several recipients at once. Like role profiles, it holds
+// nothing secret, so it's saved as plain JSON.
+const (
+	KEYRING_DIR  string = ".keyring"
+	KEYRING_FILE string = "recipients.json"
+)
+
+var RECIPIENT_NAME_PATTERN = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.+=,@-]*$`)
+
+type Recipient struct {
+	Name  string
+	Email string `json:",omitempty"`
+	// in authorized_keys format
+	PublicKey   string
+	Fingerprint string
+	// of the OpenPGP key the recipient signs commits with, if any
+	PGPFingerprint string `json:",omitempty"`
+}
+
+type Keyring struct {
+	Recipients []Recipient
+	// the names of the recipients in each group
+	Groups map[string][]string `json:",omitempty"`
+}
+
+func keyringPath(repo string) string {
+	return filepath.Join(repo, KEYRING_DIR, KEYRING_FILE)
+}
+
+// readKeyring returns an empty keyring if the repository has none
+func readKeyring(repo string) (Keyring, error) {
+	keyring := Keyring{Recipients: []Recipient{}, Groups: map[string][]string{}}
+	b, err := ioutil.ReadFile(keyringPath(repo))
+	if os.IsNotExist(err) {
+		return keyring, nil
+	}
+	if err != nil {
+		return Keyring{}, err
+	}
+	if err = json.Unmarshal(b, &keyring); err != nil {
+		return Keyring{}, errors.New("Unable to read " + keyringPath(repo) + ": " + err.Error())
+	}
+	if keyring.Groups == nil {
+		keyring.Groups = map[string][]string{}
+	}
+	return keyring, nil
+}
+
+func (keyring Keyring) WriteToDisk(repo, message string) error {
+	b, err := json.MarshalIndent(keyring, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Join(repo, KEYRING_DIR), 0700)
+	err = ioutil.WriteFile(keyringPath(repo), append(b, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+	isrepo, err := isGitRepo(repo)
+	if err != nil || !isrepo {
+		return err
+	}
+	_, err = gitAddCommitFile(repo, filepath.Join(KEYRING_DIR, KEYRING_FILE), message)
+	return err
+}
+
+// publicKey parses the recipient's key, making sure it's the one the
+// fingerprint says it is
+func (recipient Recipient) publicKey() (ssh.PublicKey, error) {
+	pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(recipient.PublicKey))
+	if err != nil {
+		return nil, errors.New("Invalid public key for recipient '" + recipient.Name + "': " + err.Error())
+	}
+	if !fingerprintMatches(recipient.Fingerprint, pubkey) {
+		return nil, errors.New("The public key for recipient '" + recipient.Name + "' does not match its fingerprint")
+	}
+	return pubkey, nil
+}
+
+func hasMember(members []string, name string) bool {
+	for _, member := range members {
+		if member == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (keyring Keyring) find(name string) int {
+	for i, recipient := range keyring.Recipients {
+		if recipient.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// has says whether there's a recipient or a group of that name
+func (keyring Keyring) has(name string) bool {
+	_, ok := keyring.Groups[name]
+	return ok || keyring.find(name) >= 0
+}
+
+// add adds the recipient, or replaces the key and email of the one with
+// the same name, and puts it in the groups
+func (keyring *Keyring) add(recipient Recipient, groups []string) error {
+	if !RECIPIENT_NAME_PATTERN.MatchString(recipient.Name) {
+		return errors.New("Invalid recipient name '" + recipient.Name + "'")
+	}
+	if strings.ContainsAny(recipient.Email, " \t\r\n") {
+		return errors.New("Invalid email address '" + recipient.Email + "'")
+	}
+	if _, ok := keyring.Groups[recipient.Name]; ok {
+		return errors.New("There is already a group named '" + recipient.Name + "'")
+	}
+	if _, err := recipient.publicKey(); err != nil {
+		return err
+	}
+	for _, other := range keyring.Recipients {
+		if other.Name != recipient.Name && other.Fingerprint == recipient.Fingerprint {
+			return errors.New("That key is already in the keyring, as '" + other.Name + "'")
+		}
+	}
+
+	if i := keyring.find(recipient.Name); i >= 0 {
+		keyring.Recipients[i] = recipient
+	} else {
+		keyring.Recipients = append(keyring.Recipients, recipient)
+		sort.Slice(keyring.Recipients, func(i, j int) bool {
+			return keyring.Recipients[i].Name < keyring.Recipients[j].Name
+		})
+	}
+
+	for _, group := range groups {
+		if !RECIPIENT_NAME_PATTERN.MatchString(group) {
+			return errors.New("Invalid group name '" + group + "'")
+		}
+		if keyring.find(group) >= 0 {
+			return errors.New("There is already a recipient named '" + group + "'")
+		}
+		if !hasMember(keyring.Groups[group], recipient.Name) {
+			keyring.Groups[group] = append(keyring.Groups[group], recipient.Name)
+			sort.Strings(keyring.Groups[group])
+		}
+	}
+	return nil
+}
+
+// remove removes a recipient, from its groups too, or a whole group
+func (keyring *Keyring) remove(name string) error {
+	if _, ok := keyring.Groups[name]; ok {
+		delete(keyring.Groups, name)
+		return nil
+	}
+	i := keyring.find(name)
+	if i < 0 {
+		return errors.New("No recipient or group named '" + name + "'")
+	}
+	keyring.Recipients = append(keyring.Recipients[:i], keyring.Recipients[i+1:]...)
+	for group, members := range keyring.Groups {
+		remaining := []string{}
+		for _, member := range members {
+			if member != name {
+				remaining = append(remaining, member)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(keyring.Groups, group)
+		} else {
+			keyring.Groups[group] = remaining
+		}
+	}
+	return nil
+}
+
+// resolve finds the public keys of the named recipients, and of the
+// members of the named groups
+func (keyring Keyring) resolve(names []string) ([]ssh.PublicKey, error) {
+	pubkeys := []ssh.PublicKey{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		members, ok := keyring.Groups[name]
+		if !ok {
+			members = []string{name}
+		}
+		for _, member := range members {
+			i := keyring.find(member)
+			if i < 0 {
+				return nil, errors.New("No recipient or group named '" + member + "'; add one with 'credulous keys add'")
+			}
+			pubkey, err := keyring.Recipients[i].publicKey()
+			if err != nil {
+				return nil, err
+			}
+			if fingerprint := SSHFingerprint(pubkey); !seen[fingerprint] {
+				seen[fingerprint] = true
+				pubkeys = append(pubkeys, pubkey)
+			}
+		}
+	}
+	return pubkeys, nil
+}
+
+// publicKeys returns every recipient's key, passing over any that don't
+// match their fingerprints
+func (keyring Keyring) publicKeys() []ssh.PublicKey {
+	pubkeys := []ssh.PublicKey{}
+	for _, recipient := range keyring.Recipients {
+		if pubkey, err := recipient.publicKey(); err == nil {
+			pubkeys = append(pubkeys, pubkey)
+		}
+	}
+	return pubkeys
+}
+
+// groupsOf lists the groups the recipient is in
+func (keyring Keyring) groupsOf(name string) []string {
+	groups := []string{}
+	for group, members := range keyring.Groups {
+		if hasMember(members, name) {
+			groups = append(groups, group)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+func newRecipient(name, email, keyfile string) (Recipient, error) {
+	pubkey, err := readSSHPubkeyFile(keyfile)
+	if err != nil {
+		return Recipient{}, err
+	}
+	return Recipient{
+		Name:        name,
+		Email:       email,
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubkey))),
+		Fingerprint: SSHFingerprint(pubkey),
+	}, nil
+}
+
+func writeKeyring(output io.Writer, keyring Keyring) error {
+	w := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tEMAIL\tFINGERPRINT\tGROUPS")
+	for _, recipient := range keyring.Recipients {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", recipient.Name, recipient.Email, recipient.Fingerprint,
+			strings.Join(keyring.groupsOf(recipient.Name), ","))
+	}
+	return w.Flush()
+}
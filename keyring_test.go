@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKeyring(t *testing.T) {
+	Convey("Test keeping the recipients of a repository's credentials", t, func() {
+		repo, err := ioutil.TempDir("", "credulous-keyring")
+		panic_the_err(err)
+		defer os.RemoveAll(repo)
+
+		keyring, err := readKeyring(repo)
+		So(err, ShouldEqual, nil)
+		So(len(keyring.Recipients), ShouldEqual, 0)
+
+		alice, err := newRecipient("alice", "alice@example.com", "testdata/testkey.pub")
+		panic_the_err(err)
+		bob, err := newRecipient("bob", "", "testdata/testkey_ed25519.pub")
+		panic_the_err(err)
+		So(keyring.add(alice, []string{"team-ops"}), ShouldEqual, nil)
+		So(keyring.add(bob, []string{"team-ops", "oncall"}), ShouldEqual, nil)
+		So(keyring.WriteToDisk(repo, "Recipients added"), ShouldEqual, nil)
+
+		keyring, err = readKeyring(repo)
+		So(err, ShouldEqual, nil)
+		So(len(keyring.Recipients), ShouldEqual, 2)
+		So(keyring.groupsOf("bob"), ShouldResemble, []string{"oncall", "team-ops"})
+
+		Convey("Names and groups resolve to public keys, each once", func() {
+			pubkeys, err := keyring.resolve([]string{"alice", "team-ops"})
+			So(err, ShouldEqual, nil)
+			So(len(pubkeys), ShouldEqual, 2)
+			So(SSHFingerprint(pubkeys[0]), ShouldEqual, alice.Fingerprint)
+
+			_, err = keyring.resolve([]string{"zaphod"})
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Recipients and groups can't be confused", func() {
+			ford, err := newRecipient("team-ops", "", "testdata/testkey_ecdsa.pub")
+			panic_the_err(err)
+			So(keyring.add(ford, nil), ShouldNotEqual, nil)
+			ford.Name = "ford"
+			So(keyring.add(ford, []string{"alice"}), ShouldNotEqual, nil)
+			ford.Name = "../ford"
+			So(keyring.add(ford, nil), ShouldNotEqual, nil)
+		})
+
+		Convey("A key is only added once", func() {
+			alice.Name = "alice2"
+			So(keyring.add(alice, nil), ShouldNotEqual, nil)
+		})
+
+		Convey("Removing a recipient removes it from its groups", func() {
+			So(keyring.remove("bob"), ShouldEqual, nil)
+			So(keyring.Groups["team-ops"], ShouldResemble, []string{"alice"})
+			_, ok := keyring.Groups["oncall"]
+			So(ok, ShouldBeFalse)
+			So(keyring.remove("bob"), ShouldNotEqual, nil)
+
+			So(keyring.remove("team-ops"), ShouldEqual, nil)
+			So(len(keyring.Recipients), ShouldEqual, 1)
+		})
+
+		Convey("A key that doesn't match its fingerprint is refused", func() {
+			keyring.Recipients[0].PublicKey = bob.PublicKey
+			_, err := keyring.resolve([]string{"alice"})
+			So(err, ShouldNotEqual, nil)
+			So(len(keyring.publicKeys()), ShouldEqual, 1)
+		})
+
+		Convey("The keyring can be listed", func() {
+			var out bytes.Buffer
+			So(writeKeyring(&out, keyring), ShouldEqual, nil)
+			So(out.String(), ShouldContainSubstring, alice.Fingerprint)
+			So(out.String(), ShouldContainSubstring, "oncall,team-ops")
+		})
+	})
+}
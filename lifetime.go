@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The lifetime of saved credentials is counted in seconds from the
+// creation of their access key (their CreateTime). Credentials are
+// refused once it has run out, and warned about once less than a tenth
+// of it is left, or a week, whichever is less.
+const LIFETIME_WARNING time.Duration = 7 * 24 * time.Hour
+
+// parseDuration accepts a number of seconds, anything time.ParseDuration
+// does, and a number of days in front of either, as in "90d" or "1d12h"
+func parseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.Atoi(s); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	invalid := errors.New("Invalid duration '" + s + "'; use a number of seconds, or eg. 90d or 12h")
+
+	var days time.Duration
+	if i := strings.Index(s, "d"); i >= 0 {
+		n, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return 0, invalid
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		s = s[i+1:]
+		if s == "" {
+			return days, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || (days != 0 && d < 0) {
+		return 0, invalid
+	}
+	return days + d, nil
+}
+
+// formatDuration is the inverse of parseDuration, to the minute
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return "less than a minute"
+	}
+	d = d.Truncate(time.Minute)
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours := d / time.Hour
+	minutes := (d - hours*time.Hour) / time.Minute
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh%dm", hours, minutes)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
+
+// expiresAt is when the credentials' lifetime runs out; ok is false if
+// they have no lifetime, and last until they're rotated
+func (creds Credentials) expiresAt() (expiry time.Time, ok bool, err error) {
+	if creds.LifeTime <= 0 {
+		return time.Time{}, false, nil
+	}
+	created, err := strconv.ParseInt(creds.CreateTime, 10, 64)
+	if err != nil {
+		return time.Time{}, false, errors.New("Invalid creation time '" + creds.CreateTime + "'")
+	}
+	return time.Unix(created, 0).Add(time.Duration(creds.LifeTime) * time.Second), true, nil
+}
+
+// checkLifetime refuses credentials whose lifetime has run out, unless
+// ignore is set, and warns about those whose lifetime soon will
+func (creds Credentials) checkLifetime(now time.Time, ignore bool) error {
+	expiry, ok, err := creds.expiresAt()
+	if err != nil || !ok {
+		return err
+	}
+	name := creds.IamUsername + "@" + creds.AccountAliasOrId
+	remaining := expiry.Sub(now)
+	if remaining <= 0 {
+		if ignore {
+			log.Print("WARNING: The lifetime of the credentials for " + name + " ran out " + formatDuration(-remaining) + " ago")
+			return nil
+		}
+		return errors.New("The lifetime of the credentials for " + name + " ran out at " +
+			expiry.Local().Format(time.RFC1123) + "; please rotate them, or use --ignore-expiry")
+	}
+	if remaining < creds.lifetimeWarning() {
+		log.Print("WARNING: The lifetime of the credentials for " + name + " runs out in " + formatDuration(remaining) + "; please rotate them")
+	}
+	return nil
+}
+
+// lifetimeWarning is how long before the end of their lifetime that
+// credentials are warned about
+func (creds Credentials) lifetimeWarning() time.Duration {
+	warning := time.Duration(creds.LifeTime) * time.Second / 10
+	if warning > LIFETIME_WARNING {
+		warning = LIFETIME_WARNING
+	}
+	return warning
+}
+
+type credentialStatus struct {
+	name    string
+	repo    string
+	created time.Time
+	expiry  time.Time
+	expires bool
+}
+
+// readCredentialStatuses finds the latest credentials for every user in
+// every repository, reading only what's saved alongside the encrypted
+// credentials. Those that expire soonest come first.
+func readCredentialStatuses(rootPath string) ([]credentialStatus, error) {
+	statuses := []credentialStatus{}
+	repos, err := ioutil.ReadDir(rootPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, repo := range repos {
+		if !repo.IsDir() || strings.HasPrefix(repo.Name(), ".") {
+			continue
+		}
+		stored, err := findStoredCredentials(filepath.Join(rootPath, repo.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range stored {
+			status, err := s.status()
+			if err != nil {
+				return nil, err
+			}
+			status.repo = repo.Name()
+			statuses = append(statuses, status)
+		}
+	}
+
+	sort.SliceStable(statuses, func(i, j int) bool {
+		a, b := statuses[i], statuses[j]
+		if a.expires != b.expires {
+			return a.expires
+		}
+		if a.expires && !a.expiry.Equal(b.expiry) {
+			return a.expiry.Before(b.expiry)
+		}
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		return a.repo < b.repo
+	})
+	return statuses, nil
+}
+
+// readLatestMetadata reads what's saved alongside the latest encrypted
+// credentials in dir, without decrypting them
+func readLatestMetadata(dir string) (creds Credentials, filename string, err error) {
+	latest, err := latestFileInDir(dir)
+	if err != nil {
+		return Credentials{}, "", err
+	}
+	filename = filepath.Join(dir, latest.Name())
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return Credentials{}, "", err
+	}
+	if err = json.Unmarshal(b, &creds); err != nil {
+		return Credentials{}, "", fmt.Errorf("%s: %s", filename, err)
+	}
+	return creds, filename, nil
+}
+
+func (stored storedCredential) status() (credentialStatus, error) {
+	status := credentialStatus{name: stored.metadata.IamUsername + "@" + stored.metadata.AccountAliasOrId}
+	if created, err := strconv.ParseInt(stored.metadata.CreateTime, 10, 64); err == nil {
+		status.created = time.Unix(created, 0)
+	}
+	var err error
+	status.expiry, status.expires, err = stored.metadata.expiresAt()
+	if err != nil {
+		return credentialStatus{}, fmt.Errorf("%s: %s", stored.filename, err)
+	}
+	return status, nil
+}
+
+func (status credentialStatus) remaining(now time.Time) string {
+	if !status.expires {
+		return "never expires"
+	}
+	remaining := status.expiry.Sub(now)
+	if remaining <= 0 {
+		return "expired " + formatDuration(-remaining) + " ago"
+	}
+	return "expires in " + formatDuration(remaining)
+}
+
+func writeCredentialStatuses(output io.Writer, statuses []credentialStatus, now time.Time) error {
+	w := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CREDENTIALS\tREPOSITORY\tCREATED\tSTATUS")
+	for _, status := range statuses {
+		created := "unknown"
+		if !status.created.IsZero() {
+			created = status.created.Local().Format("2006-01-02")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", status.name, status.repo, created, status.remaining(now))
+	}
+	return w.Flush()
+}
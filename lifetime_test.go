@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseDuration(t *testing.T) {
+	Convey("Test parsing durations", t, func() {
+		good := map[string]time.Duration{
+			"":       0,
+			"0":      0,
+			"3600":   time.Hour,
+			"12h":    12 * time.Hour,
+			"90d":    90 * 24 * time.Hour,
+			"1d12h":  36 * time.Hour,
+			"1h30m":  90 * time.Minute,
+			" 30d  ": 30 * 24 * time.Hour,
+		}
+		for s, expected := range good {
+			d, err := parseDuration(s)
+			So(err, ShouldEqual, nil)
+			So(d, ShouldEqual, expected)
+		}
+		for _, s := range []string{"forever", "d", "1.5d", "12x", "1d-1h"} {
+			_, err := parseDuration(s)
+			So(err, ShouldNotEqual, nil)
+		}
+	})
+
+	Convey("Test formatting durations", t, func() {
+		So(formatDuration(30*time.Second), ShouldEqual, "less than a minute")
+		So(formatDuration(45*time.Minute), ShouldEqual, "45m")
+		So(formatDuration(3*time.Hour+20*time.Minute+10*time.Second), ShouldEqual, "3h20m")
+		So(formatDuration(36*time.Hour), ShouldEqual, "1d12h")
+	})
+}
+
+func TestCheckLifetime(t *testing.T) {
+	Convey("Test enforcing the credential lifetime", t, func() {
+		created := time.Date(2014, 6, 12, 0, 0, 0, 0, time.UTC)
+		creds := testCredentials()
+		creds.CreateTime = fmt.Sprintf("%d", created.Unix())
+		creds.LifeTime = 30 * 24 * 60 * 60
+
+		expiry, ok, err := creds.expiresAt()
+		So(err, ShouldEqual, nil)
+		So(ok, ShouldBeTrue)
+		So(expiry.Equal(created.Add(30*24*time.Hour)), ShouldBeTrue)
+
+		So(creds.checkLifetime(created.Add(24*time.Hour), false), ShouldEqual, nil)
+		// a warning, but usable
+		So(creds.checkLifetime(created.Add(29*24*time.Hour), false), ShouldEqual, nil)
+
+		err = creds.checkLifetime(created.Add(31*24*time.Hour), false)
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldContainSubstring, "testuser@testalias")
+		So(creds.checkLifetime(created.Add(31*24*time.Hour), true), ShouldEqual, nil)
+
+		Convey("Credentials without a lifetime last forever", func() {
+			creds.LifeTime = 0
+			_, ok, err := creds.expiresAt()
+			So(err, ShouldEqual, nil)
+			So(ok, ShouldBeFalse)
+			So(creds.checkLifetime(created.Add(1000*24*time.Hour), false), ShouldEqual, nil)
+		})
+	})
+}
+
+func TestCredentialStatus(t *testing.T) {
+	Convey("Test showing when credentials expire", t, func() {
+		root, err := ioutil.TempDir("", "credulous-status")
+		panic_the_err(err)
+		defer os.RemoveAll(root)
+		now := time.Date(2014, 6, 12, 0, 0, 0, 0, time.UTC)
+
+		write := func(repo, alias, username string, created time.Time, lifetime int) {
+			dir := filepath.Join(root, repo, alias, username)
+			os.MkdirAll(dir, 0700)
+			creds := fmt.Sprintf(`{"Version": "2014-06-12", "IamUsername": %q, "AccountAliasOrId": %q, "CreateTime": "%d", "LifeTime": %d}`,
+				username, alias, created.Unix(), lifetime)
+			err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d-creds.json", created.Unix())), []byte(creds), 0600)
+			panic_the_err(err)
+		}
+		write("local", "frood", "hoopy", now.Add(-10*24*time.Hour), 0)
+		write("local", "frood", "zaphod", now.Add(-10*24*time.Hour), 30*24*60*60)
+		write("team", "heartofgold", "ford", now.Add(-40*24*time.Hour), 30*24*60*60)
+		os.MkdirAll(filepath.Join(root, ".cache", "sessions", "frood"), 0700)
+		os.MkdirAll(filepath.Join(root, "local", ".roles"), 0700)
+		// a user whose credentials haven't been saved doesn't stop the rest
+		os.MkdirAll(filepath.Join(root, "team", "heartofgold", "arthur"), 0700)
+
+		statuses, err := readCredentialStatuses(root)
+		So(err, ShouldEqual, nil)
+		So(len(statuses), ShouldEqual, 3)
+		_, _, err = readLatestMetadata(filepath.Join(root, "team", "heartofgold", "arthur"))
+		So(err, ShouldEqual, errNoCredentialsSaved)
+		_, _, err = readLatestMetadata(filepath.Join(root, "team", "heartofgold", "trillian"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+		So(statuses[0].name, ShouldEqual, "ford@heartofgold")
+		So(statuses[0].repo, ShouldEqual, "team")
+		So(statuses[0].remaining(now), ShouldEqual, "expired 10d0h ago")
+		So(statuses[1].name, ShouldEqual, "zaphod@frood")
+		So(statuses[1].remaining(now), ShouldEqual, "expires in 20d0h")
+		So(statuses[2].name, ShouldEqual, "hoopy@frood")
+		So(statuses[2].remaining(now), ShouldEqual, "never expires")
+
+		var output bytes.Buffer
+		err = writeCredentialStatuses(&output, statuses, now)
+		So(err, ShouldEqual, nil)
+		lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+		So(len(lines), ShouldEqual, 4)
+		So(lines[0], ShouldStartWith, "CREDENTIALS")
+		So(lines[1], ShouldStartWith, "ford@heartofgold")
+		So(lines[1], ShouldEndWith, "expired 10d0h ago")
+	})
+}
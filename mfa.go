@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Session credentials obtained with an MFA code are cached, so that the
+// code needn't be entered every time they're sourced. The cache is kept
+// outside the repositories (it's never committed), and is encrypted just
+// like saved credentials, for the SSH key that decrypted the long-term
+// credentials. The session's expiry is kept in the (authenticated)
+// metadata, so that a stale session is spotted without decrypting it.
+const SESSION_CACHE_DIR string = ".cache/sessions"
+
+// cached sessions this close to expiry aren't worth handing out
+const SESSION_EXPIRY_MARGIN time.Duration = 5 * time.Minute
+
+var MFA_CODE_PATTERN = regexp.MustCompile(`^[0-9]{6}$`)
+
+type MFAOptions struct {
+	serial       string
+	code         string
+	duration     int
+	force        bool
+	ignoreExpiry bool
+	config       AWSConfig
+}
+
+// sessionCachePath is where the user's session is cached; the same user
+// may be saved in more than one repository, so each has its own cache
+func sessionCachePath(repo, alias, username string) string {
+	return filepath.Join(getRootPath(), SESSION_CACHE_DIR, sessionCacheRepo(repo), alias, username+".json")
+}
+
+// sessionCacheRepo names a repository in ~/.credulous by its name, and
+// any other by a hash of its path, which can't be mistaken for a name as
+// it starts with a dot
+func sessionCacheRepo(repo string) string {
+	path, err := filepath.Abs(repo)
+	if err != nil {
+		path = repo
+	}
+	if filepath.Dir(path) == filepath.Clean(getRootPath()) {
+		return filepath.Base(path)
+	}
+	return fmt.Sprintf(".%x", sha256.Sum256([]byte(path)))[:17]
+}
+
+// mfaSerialForArn guesses the ARN of an IAM user's virtual MFA device,
+// which is named for the user unless they chose otherwise
+func mfaSerialForArn(arn string) (string, error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || !strings.HasPrefix(parts[5], "user/") {
+		return "", errors.New("Cannot work out the MFA device for " + arn + "; please specify it with --mfa-serial")
+	}
+	fields := strings.Split(parts[5], "/")
+	return strings.Join(parts[:5], ":") + ":mfa/" + fields[len(fields)-1], nil
+}
+
+func defaultMFASerial(cred Credential, config AWSConfig) (string, error) {
+	id, err := getCallerIdentity(newSTSClient(cred, config))
+	if err != nil {
+		return "", err
+	}
+	return mfaSerialForArn(id.Arn)
+}
+
+func readMFACode(serial string) (string, error) {
+	// stdout is probably being eval'd, so prompt on stderr
+	if _, err := fmt.Fprintf(os.Stderr, "Enter MFA code for %s: ", serial); err != nil {
+		return "", err
+	}
+	line, err := readLine(os.Stdin)
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// readLine reads up to and including a newline a byte at a time, so as
+// not to read ahead into what's left of stdin for the command 'exec' runs
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			line = append(line, b[0])
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+		}
+		if err != nil {
+			return string(line), err
+		}
+	}
+}
+
+func writeSessionCache(path string, session Credentials, pubkey ssh.PublicKey) error {
+	decoded := session.Encryptions[0].decoded
+	expiry, err := time.Parse(time.RFC3339, decoded.Expiration)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	cache := Credentials{
+		Version:          FORMAT_VERSION,
+		IamUsername:      session.IamUsername,
+		AccountAliasOrId: session.AccountAliasOrId,
+		CreateTime:       fmt.Sprintf("%d", now.Unix()),
+		LifeTime:         int(expiry.Sub(now) / time.Second),
+	}
+	plaintext, err := json.Marshal(decoded)
+	if err != nil {
+		return err
+	}
+	err = cache.encrypt(plaintext, []ssh.PublicKey{pubkey})
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// readCachedSession returns ok == false if there's no usable session in
+// the cache; expired sessions are removed
+func readCachedSession(path, keyfile, alias, username string) (session Credentials, ok bool) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Credentials{}, false
+	}
+	var metadata Credentials
+	if err = json.Unmarshal(b, &metadata); err != nil {
+		return Credentials{}, false
+	}
+	created, err := strconv.ParseInt(metadata.CreateTime, 10, 64)
+	expiry := time.Unix(created, 0).Add(time.Duration(metadata.LifeTime) * time.Second)
+	if err != nil || time.Now().Add(SESSION_EXPIRY_MARGIN).After(expiry) {
+		os.Remove(path)
+		return Credentials{}, false
+	}
+
+	creds, err := parseCredential(b, keyfile)
+	if err != nil {
+		log.Print("WARNING: Unable to read cached MFA session: " + err.Error())
+		return Credentials{}, false
+	}
+	if creds.IamUsername != username || creds.AccountAliasOrId != alias {
+		return Credentials{}, false
+	}
+	expired, err := creds.Encryptions[0].decoded.expired(time.Now().Add(SESSION_EXPIRY_MARGIN))
+	if err != nil || expired {
+		os.Remove(path)
+		return Credentials{}, false
+	}
+	return *creds, true
+}
+
+// loadMFASession returns cached session credentials for the user if it
+// can; otherwise it decrypts their long-term credentials, and exchanges
+// them and an MFA code for new session credentials, which it caches
+func loadMFASession(repo, alias, username, keyfile string, opts MFAOptions) (Credentials, error) {
+	cachePath := sessionCachePath(repo, alias, username)
+	if session, ok := readCachedSession(cachePath, keyfile, alias, username); ok {
+		return session, nil
+	}
+
+	creds, err := RetrieveCredentials(repo, alias, username, keyfile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	err = creds.checkLifetime(time.Now(), opts.ignoreExpiry)
+	if err != nil {
+		return Credentials{}, err
+	}
+	if !opts.force {
+		err = creds.ValidateCredentials(alias, username, opts.config)
+		if err != nil {
+			return Credentials{}, err
+		}
+	}
+	base := creds.Encryptions[0].decoded
+	if base.temporary() {
+		return Credentials{}, errors.New("MFA sessions can only be started with long-term credentials")
+	}
+
+	serial := opts.serial
+	if serial == "" {
+		serial, err = defaultMFASerial(base, opts.config)
+		if err != nil {
+			return Credentials{}, err
+		}
+	}
+	code := opts.code
+	if code == "" {
+		code, err = readMFACode(serial)
+		if err != nil {
+			return Credentials{}, err
+		}
+	}
+	if !MFA_CODE_PATTERN.MatchString(code) {
+		return Credentials{}, errors.New("MFA codes are six digits")
+	}
+
+	cred, err := getSessionToken(newSTSClient(base, opts.config), serial, code, opts.duration)
+	if err != nil {
+		return Credentials{}, err
+	}
+	session := creds.withCredential(cred)
+
+	pubkey := creds.Encryptions[0].pubkey
+	if pubkey == nil {
+		log.Print("WARNING: Not caching the MFA session; these credentials are in the old format")
+	} else if err = writeSessionCache(cachePath, session, pubkey); err != nil {
+		log.Print("WARNING: Unable to cache the MFA session: " + err.Error())
+	}
+	return session, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMFASerialForArn(t *testing.T) {
+	Convey("Test guessing MFA device ARNs", t, func() {
+		serial, err := mfaSerialForArn("arn:aws:iam::123456789012:user/bob")
+		So(err, ShouldEqual, nil)
+		So(serial, ShouldEqual, "arn:aws:iam::123456789012:mfa/bob")
+
+		serial, err = mfaSerialForArn("arn:aws:iam::123456789012:user/division/bob")
+		So(err, ShouldEqual, nil)
+		So(serial, ShouldEqual, "arn:aws:iam::123456789012:mfa/bob")
+
+		_, err = mfaSerialForArn("arn:aws:sts::123456789012:assumed-role/Deployer/bob")
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
+func testSession(expiry time.Time) Credentials {
+	creds := testCredentials()
+	return creds.withCredential(Credential{
+		KeyId:        "ASIAsession",
+		SecretKey:    "sessionsecret",
+		SessionToken: "sessiontoken",
+		Expiration:   expiry.UTC().Format(time.RFC3339),
+	})
+}
+
+func TestSessionCache(t *testing.T) {
+	Convey("Test caching MFA sessions", t, func() {
+		defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+		os.Setenv("SSH_AUTH_SOCK", "")
+		dir, err := ioutil.TempDir("", "credulous-cache")
+		panic_the_err(err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "testalias", "testuser.json")
+		pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+		panic_the_err(err)
+
+		Convey("A current session is read back", func() {
+			err := writeSessionCache(path, testSession(time.Now().Add(time.Hour)), pubkey)
+			So(err, ShouldEqual, nil)
+			info, err := os.Stat(path)
+			So(err, ShouldEqual, nil)
+			So(info.Mode().Perm(), ShouldEqual, 0600)
+
+			session, ok := readCachedSession(path, "testdata/testkey", "testalias", "testuser")
+			So(ok, ShouldBeTrue)
+			So(session.Encryptions[0].decoded.SessionToken, ShouldEqual, "sessiontoken")
+			So(session.Encryptions[0].decoded.EnvVars["FOO"], ShouldEqual, "bar")
+
+			_, ok = readCachedSession(path, "testdata/testkey", "otheralias", "testuser")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("A session about to expire is discarded", func() {
+			err := writeSessionCache(path, testSession(time.Now().Add(time.Minute)), pubkey)
+			So(err, ShouldEqual, nil)
+			_, ok := readCachedSession(path, "testdata/testkey", "testalias", "testuser")
+			So(ok, ShouldBeFalse)
+			_, err = os.Stat(path)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("There's no session to read", func() {
+			_, ok := readCachedSession(path, "testdata/testkey", "testalias", "testuser")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestLoadMFASession(t *testing.T) {
+	Convey("Test starting an MFA session", t, func() {
+		defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+		os.Setenv("SSH_AUTH_SOCK", "")
+		home, err := ioutil.TempDir("", "credulous-home")
+		panic_the_err(err)
+		defer os.RemoveAll(home)
+		defer os.Setenv("HOME", os.Getenv("HOME"))
+		os.Setenv("HOME", home)
+
+		repo := filepath.Join(home, ".credulous", "local")
+		os.MkdirAll(filepath.Join(repo, "testalias", "testuser"), 0700)
+		b, err := ioutil.ReadFile("testdata/aeadcreds.json")
+		panic_the_err(err)
+		err = ioutil.WriteFile(filepath.Join(repo, "testalias", "testuser", "1401515273-creds.json"), b, 0600)
+		panic_the_err(err)
+
+		requests := 0
+		var form map[string][]string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests += 1
+			r.ParseForm()
+			form = r.PostForm
+			w.Write([]byte(`<GetSessionTokenResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetSessionTokenResult>
+    <Credentials>
+      <AccessKeyId>ASIAsession</AccessKeyId>
+      <SecretAccessKey>sessionsecret</SecretAccessKey>
+      <SessionToken>sessiontoken</SessionToken>
+      <Expiration>` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `</Expiration>
+    </Credentials>
+  </GetSessionTokenResult>
+</GetSessionTokenResponse>`))
+		}))
+		defer server.Close()
+
+		opts := MFAOptions{
+			serial: "arn:aws:iam::123456789012:mfa/testuser",
+			code:   "123456",
+			force:  true,
+			config: AWSConfig{Region: "us-east-1", STSEndpoint: server.URL},
+		}
+		session, err := loadMFASession(repo, "testalias", "testuser", "testdata/testkey", opts)
+		So(err, ShouldEqual, nil)
+		So(requests, ShouldEqual, 1)
+		So(form["Action"], ShouldResemble, []string{"GetSessionToken"})
+		So(form["SerialNumber"], ShouldResemble, []string{opts.serial})
+		So(form["TokenCode"], ShouldResemble, []string{"123456"})
+		So(session.Encryptions[0].decoded.KeyId, ShouldEqual, "ASIAsession")
+
+		Convey("The session is cached", func() {
+			opts.code = ""
+			session, err := loadMFASession(repo, "testalias", "testuser", "testdata/testkey", opts)
+			So(err, ShouldEqual, nil)
+			So(requests, ShouldEqual, 1)
+			So(session.Encryptions[0].decoded.SessionToken, ShouldEqual, "sessiontoken")
+		})
+
+		Convey("But not for the same user in another repository", func() {
+			other := filepath.Join(home, ".credulous", "other")
+			os.MkdirAll(filepath.Join(other, "testalias", "testuser"), 0700)
+			err := ioutil.WriteFile(filepath.Join(other, "testalias", "testuser", "1401515273-creds.json"), b, 0600)
+			panic_the_err(err)
+			So(sessionCachePath(other, "testalias", "testuser"), ShouldNotEqual, sessionCachePath(repo, "testalias", "testuser"))
+			So(sessionCachePath("./local", "testalias", "testuser"), ShouldNotEqual, sessionCachePath(repo, "testalias", "testuser"))
+			_, err = loadMFASession(other, "testalias", "testuser", "testdata/testkey", opts)
+			So(err, ShouldEqual, nil)
+			So(requests, ShouldEqual, 2)
+		})
+
+		Convey("Bad MFA codes are refused before calling STS", func() {
+			os.RemoveAll(filepath.Join(home, ".credulous", SESSION_CACHE_DIR))
+			opts.code = "12345"
+			_, err := loadMFASession(repo, "testalias", "testuser", "testdata/testkey", opts)
+			So(err, ShouldNotEqual, nil)
+			So(requests, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestReadLine(t *testing.T) {
+	Convey("Test reading a line without reading past it", t, func() {
+		input := strings.NewReader("123456\nfor the command\n")
+		line, err := readLine(input)
+		So(err, ShouldEqual, nil)
+		So(line, ShouldEqual, "123456\n")
+		rest, err := ioutil.ReadAll(input)
+		So(err, ShouldEqual, nil)
+		So(string(rest), ShouldEqual, "for the command\n")
+
+		line, err = readLine(strings.NewReader("654321"))
+		So(err, ShouldEqual, io.EOF)
+		So(line, ShouldEqual, "654321")
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// The version of the credential_process output format, as documented at
+// https://docs.aws.amazon.com/cli/latest/topic/config-vars.html
+const PROCESS_FORMAT_VERSION int = 1
+
+// processCredential is what the AWS CLI and SDKs expect on the standard
+// output of a credential_process; without an Expiration, they take the
+// credentials never to expire
+type processCredential struct {
+	Version         int
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string `json:",omitempty"`
+	Expiration      string `json:",omitempty"`
+}
+
+// DisplayProcess writes the credentials for a credential_process. There's
+// no way of passing on the environment variables saved with them.
+func (cred Credentials) DisplayProcess(output io.Writer) error {
+	decoded := cred.Encryptions[0].decoded
+	b, err := json.MarshalIndent(processCredential{
+		Version:         PROCESS_FORMAT_VERSION,
+		AccessKeyId:     decoded.KeyId,
+		SecretAccessKey: decoded.SecretKey,
+		SessionToken:    decoded.SessionToken,
+		Expiration:      decoded.Expiration,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDisplayProcess(t *testing.T) {
+	Convey("Test writing credentials for a credential_process", t, func() {
+		Convey("Long-term credentials don't expire", func() {
+			testWriter := TestWriter{}
+			err := testCredentials().DisplayProcess(&testWriter)
+			So(err, ShouldEqual, nil)
+			var out map[string]interface{}
+			So(json.Unmarshal(testWriter.Written, &out), ShouldEqual, nil)
+			So(out, ShouldResemble, map[string]interface{}{
+				"Version":         float64(1),
+				"AccessKeyId":     "plaintextkeyid",
+				"SecretAccessKey": "plaintextsecret",
+			})
+		})
+
+		Convey("Session credentials come with their token and expiry", func() {
+			expiry := time.Date(2014, 6, 12, 1, 0, 0, 0, time.UTC)
+			testWriter := TestWriter{}
+			err := testSession(expiry).DisplayProcess(&testWriter)
+			So(err, ShouldEqual, nil)
+			var out processCredential
+			So(json.Unmarshal(testWriter.Written, &out), ShouldEqual, nil)
+			So(out.Version, ShouldEqual, 1)
+			So(out.SessionToken, ShouldEqual, "sessiontoken")
+			So(out.Expiration, ShouldEqual, "2014-06-12T01:00:00Z")
+		})
+	})
+}
+
+func TestAskPassphrase(t *testing.T) {
+	Convey("Test asking a program for the passphrase", t, func() {
+		dir, err := ioutil.TempDir("", "credulous-askpass")
+		panic_the_err(err)
+		defer os.RemoveAll(dir)
+		defer os.Setenv("CREDULOUS_ASKPASS", os.Getenv("CREDULOUS_ASKPASS"))
+		defer os.Setenv("SSH_ASKPASS", os.Getenv("SSH_ASKPASS"))
+		os.Setenv("SSH_ASKPASS", "")
+
+		askpass := filepath.Join(dir, "askpass")
+		err = ioutil.WriteFile(askpass, []byte("#!/bin/sh\necho credulous\n"), 0700)
+		panic_the_err(err)
+
+		Convey("The program's passphrase decrypts the key", func() {
+			os.Setenv("CREDULOUS_ASKPASS", askpass)
+			passphrase, err := askPassphrase("Enter passphrase: ")
+			So(err, ShouldEqual, nil)
+			So(string(passphrase), ShouldEqual, "credulous")
+			tmp, err := ioutil.ReadFile("testdata/testkey_encrypted.pem")
+			panic_the_err(err)
+			_, err = parsePrivateKey(tmp, func() ([]byte, error) {
+				return askPassphrase("Enter passphrase: ")
+			})
+			So(err, ShouldEqual, nil)
+		})
+
+		Convey("SSH_ASKPASS is used too", func() {
+			os.Setenv("CREDULOUS_ASKPASS", "")
+			os.Setenv("SSH_ASKPASS", askpass)
+			passphrase, err := askPassphrase("Enter passphrase: ")
+			So(err, ShouldEqual, nil)
+			So(string(passphrase), ShouldEqual, "credulous")
+		})
+
+		Convey("A failing program is an error", func() {
+			os.Setenv("CREDULOUS_ASKPASS", filepath.Join(dir, "missing"))
+			_, err := askPassphrase("Enter passphrase: ")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Without a program, there's nothing to ask", func() {
+			os.Setenv("CREDULOUS_ASKPASS", "")
+			_, err := askPassphrase("Enter passphrase: ")
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
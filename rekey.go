@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 'credulous rekey' encrypts the latest credentials saved for each user in
+// a repository (or for those named) for a new set of recipients, as when
+// someone joins the team or leaves it, without saving them again from the
+// environment. Each is saved to a new file, with the same metadata, so
+// that lifetimes are unaffected, and the old file is left as it is: files
+// are never changed once saved, so two people rekeying the same
+// credentials don't conflict when their repositories are merged. Someone
+// who's removed can still read what they could before in the repository's
+// history, so the credentials they could read should be rotated as well.
+type rekeyer struct {
+	repo       string
+	keyfile    string
+	candidates []ssh.PublicKey
+	// if replace is set, the credentials are encrypted for exactly those
+	// keys; otherwise for those they were, and add, less any in remove
+	replace []ssh.PublicKey
+	add     []ssh.PublicKey
+	// fingerprints
+	remove []string
+	dryRun bool
+}
+
+func (r rekeyer) removed(fingerprint string) bool {
+	for _, remove := range r.remove {
+		if remove == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rekeyer) removedKey(pubkey ssh.PublicKey) bool {
+	for _, remove := range r.remove {
+		if fingerprintMatches(remove, pubkey) {
+			return true
+		}
+	}
+	return false
+}
+
+// recipientsFor works out who the credentials should be encrypted for,
+// and whether that's any different from who they are
+func (r rekeyer) recipientsFor(stored storedCredential) (pubkeys []ssh.PublicKey, changed bool, err error) {
+	found, missing := recipients(stored.metadata, r.candidates)
+	if r.replace != nil {
+		pubkeys = append(pubkeys, r.replace...)
+	} else {
+		unknown := []string{}
+		for _, fingerprint := range missing {
+			if !r.removed(fingerprint) {
+				unknown = append(unknown, fingerprint)
+			}
+		}
+		if len(unknown) > 0 {
+			return nil, false, errors.New(stored.filename + " is also encrypted for " + strings.Join(unknown, ", ") +
+				", whose public key can't be found; please add it to the keyring, or remove it with --remove")
+		}
+		for _, pubkey := range found {
+			if !r.removedKey(pubkey) {
+				pubkeys = append(pubkeys, pubkey)
+			}
+		}
+		pubkeys = append(pubkeys, r.add...)
+	}
+
+	unique := []ssh.PublicKey{}
+	seen := map[string]bool{}
+	for _, pubkey := range pubkeys {
+		if fingerprint := SSHFingerprint(pubkey); !seen[fingerprint] {
+			seen[fingerprint] = true
+			unique = append(unique, pubkey)
+		}
+	}
+	if len(unique) == 0 {
+		return nil, false, errors.New("Nobody would be able to decrypt " + stored.filename)
+	}
+
+	changed = len(missing) > 0 || len(found) != len(unique)
+	for _, pubkey := range found {
+		if !seen[SSHFingerprint(pubkey)] {
+			changed = true
+		}
+	}
+	return unique, changed, nil
+}
+
+// run rekeys the named credentials, or all of them if none are named,
+// returning the names of those it rekeyed; one set that can't be rekeyed
+// (because the caller can't decrypt it, say) doesn't stop the others
+func (r rekeyer) run(names []string) (rekeyed []string, err error) {
+	stored, err := findStoredCredentials(r.repo)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		selected := []storedCredential{}
+		for _, name := range names {
+			found := false
+			for _, s := range stored {
+				if s.name() == name {
+					selected = append(selected, s)
+					found = true
+				}
+			}
+			if !found {
+				return nil, errors.New("No credentials saved for " + name)
+			}
+		}
+		stored = selected
+	}
+
+	due, failed := 0, 0
+	for _, s := range stored {
+		pubkeys, changed, err := r.recipientsFor(s)
+		if err == nil && !changed {
+			continue
+		}
+		due++
+		if err == nil {
+			if r.dryRun {
+				fmt.Printf("would rekey %s\n", s.name())
+			} else {
+				fmt.Printf("rekeying %s\n", s.name())
+				err = r.rekeyOne(s, pubkeys)
+			}
+		}
+		if err != nil {
+			log.Print("WARNING: Not rekeying " + s.name() + ": " + err.Error())
+			failed++
+			continue
+		}
+		rekeyed = append(rekeyed, s.name())
+	}
+	if len(rekeyed) > 0 && !r.dryRun {
+		syncAfterSave(r.repo)
+	}
+	if failed > 0 {
+		return rekeyed, fmt.Errorf("%d of %d credentials could not be rekeyed", failed, due)
+	}
+	return rekeyed, nil
+}
+
+func (r rekeyer) rekeyOne(stored storedCredential, pubkeys []ssh.PublicKey) error {
+	// rekeying commits the credentials under the rekeyer's name, so it
+	// mustn't vouch for a file that couldn't be used as it is
+	relpath := filepath.Join(stored.alias, stored.username, filepath.Base(stored.filename))
+	if err := verifyIfRequired(r.repo, relpath); err != nil {
+		return err
+	}
+	creds, ok := agentGetCredentials(r.repo, stored.alias, stored.username)
+	if !ok {
+		decrypted, err := readCredentialFile(stored.filename, r.keyfile)
+		if err != nil {
+			return errors.New("Unable to decrypt " + stored.filename + ": " + err.Error())
+		}
+		creds = *decrypted
+	}
+	plaintext, err := json.Marshal(creds.Encryptions[0].decoded)
+	if err != nil {
+		return err
+	}
+
+	rekeyed := Credentials{
+		Version:          FORMAT_VERSION,
+		IamUsername:      stored.username,
+		AccountAliasOrId: stored.alias,
+		CreateTime:       creds.CreateTime,
+		LifeTime:         creds.LifeTime,
+	}
+	if err = rekeyed.encrypt(plaintext, pubkeys); err != nil {
+		return err
+	}
+	return rekeyed.writeAndCommit(r.repo, rekeyedFilename(stored.filename, creds, time.Now()), "Rekeyed by Credulous")
+}
+
+// rekeyedFilename names the file rekeyed credentials are saved to as save
+// would, making sure it sorts after the file they were read from, so that
+// it's the latest
+func rekeyedFilename(filename string, creds Credentials, now time.Time) string {
+	t := now.Unix()
+	previous := filepath.Base(filename)
+	if i := strings.Index(previous, "-"); i > 0 {
+		if saved, err := strconv.ParseInt(previous[:i], 10, 64); err == nil && saved >= t {
+			t = saved + 1
+		}
+	}
+	return fmt.Sprintf("%d-%s.json", t, creds.Encryptions[0].decoded.KeyId[12:])
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libgit2/git2go"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRekey(t *testing.T) {
+	Convey("Test encrypting stored credentials for new recipients", t, func() {
+		defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+		defer os.Setenv(AGENT_SOCK_ENV, os.Getenv(AGENT_SOCK_ENV))
+		os.Setenv("SSH_AUTH_SOCK", "")
+		repo, err := ioutil.TempDir("", "credulous-rekey")
+		panic_the_err(err)
+		defer os.RemoveAll(repo)
+		os.Setenv(AGENT_SOCK_ENV, filepath.Join(repo, ".agent.sock"))
+
+		rsaKey, err := readSSHPubkeyFile("testdata/testkey.pub")
+		panic_the_err(err)
+		ed25519Key, err := readSSHPubkeyFile("testdata/testkey_ed25519.pub")
+		panic_the_err(err)
+		ecdsaKey, err := readSSHPubkeyFile("testdata/testkey_ecdsa.pub")
+		panic_the_err(err)
+		created := time.Now().Add(-time.Hour)
+		cred := Credential{
+			KeyId:     "AKIAOLDKEYEXAMPLE123",
+			SecretKey: "oldsecret",
+			EnvVars:   map[string]string{"FOO": "bar"},
+		}
+		saveTestCredentials(repo, "frood", "hoopy", created, 3600*24, cred, []ssh.PublicKey{rsaKey})
+		saveTestCredentials(repo, "frood", "zaphod", created, 0, cred, []ssh.PublicKey{rsaKey})
+
+		r := rekeyer{
+			repo:       repo,
+			keyfile:    "testdata/testkey",
+			candidates: []ssh.PublicKey{rsaKey, ed25519Key, ecdsaKey},
+			add:        []ssh.PublicKey{ed25519Key},
+		}
+		decrypt := func(username, keyfile string) (Credentials, error) {
+			return RetrieveCredentials(repo, "frood", username, keyfile)
+		}
+
+		Convey("A dry run changes nothing", func() {
+			r.dryRun = true
+			rekeyed, err := r.run(nil)
+			So(err, ShouldEqual, nil)
+			So(rekeyed, ShouldResemble, []string{"hoopy@frood", "zaphod@frood"})
+			_, err = decrypt("hoopy", "testdata/testkey_ed25519")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Recipients can be added to some of the credentials", func() {
+			rekeyed, err := r.run([]string{"hoopy@frood"})
+			So(err, ShouldEqual, nil)
+			So(rekeyed, ShouldResemble, []string{"hoopy@frood"})
+			creds, err := decrypt("hoopy", "testdata/testkey_ed25519")
+			So(err, ShouldEqual, nil)
+			So(creds.Encryptions[0].decoded.EnvVars["FOO"], ShouldEqual, "bar")
+			So(creds.LifeTime, ShouldEqual, 3600*24)
+			So(creds.CreateTime, ShouldEqual, fmt.Sprintf("%d", created.Unix()))
+			files, err := ioutil.ReadDir(filepath.Join(repo, "frood", "hoopy"))
+			panic_the_err(err)
+			So(len(files), ShouldEqual, 2)
+			So(files[0].Name(), ShouldEqual, fmt.Sprintf("%d-%s.json", created.Unix(), cred.KeyId[12:]))
+			_, err = decrypt("zaphod", "testdata/testkey_ed25519")
+			So(err, ShouldNotEqual, nil)
+
+			Convey("And aren't added twice", func() {
+				rekeyed, err := r.run(nil)
+				So(err, ShouldEqual, nil)
+				So(rekeyed, ShouldResemble, []string{"zaphod@frood"})
+			})
+
+			Convey("And removed again", func() {
+				r.add = nil
+				r.remove = []string{SSHFingerprint(rsaKey)}
+				rekeyed, err := r.run([]string{"hoopy@frood"})
+				So(err, ShouldEqual, nil)
+				So(rekeyed, ShouldResemble, []string{"hoopy@frood"})
+				_, err = decrypt("hoopy", "testdata/testkey")
+				So(err, ShouldNotEqual, nil)
+				_, err = decrypt("hoopy", "testdata/testkey_ed25519")
+				So(err, ShouldEqual, nil)
+			})
+		})
+
+		Convey("Credentials the caller can't decrypt are reported", func() {
+			saveTestCredentials(repo, "frood", "ford", created, 0, cred, []ssh.PublicKey{ecdsaKey})
+			rekeyed, err := r.run(nil)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldEqual, "1 of 3 credentials could not be rekeyed")
+			So(rekeyed, ShouldResemble, []string{"hoopy@frood", "zaphod@frood"})
+		})
+
+		Convey("Credentials that can't be verified aren't rekeyed", func() {
+			gitrepo, err := git.InitRepository(repo, false)
+			panic_the_err(err)
+			config, err := gitrepo.Config()
+			panic_the_err(err)
+			panic_the_err(config.SetBool(VERIFY_SIGNATURES_KEY, true))
+			rekeyed, err := r.run([]string{"hoopy@frood"})
+			So(err, ShouldNotEqual, nil)
+			So(rekeyed, ShouldBeEmpty)
+			creds, _, err := readLatestMetadata(filepath.Join(repo, "frood", "hoopy"))
+			So(err, ShouldEqual, nil)
+			So(len(creds.Encryptions), ShouldEqual, 1)
+		})
+
+		Convey("Nobody is left out, or left able to decrypt nothing", func() {
+			r.candidates = []ssh.PublicKey{ed25519Key}
+			_, err := r.run([]string{"hoopy@frood"})
+			So(err, ShouldNotEqual, nil)
+
+			r.candidates = []ssh.PublicKey{rsaKey}
+			r.add = nil
+			r.remove = []string{SSHFingerprint(rsaKey)}
+			_, err = r.run([]string{"hoopy@frood"})
+			So(err, ShouldNotEqual, nil)
+
+			_, err = r.run([]string{"arthur@frood"})
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
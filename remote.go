@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/libgit2/git2go"
+	"golang.org/x/crypto/ssh"
+)
+
+// Repositories can be shared with the rest of a team through a git
+// remote: 'credulous repo clone' clones one into ~/.credulous, and
+// 'credulous repo sync' fetches from it, fast-forwards or else merges what
+// was fetched, and pushes the result. With
+// credulous.autosync set in the repository's git config, that's done
+// after anything is saved too.
+const (
+	GIT_REMOTE   string = "origin"
+	AUTOSYNC_KEY string = "credulous.autosync"
+)
+
+// gitRemoteCallbacks authenticates over SSH with the ssh-agent, and checks
+// SSH host keys against ~/.ssh/known_hosts
+func gitRemoteCallbacks() git.RemoteCallbacks {
+	return git.RemoteCallbacks{
+		CredentialsCallback: func(url, username string, allowed git.CredType) (git.ErrorCode, *git.Cred) {
+			if allowed&git.CredTypeSshKey == 0 {
+				return git.ErrUser, nil
+			}
+			ret, cred := git.NewCredSshKeyFromAgent(username)
+			return git.ErrorCode(ret), &cred
+		},
+		CertificateCheckCallback: gitCertificateCheck,
+	}
+}
+
+// gitCertificateCheck accepts TLS certificates that libgit2 found valid,
+// and SSH host keys listed for the host in ~/.ssh/known_hosts, which
+// libgit2 doesn't check itself
+func gitCertificateCheck(cert *git.Certificate, valid bool, hostname string) git.ErrorCode {
+	if cert.Kind != git.CertificateHostkey {
+		if valid {
+			return git.ErrOk
+		}
+		return git.ErrCertificate
+	}
+	b, err := ioutil.ReadFile(filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts"))
+	if err != nil {
+		log.Print("WARNING: Unable to check the host key of " + hostname + ": " + err.Error())
+		return git.ErrCertificate
+	}
+	if knownHostKey(b, hostname, cert.Hostkey) {
+		return git.ErrOk
+	}
+	log.Print("WARNING: The host key of " + hostname + " is not in ~/.ssh/known_hosts")
+	return git.ErrCertificate
+}
+
+// knownHostKey says whether the host key with those hashes is listed for
+// the host in knownHosts, and not revoked
+func knownHostKey(knownHosts []byte, hostname string, hostkey git.HostkeyCertificate) bool {
+	known := false
+	for _, line := range bytes.Split(knownHosts, []byte("\n")) {
+		marker, hosts, pubkey, _, _, err := ssh.ParseKnownHosts(line)
+		if err != nil || marker == "cert-authority" {
+			continue
+		}
+		if !knownHostMatches(hosts, hostname) || !hostkeyMatches(hostkey, pubkey) {
+			continue
+		}
+		if marker == "revoked" {
+			return false
+		}
+		known = true
+	}
+	return known
+}
+
+func knownHostMatches(hosts []string, hostname string) bool {
+	for _, host := range hosts {
+		if host == hostname || strings.HasPrefix(host, "["+hostname+"]:") {
+			return true
+		}
+		// hashed, as by 'ssh-keygen -H': |1|salt|HMAC-SHA1(salt, hostname)
+		fields := strings.Split(host, "|")
+		if len(fields) != 4 || fields[1] != "1" {
+			continue
+		}
+		salt, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			continue
+		}
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(hostname))
+		if base64.StdEncoding.EncodeToString(mac.Sum(nil)) == fields[3] {
+			return true
+		}
+	}
+	return false
+}
+
+func hostkeyMatches(hostkey git.HostkeyCertificate, pubkey ssh.PublicKey) bool {
+	switch {
+	case hostkey.Kind&git.HostkeySHA1 != 0:
+		return sha1.Sum(pubkey.Marshal()) == hostkey.HashSHA1
+	case hostkey.Kind&git.HostkeyMD5 != 0:
+		return md5.Sum(pubkey.Marshal()) == hostkey.HashMD5
+	}
+	return false
+}
+
+// gitClone clones the repository at url into dir, which mustn't exist
+func gitClone(url, dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return errors.New(dir + " already exists")
+	}
+	repo, err := git.Clone(url, dir, &git.CloneOptions{
+		FetchOptions: &git.FetchOptions{RemoteCallbacks: gitRemoteCallbacks()},
+	})
+	if err != nil {
+		return err
+	}
+	// credentials can't be committed without someone to commit them as
+	if _, err = getRepoConfig(repo); err != nil {
+		return setRepoConfig(repo, gitDefaultUser())
+	}
+	return nil
+}
+
+// gitRemoteURL returns the URL of the repository's remote, if it has one
+func gitRemoteURL(repopath string) string {
+	isrepo, err := isGitRepo(repopath)
+	if err != nil || !isrepo {
+		return ""
+	}
+	repo, err := git.OpenRepository(repopath)
+	if err != nil {
+		return ""
+	}
+	remote, err := repo.Remotes.Lookup(GIT_REMOTE)
+	if err != nil {
+		return ""
+	}
+	return remote.Url()
+}
+
+// gitSync brings the current branch and its counterpart in the remote up
+// to date with each other
+func gitSync(repopath string) error {
+	repo, err := git.OpenRepository(repopath)
+	if err != nil {
+		return err
+	}
+	remote, err := repo.Remotes.Lookup(GIT_REMOTE)
+	if err != nil {
+		return errors.New(repopath + " has no remote named '" + GIT_REMOTE + "' to sync with")
+	}
+	err = remote.Fetch([]string{}, &git.FetchOptions{RemoteCallbacks: gitRemoteCallbacks()}, "")
+	if err != nil {
+		return err
+	}
+
+	head, err := repo.References.Lookup("HEAD")
+	if err != nil {
+		return err
+	}
+	branch := head.SymbolicTarget()
+	if !strings.HasPrefix(branch, "refs/heads/") {
+		return errors.New(repopath + " is not on a branch")
+	}
+	upstream, err := repo.References.Lookup("refs/remotes/" + GIT_REMOTE + "/" + strings.TrimPrefix(branch, "refs/heads/"))
+	if err != nil && !git.IsErrorCode(err, git.ErrNotFound) {
+		return err
+	}
+	if upstream != nil {
+		if err = gitIntegrate(repo, branch, upstream); err != nil {
+			return err
+		}
+	}
+	if _, err = repo.References.Lookup(branch); err != nil {
+		// nothing has been committed on either side
+		return nil
+	}
+
+	var rejected []string
+	callbacks := gitRemoteCallbacks()
+	callbacks.PushUpdateReferenceCallback = func(refname, status string) git.ErrorCode {
+		if status != "" {
+			rejected = append(rejected, refname+" ("+status+")")
+		}
+		return git.ErrOk
+	}
+	err = remote.Push([]string{branch + ":" + branch}, &git.PushOptions{RemoteCallbacks: callbacks})
+	if err != nil {
+		return err
+	}
+	if len(rejected) > 0 {
+		return errors.New("The remote rejected " + strings.Join(rejected, ", "))
+	}
+	return nil
+}
+
+// gitIntegrate brings what was fetched into the branch: by fast-forwarding
+// if the branch has nothing the remote doesn't, or else by merging
+func gitIntegrate(repo *git.Repository, branch string, upstream *git.Reference) error {
+	theirs, err := repo.AnnotatedCommitFromRef(upstream)
+	if err != nil {
+		return err
+	}
+	analysis, _, err := repo.MergeAnalysis([]*git.AnnotatedCommit{theirs})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case analysis&git.MergeAnalysisUpToDate != 0:
+		return nil
+	case analysis&git.MergeAnalysisUnborn != 0:
+		if _, err = repo.References.Create(branch, upstream.Target(), false, "credulous: sync"); err != nil {
+			return err
+		}
+		return repo.CheckoutHead(&git.CheckoutOpts{Strategy: git.CheckoutForce})
+	case analysis&git.MergeAnalysisFastForward != 0:
+		commit, err := repo.LookupCommit(upstream.Target())
+		if err != nil {
+			return err
+		}
+		tree, err := commit.Tree()
+		if err != nil {
+			return err
+		}
+		if err = repo.CheckoutTree(tree, &git.CheckoutOpts{Strategy: git.CheckoutSafe}); err != nil {
+			return err
+		}
+		local, err := repo.References.Lookup(branch)
+		if err != nil {
+			return err
+		}
+		_, err = local.SetTarget(upstream.Target(), "credulous: sync: fast-forward")
+		return err
+	}
+	return gitMerge(repo, branch, upstream)
+}
+
+// Files are merged whole, never line by line: a credential file is
+// encrypted, and the keyring and role profiles are JSON that a line-by-line
+// merge could leave invalid. Saving credentials only ever adds a file named
+// for when they were created and who they were encrypted for, so saves on
+// both sides are simply merged together; only a file that both sides have
+// changed differently is a conflict.
+type fileChange struct {
+	// blob ids before and after, or "" if the file wasn't there
+	before, after string
+}
+
+type syncConflict struct {
+	path, reason string
+}
+
+// SyncConflictError reports the files that couldn't be merged, leaving
+// both the repository and the remote as they were
+type SyncConflictError struct {
+	Repo      string
+	Conflicts []syncConflict
+}
+
+func (e *SyncConflictError) Error() string {
+	lines := []string{"Unable to sync " + e.Repo + ", as these were changed on both sides:"}
+	for _, conflict := range e.Conflicts {
+		lines = append(lines, "  "+describeRepoPath(conflict.path)+": "+conflict.reason)
+	}
+	lines = append(lines, "Nothing has been changed; please resolve them with git")
+	return strings.Join(lines, "\n")
+}
+
+// describeRepoPath names what a file in a repository holds
+func describeRepoPath(path string) string {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == KEYRING_DIR && parts[1] == KEYRING_FILE:
+		return path + " (the keyring)"
+	case len(parts) == 2 && parts[0] == ROLES_DIR:
+		return path + " (role profile " + strings.TrimSuffix(parts[1], ".json") + ")"
+	case len(parts) == 3 && !strings.HasPrefix(parts[0], ".") && strings.HasSuffix(parts[2], ".json"):
+		return path + " (credentials for " + parts[1] + "@" + parts[0] + ")"
+	}
+	return path
+}
+
+// unionConflicts finds the files changed differently on each side since
+// the two diverged; every other change on either side can be kept
+func unionConflicts(ours, theirs map[string]fileChange) []syncConflict {
+	conflicts := []syncConflict{}
+	for path, our := range ours {
+		their, ok := theirs[path]
+		if !ok || our.after == their.after {
+			continue
+		}
+		var reason string
+		switch {
+		case our.before == "":
+			reason = "saved on both sides, with different contents"
+		case our.after == "" || their.after == "":
+			reason = "removed on one side and changed on the other"
+		default:
+			reason = "changed differently on both sides"
+		}
+		conflicts = append(conflicts, syncConflict{path: path, reason: reason})
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].path < conflicts[j].path
+	})
+	return conflicts
+}
+
+// gitTreeChanges lists the files changed between two trees
+func gitTreeChanges(repo *git.Repository, from, to *git.Tree) (map[string]fileChange, error) {
+	diff, err := repo.DiffTreeToTree(from, to, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Free()
+	deltas, err := diff.NumDeltas()
+	if err != nil {
+		return nil, err
+	}
+	changes := map[string]fileChange{}
+	for i := 0; i < deltas; i++ {
+		delta, err := diff.GetDelta(i)
+		if err != nil {
+			return nil, err
+		}
+		var change fileChange
+		if delta.Status != git.DeltaAdded {
+			change.before = delta.OldFile.Oid.String()
+		}
+		if delta.Status != git.DeltaDeleted {
+			change.after = delta.NewFile.Oid.String()
+		}
+		changes[delta.NewFile.Path] = change
+	}
+	return changes, nil
+}
+
+// gitMerge merges what was fetched into the branch, as a union of the
+// files changed on each side. If any file was changed on both, nothing is
+// merged, and those files are reported.
+func gitMerge(repo *git.Repository, branch string, upstream *git.Reference) error {
+	local, err := repo.References.Lookup(branch)
+	if err != nil {
+		return err
+	}
+	ours, err := repo.LookupCommit(local.Target())
+	if err != nil {
+		return err
+	}
+	theirs, err := repo.LookupCommit(upstream.Target())
+	if err != nil {
+		return err
+	}
+	baseId, err := repo.MergeBase(ours.Id(), theirs.Id())
+	if err != nil {
+		return err
+	}
+	base, err := repo.LookupCommit(baseId)
+	if err != nil {
+		return err
+	}
+	baseTree, err := base.Tree()
+	if err != nil {
+		return err
+	}
+	changes := []map[string]fileChange{}
+	for _, commit := range []*git.Commit{ours, theirs} {
+		tree, err := commit.Tree()
+		if err != nil {
+			return err
+		}
+		changed, err := gitTreeChanges(repo, baseTree, tree)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, changed)
+	}
+	if conflicts := unionConflicts(changes[0], changes[1]); len(conflicts) > 0 {
+		return &SyncConflictError{Repo: repo.Workdir(), Conflicts: conflicts}
+	}
+
+	index, err := repo.MergeCommits(ours, theirs, nil)
+	if err != nil {
+		return err
+	}
+	defer index.Free()
+	if index.HasConflicts() {
+		conflicts := []syncConflict{}
+		for _, path := range gitConflicts(index) {
+			conflicts = append(conflicts, syncConflict{path: path, reason: "changed on both sides"})
+		}
+		return &SyncConflictError{Repo: repo.Workdir(), Conflicts: conflicts}
+	}
+	treeId, err := index.WriteTreeTo(repo)
+	if err != nil {
+		return err
+	}
+	tree, err := repo.LookupTree(treeId)
+	if err != nil {
+		return err
+	}
+	signature, err := gitSignature(repo)
+	if err != nil {
+		return err
+	}
+	if err = repo.CheckoutTree(tree, &git.CheckoutOpts{Strategy: git.CheckoutSafe}); err != nil {
+		return err
+	}
+	_, err = gitCreateCommit(repo, signature, "Merged "+GIT_REMOTE+" by Credulous", tree, ours, theirs)
+	return err
+}
+
+// gitConflicts lists the paths with conflicts in the index
+func gitConflicts(index *git.Index) []string {
+	paths := []string{}
+	iterator, err := index.ConflictIterator()
+	if err != nil {
+		return paths
+	}
+	defer iterator.Free()
+	for {
+		conflict, err := iterator.Next()
+		if err != nil {
+			return paths
+		}
+		for _, entry := range []*git.IndexEntry{conflict.Our, conflict.Their, conflict.Ancestor} {
+			if entry != nil {
+				paths = append(paths, entry.Path)
+				break
+			}
+		}
+	}
+}
+
+// gitAutoSync says whether the repository is to be synced after anything
+// is saved in it
+func gitAutoSync(repopath string) bool {
+	isrepo, err := isGitRepo(repopath)
+	if err != nil || !isrepo {
+		return false
+	}
+	repo, err := git.OpenRepository(repopath)
+	if err != nil {
+		return false
+	}
+	config, err := repo.Config()
+	if err != nil {
+		return false
+	}
+	autosync, err := config.LookupBool(AUTOSYNC_KEY)
+	return err == nil && autosync
+}
+
+func gitSetAutoSync(repopath string, autosync bool) error {
+	repo, err := git.OpenRepository(repopath)
+	if err != nil {
+		return err
+	}
+	config, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	return config.SetBool(AUTOSYNC_KEY, autosync)
+}
+
+// syncAfterSave syncs the repository if it's set to sync automatically.
+// What was saved has been committed either way, so failing to sync is
+// only a warning.
+func syncAfterSave(repopath string) {
+	if !gitAutoSync(repopath) {
+		return
+	}
+	if err := gitSync(repopath); err != nil {
+		log.Print("WARNING: Unable to sync " + repopath + ": " + err.Error() +
+			"; run 'credulous repo sync' to try again")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/libgit2/git2go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKnownHostKey(t *testing.T) {
+	Convey("Test checking SSH host keys against known_hosts", t, func() {
+		b, err := ioutil.ReadFile("testdata/testkey_ed25519.pub")
+		panic_the_err(err)
+		pubkey, err := readSSHPubkeyFile("testdata/testkey_ed25519.pub")
+		panic_the_err(err)
+		hostkey := git.HostkeyCertificate{Kind: git.HostkeySHA1, HashSHA1: sha1.Sum(pubkey.Marshal())}
+
+		knownHosts := []byte("# a comment\nnot a valid line\ngit.example.com,10.0.0.1 " + string(b))
+		So(knownHostKey(knownHosts, "git.example.com", hostkey), ShouldBeTrue)
+		So(knownHostKey(knownHosts, "10.0.0.1", hostkey), ShouldBeTrue)
+		So(knownHostKey(knownHosts, "evil.example.com", hostkey), ShouldBeFalse)
+
+		other, err := readSSHPubkeyFile("testdata/testkey.pub")
+		panic_the_err(err)
+		So(knownHostKey(knownHosts, "git.example.com", git.HostkeyCertificate{
+			Kind: git.HostkeySHA1, HashSHA1: sha1.Sum(other.Marshal()),
+		}), ShouldBeFalse)
+
+		Convey("Hashed host names match too", func() {
+			salt := []byte("0123456789abcdefghij")
+			mac := hmac.New(sha1.New, salt)
+			mac.Write([]byte("git.example.com"))
+			hashed := "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+			So(knownHostKey([]byte(hashed+" "+string(b)), "git.example.com", hostkey), ShouldBeTrue)
+			So(knownHostKey([]byte(hashed+" "+string(b)), "other.example.com", hostkey), ShouldBeFalse)
+		})
+
+		Convey("Revoked keys don't", func() {
+			revoked := append(knownHosts, []byte("\n@revoked git.example.com "+string(b))...)
+			So(knownHostKey(revoked, "git.example.com", hostkey), ShouldBeFalse)
+		})
+	})
+}
+
+func TestUnionConflicts(t *testing.T) {
+	Convey("Test finding the files both sides of a sync changed", t, func() {
+		keyring := filepath.Join(KEYRING_DIR, KEYRING_FILE)
+		ours := map[string]fileChange{
+			"frood/hoopy/1402531200-abcd1234.json":  {after: "a1"},
+			"frood/hoopy/1402531300-abcd1234.json":  {after: "a2"},
+			"frood/zaphod/1402531200-abcd1234.json": {before: "b0", after: "b1"},
+			keyring:                                 {before: "k0", after: "k1"},
+			".roles/admin.json":                     {before: "r0", after: "r1"},
+		}
+		theirs := map[string]fileChange{
+			"frood/hoopy/1402531200-abcd1234.json":  {after: "a1"},
+			"frood/hoopy/1402531400-ef567890.json":  {after: "a3"},
+			"frood/zaphod/1402531200-abcd1234.json": {before: "b0", after: "b2"},
+			keyring:                                 {before: "k0", after: ""},
+		}
+
+		Convey("Files only one side changed, or both changed alike, are merged", func() {
+			delete(theirs, "frood/zaphod/1402531200-abcd1234.json")
+			delete(theirs, keyring)
+			So(unionConflicts(ours, theirs), ShouldResemble, []syncConflict{})
+		})
+
+		Convey("Files changed differently are conflicts", func() {
+			theirs["frood/hoopy/1402531300-abcd1234.json"] = fileChange{after: "a4"}
+			conflicts := unionConflicts(ours, theirs)
+			So(conflicts, ShouldResemble, []syncConflict{
+				{keyring, "removed on one side and changed on the other"},
+				{"frood/hoopy/1402531300-abcd1234.json", "saved on both sides, with different contents"},
+				{"frood/zaphod/1402531200-abcd1234.json", "changed differently on both sides"},
+			})
+
+			err := &SyncConflictError{Repo: "/home/hoopy/.credulous/ops", Conflicts: conflicts}
+			So(err.Error(), ShouldContainSubstring, "/home/hoopy/.credulous/ops")
+			So(err.Error(), ShouldContainSubstring, keyring+" (the keyring)")
+			So(err.Error(), ShouldContainSubstring, "frood/zaphod/1402531200-abcd1234.json (credentials for zaphod@frood)")
+		})
+
+		So(describeRepoPath(".roles/admin.json"), ShouldEqual, ".roles/admin.json (role profile admin)")
+		So(describeRepoPath(".credulous.json"), ShouldEqual, ".credulous.json")
+		So(describeRepoPath(".keyring/other.json"), ShouldEqual, ".keyring/other.json")
+	})
+}
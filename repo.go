@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Each repository in ~/.credulous is a directory, and usually a git
+// repository; 'credulous repo init' creates one, with a metadata file
+// describing it and a .gitattributes. Commands use the default
+// repository unless given --repo; it's 'local' unless it's been set with
+// 'credulous repo set-default', which saves it in the config file.
+const (
+	DEFAULT_REPO    string = "local"
+	REPO_METADATA   string = ".credulous.json"
+	GITATTRIBUTES   string = ".gitattributes"
+	REPO_ATTRIBUTES string = `# Credentials are encrypted, so diffs of them mean nothing, and they
+# can only be merged whole
+*/*/*.json -diff -merge
+.keyring/* -merge
+.roles/* -merge
+`
+)
+
+type RepoMetadata struct {
+	Name        string
+	Description string `json:",omitempty"`
+	CreateTime  string
+}
+
+type repoSettings struct {
+	DefaultRepo string `json:",omitempty"`
+}
+
+func repoPath(name string) string {
+	return filepath.Join(getRootPath(), name)
+}
+
+// defaultRepo returns the name of the default repository, as set in the
+// config file
+func defaultRepo(configFile string) (string, error) {
+	var settings repoSettings
+	b, err := ioutil.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		return DEFAULT_REPO, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if err = json.Unmarshal(b, &settings); err != nil {
+		return "", errors.New("Unable to read " + configFile + ": " + err.Error())
+	}
+	if settings.DefaultRepo == "" {
+		return DEFAULT_REPO, nil
+	}
+	return settings.DefaultRepo, nil
+}
+
+// setDefaultRepo saves the name of the default repository in the config
+// file, leaving the other settings there as they were
+func setDefaultRepo(configFile, name string) error {
+	settings := map[string]interface{}{}
+	b, err := ioutil.ReadFile(configFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err = json.Unmarshal(b, &settings); err != nil {
+			return errors.New("Unable to read " + configFile + ": " + err.Error())
+		}
+	}
+	if name == DEFAULT_REPO {
+		delete(settings, "DefaultRepo")
+	} else {
+		settings["DefaultRepo"] = name
+	}
+	b, err = json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configFile, append(b, '\n'), 0600)
+}
+
+func readRepoMetadata(repo string) (RepoMetadata, error) {
+	var metadata RepoMetadata
+	b, err := ioutil.ReadFile(filepath.Join(repo, REPO_METADATA))
+	if err != nil {
+		return RepoMetadata{}, err
+	}
+	if err = json.Unmarshal(b, &metadata); err != nil {
+		return RepoMetadata{}, errors.New("Unable to read " + filepath.Join(repo, REPO_METADATA) + ": " + err.Error())
+	}
+	return metadata, nil
+}
+
+// initRepo creates a repository in ~/.credulous, as a git repository
+// committing as the user given, with its metadata and .gitattributes
+func initRepo(name, description string, user RepoConfig) error {
+	if !isRepoName(name) {
+		return errors.New("Invalid repository name '" + name + "'")
+	}
+	repo := repoPath(name)
+	if _, err := os.Stat(repo); err == nil {
+		return errors.New("There is already a repository named '" + name + "'")
+	}
+	if err := os.MkdirAll(repo, 0700); err != nil {
+		return err
+	}
+
+	metadata := RepoMetadata{
+		Name:        name,
+		Description: description,
+		CreateTime:  fmt.Sprintf("%d", time.Now().Unix()),
+	}
+	b, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(repo, REPO_METADATA), append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(repo, GITATTRIBUTES), []byte(REPO_ATTRIBUTES), 0600); err != nil {
+		return err
+	}
+	err = gitInit(repo, user, []string{REPO_METADATA, GITATTRIBUTES}, "Repository "+name+" created by Credulous")
+	if err != nil {
+		os.RemoveAll(repo)
+	}
+	return err
+}
+
+type repoInfo struct {
+	name        string
+	description string
+	remote      string
+	isDefault   bool
+}
+
+// listRepos describes each repository in ~/.credulous
+func listRepos(rootPath, defaultName string) ([]repoInfo, error) {
+	entries, err := ioutil.ReadDir(rootPath)
+	if err != nil {
+		return nil, err
+	}
+	repos := []repoInfo{}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info := repoInfo{name: entry.Name(), isDefault: entry.Name() == defaultName}
+		if metadata, err := readRepoMetadata(filepath.Join(rootPath, entry.Name())); err == nil {
+			info.description = metadata.Description
+		}
+		info.remote = gitRemoteURL(filepath.Join(rootPath, entry.Name()))
+		repos = append(repos, info)
+	}
+	return repos, nil
+}
+
+func writeRepos(output io.Writer, repos []repoInfo) error {
+	w := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "  NAME\tREMOTE\tDESCRIPTION")
+	for _, repo := range repos {
+		marker := " "
+		if repo.isDefault {
+			marker = "*"
+		}
+		fmt.Fprintf(w, "%s %s\t%s\t%s\n", marker, repo.name, repo.remote, repo.description)
+	}
+	return w.Flush()
+}
+
+// removeRepo deletes a repository, which unless force is set mustn't
+// hold any credentials
+func removeRepo(rootPath, name string, force bool) error {
+	if !isRepoName(name) {
+		return errors.New("Invalid repository name '" + name + "'")
+	}
+	repo := filepath.Join(rootPath, name)
+	if _, err := os.Stat(repo); err != nil {
+		return errors.New("No repository named '" + name + "'")
+	}
+	if !force {
+		stored, err := findStoredCredentials(repo)
+		if err != nil {
+			return err
+		}
+		if len(stored) > 0 {
+			return fmt.Errorf("The repository '%s' holds %d sets of credentials; use --force to remove it anyway", name, len(stored))
+		}
+	}
+	return os.RemoveAll(repo)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRepoManagement(t *testing.T) {
+	Convey("Test naming, listing and removing repositories", t, func() {
+		root, err := ioutil.TempDir("", "credulous-repos")
+		panic_the_err(err)
+		defer os.RemoveAll(root)
+		configFile := filepath.Join(root, CONFIG_FILE)
+
+		So(isRepoName("ops"), ShouldBeTrue)
+		So(isRepoName(".journal"), ShouldBeFalse)
+		So(isRepoName("/tmp/ops"), ShouldBeFalse)
+		So(isRepoName(""), ShouldBeFalse)
+
+		Convey("The default repository is kept with the other settings", func() {
+			name, err := defaultRepo(configFile)
+			So(err, ShouldEqual, nil)
+			So(name, ShouldEqual, DEFAULT_REPO)
+
+			panic_the_err(ioutil.WriteFile(configFile, []byte(`{"Region": "ap-southeast-2"}`), 0600))
+			So(setDefaultRepo(configFile, "ops"), ShouldEqual, nil)
+			name, err = defaultRepo(configFile)
+			So(name, ShouldEqual, "ops")
+			config, err := readConfigFile(configFile)
+			So(err, ShouldEqual, nil)
+			So(config.Region, ShouldEqual, "ap-southeast-2")
+
+			So(setDefaultRepo(configFile, DEFAULT_REPO), ShouldEqual, nil)
+			name, err = defaultRepo(configFile)
+			So(name, ShouldEqual, DEFAULT_REPO)
+		})
+
+		Convey("Repositories are listed with their descriptions", func() {
+			os.MkdirAll(filepath.Join(root, "local"), 0700)
+			os.MkdirAll(filepath.Join(root, "ops"), 0700)
+			os.MkdirAll(filepath.Join(root, ".journal"), 0700)
+			panic_the_err(ioutil.WriteFile(filepath.Join(root, "ops", REPO_METADATA),
+				[]byte(`{"Name": "ops", "Description": "Production", "CreateTime": "1402531200"}`), 0600))
+
+			repos, err := listRepos(root, "ops")
+			So(err, ShouldEqual, nil)
+			So(len(repos), ShouldEqual, 2)
+			So(repos[1].description, ShouldEqual, "Production")
+			So(repos[1].isDefault, ShouldBeTrue)
+
+			var out bytes.Buffer
+			So(writeRepos(&out, repos), ShouldEqual, nil)
+			So(out.String(), ShouldContainSubstring, "* ops")
+		})
+
+		Convey("Repositories holding credentials are only removed by force", func() {
+			pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+			panic_the_err(err)
+			cred := Credential{KeyId: "AKIAOLDKEYEXAMPLE123", SecretKey: "oldsecret"}
+			saveTestCredentials(filepath.Join(root, "ops"), "frood", "hoopy", time.Now(), 0, cred, []ssh.PublicKey{pubkey})
+
+			So(removeRepo(root, "ops", false), ShouldNotEqual, nil)
+			So(removeRepo(root, "../ops", true), ShouldNotEqual, nil)
+			So(removeRepo(root, "ops", true), ShouldEqual, nil)
+			_, err = os.Stat(filepath.Join(root, "ops"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+			So(removeRepo(root, "ops", true), ShouldNotEqual, nil)
+		})
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Role profiles are kept in a hidden directory in the repository, next
+// to the account directories. They hold nothing secret, so they're saved
+// as plain JSON, one file per profile.
+const ROLES_DIR string = ".roles"
+
+const (
+	MIN_ROLE_DURATION int = 900
+	MAX_ROLE_DURATION int = 43200
+)
+
+type RoleProfile struct {
+	Name            string
+	RoleArn         string
+	ExternalId      string `json:",omitempty"`
+	SessionName     string `json:",omitempty"`
+	DurationSeconds int    `json:",omitempty"`
+	// the stored credentials to assume the role with, as username@account
+	Source string `json:",omitempty"`
+}
+
+var ROLE_NAME_PATTERN = regexp.MustCompile(`^[A-Za-z0-9_+=,@-][A-Za-z0-9_.+=,@-]*$`)
+
+// the characters STS allows in a role session name
+var SESSION_NAME_PATTERN = regexp.MustCompile(`^[A-Za-z0-9_+=,.@-]{2,64}$`)
+
+// parseRoleArn returns the account ID and role name from a role ARN, eg.
+// arn:aws:iam::123456789012:role/path/Deployer
+func parseRoleArn(arn string) (account, name string, err error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || !strings.HasPrefix(parts[5], "role/") {
+		return "", "", errors.New("Invalid role ARN " + arn)
+	}
+	fields := strings.Split(parts[5], "/")
+	return parts[4], fields[len(fields)-1], nil
+}
+
+func (profile RoleProfile) validate() error {
+	if !ROLE_NAME_PATTERN.MatchString(profile.Name) {
+		return errors.New("Invalid role profile name '" + profile.Name + "'")
+	}
+	if _, _, err := parseRoleArn(profile.RoleArn); err != nil {
+		return err
+	}
+	if profile.SessionName != "" && !SESSION_NAME_PATTERN.MatchString(profile.SessionName) {
+		return errors.New("Invalid role session name '" + profile.SessionName + "'")
+	}
+	if profile.DurationSeconds != 0 &&
+		(profile.DurationSeconds < MIN_ROLE_DURATION || profile.DurationSeconds > MAX_ROLE_DURATION) {
+		return fmt.Errorf("Role session duration must be between %d and %d seconds", MIN_ROLE_DURATION, MAX_ROLE_DURATION)
+	}
+	if profile.Source != "" {
+		if _, _, err := splitUserAndAccount(profile.Source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (profile RoleProfile) WriteToDisk(repo string) error {
+	err := profile.validate()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Join(repo, ROLES_DIR), 0700)
+	relpath := filepath.Join(ROLES_DIR, profile.Name+".json")
+	err = ioutil.WriteFile(filepath.Join(repo, relpath), b, 0600)
+	if err != nil {
+		return err
+	}
+	isrepo, err := isGitRepo(repo)
+	if err != nil || !isrepo {
+		return err
+	}
+	_, err = gitAddCommitFile(repo, relpath, "Role profile "+profile.Name+" added by Credulous")
+	return err
+}
+
+// readRoleProfile also accepts a role ARN in place of a profile name, to
+// assume a role without saving a profile for it first
+func readRoleProfile(repo, name string) (RoleProfile, error) {
+	if strings.HasPrefix(name, "arn:") {
+		profile := RoleProfile{Name: name, RoleArn: name}
+		_, _, err := parseRoleArn(name)
+		return profile, err
+	}
+	if !ROLE_NAME_PATTERN.MatchString(name) {
+		return RoleProfile{}, errors.New("Invalid role profile name '" + name + "'")
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(repo, ROLES_DIR, name+".json"))
+	if os.IsNotExist(err) {
+		return RoleProfile{}, errors.New("No role profile named '" + name + "'; add one with 'credulous role add'")
+	}
+	if err != nil {
+		return RoleProfile{}, err
+	}
+	var profile RoleProfile
+	err = json.Unmarshal(b, &profile)
+	if err != nil {
+		return RoleProfile{}, err
+	}
+	return profile, nil
+}
+
+func listRoleProfiles(repo string) ([]RoleProfile, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(repo, ROLES_DIR))
+	if os.IsNotExist(err) {
+		return []RoleProfile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, strings.TrimSuffix(entry.Name(), ".json"))
+		}
+	}
+	sort.Strings(names)
+
+	profiles := []RoleProfile{}
+	for _, name := range names {
+		profile, err := readRoleProfile(repo, name)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+func removeRoleProfile(repo, name string) error {
+	if !ROLE_NAME_PATTERN.MatchString(name) {
+		return errors.New("Invalid role profile name '" + name + "'")
+	}
+	relpath := filepath.Join(ROLES_DIR, name+".json")
+	err := os.Remove(filepath.Join(repo, relpath))
+	if os.IsNotExist(err) {
+		return errors.New("No role profile named '" + name + "'")
+	}
+	if err != nil {
+		return err
+	}
+	isrepo, err := isGitRepo(repo)
+	if err != nil || !isrepo {
+		return err
+	}
+	_, err = gitRemoveCommitFile(repo, relpath, "Role profile "+name+" removed by Credulous")
+	return err
+}
+
+// sessionName defaults to the name of the user assuming the role, so
+// that it shows up in CloudTrail; IAM user names are always valid
+// session names, apart from their length
+func (profile RoleProfile) sessionName(creds Credentials) string {
+	if profile.SessionName != "" {
+		return profile.SessionName
+	}
+	name := creds.IamUsername
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	if !SESSION_NAME_PATTERN.MatchString(name) {
+		return "credulous"
+	}
+	return name
+}
+
+// withCredential returns a copy of creds holding cred instead, and the
+// same environment variables
+func (creds Credentials) withCredential(cred Credential) Credentials {
+	cred.EnvVars = creds.Encryptions[0].decoded.EnvVars
+	creds.Encryptions = []Encryption{{decoded: cred}}
+	return creds
+}
+
+// assumeRoleProfile uses creds to assume the profile's role, returning
+// the session credentials, which are named for the role and its account
+func assumeRoleProfile(creds Credentials, profile RoleProfile, config AWSConfig) (Credentials, error) {
+	account, name, err := parseRoleArn(profile.RoleArn)
+	if err != nil {
+		return Credentials{}, err
+	}
+	client := newSTSClient(creds.Encryptions[0].decoded, config)
+	cred, err := assumeRole(client, profile, profile.sessionName(creds))
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	assumed := creds.withCredential(cred)
+	assumed.IamUsername = name
+	assumed.AccountAliasOrId = account
+	assumed.LifeTime = 0
+	return assumed, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const TEST_ROLE_ARN string = "arn:aws:iam::123456789012:role/ops/Deployer"
+
+func TestRoleProfileValidation(t *testing.T) {
+	Convey("Test role profile validation", t, func() {
+		profile := RoleProfile{Name: "deploy", RoleArn: TEST_ROLE_ARN, Source: "bob@frood"}
+		So(profile.validate(), ShouldEqual, nil)
+
+		account, name, err := parseRoleArn(TEST_ROLE_ARN)
+		So(err, ShouldEqual, nil)
+		So(account, ShouldEqual, "123456789012")
+		So(name, ShouldEqual, "Deployer")
+
+		bad := []RoleProfile{
+			{Name: ".hidden", RoleArn: TEST_ROLE_ARN},
+			{Name: "../escape", RoleArn: TEST_ROLE_ARN},
+			{Name: "deploy", RoleArn: "arn:aws:iam::123456789012:user/bob"},
+			{Name: "deploy", RoleArn: TEST_ROLE_ARN, Source: "frood"},
+			{Name: "deploy", RoleArn: TEST_ROLE_ARN, DurationSeconds: 60},
+			{Name: "deploy", RoleArn: TEST_ROLE_ARN, SessionName: "has spaces"},
+		}
+		for _, profile := range bad {
+			So(profile.validate(), ShouldNotEqual, nil)
+		}
+	})
+}
+
+func TestRoleProfileStorage(t *testing.T) {
+	Convey("Test saving, listing and removing role profiles", t, func() {
+		repo, err := ioutil.TempDir("", "credulous-roles")
+		panic_the_err(err)
+		defer os.RemoveAll(repo)
+
+		err = RoleProfile{Name: "deploy", RoleArn: TEST_ROLE_ARN, ExternalId: "xyzzy", Source: "bob@frood"}.WriteToDisk(repo)
+		So(err, ShouldEqual, nil)
+		err = RoleProfile{Name: "audit", RoleArn: "arn:aws:iam::123456789012:role/Auditor"}.WriteToDisk(repo)
+		So(err, ShouldEqual, nil)
+
+		profile, err := readRoleProfile(repo, "deploy")
+		So(err, ShouldEqual, nil)
+		So(profile.ExternalId, ShouldEqual, "xyzzy")
+		So(profile.Source, ShouldEqual, "bob@frood")
+
+		profiles, err := listRoleProfiles(repo)
+		So(err, ShouldEqual, nil)
+		So(len(profiles), ShouldEqual, 2)
+		So(profiles[0].Name, ShouldEqual, "audit")
+
+		Convey("The profiles don't look like an account", func() {
+			dir, err := os.Open(repo)
+			panic_the_err(err)
+			defer dir.Close()
+			dirs, err := getDirs(dir)
+			So(err, ShouldEqual, nil)
+			So(len(dirs), ShouldEqual, 0)
+		})
+
+		Convey("A role ARN can be used as a profile", func() {
+			profile, err := readRoleProfile(repo, TEST_ROLE_ARN)
+			So(err, ShouldEqual, nil)
+			So(profile.RoleArn, ShouldEqual, TEST_ROLE_ARN)
+		})
+
+		Convey("Removing a profile", func() {
+			So(removeRoleProfile(repo, "deploy"), ShouldEqual, nil)
+			_, err := readRoleProfile(repo, "deploy")
+			So(err, ShouldNotEqual, nil)
+			So(removeRoleProfile(repo, "deploy"), ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestAssumeRoleProfile(t *testing.T) {
+	Convey("Test assuming a role with stored credentials", t, func() {
+		var form map[string][]string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			form = r.PostForm
+			w.Write([]byte(`<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASIAassumed</AccessKeyId>
+      <SecretAccessKey>assumedsecret</SecretAccessKey>
+      <SessionToken>assumedtoken</SessionToken>
+      <Expiration>2014-06-12T01:00:00Z</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::123456789012:assumed-role/Deployer/testuser</Arn>
+      <AssumedRoleId>AROAEXAMPLE:testuser</AssumedRoleId>
+    </AssumedRoleUser>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`))
+		}))
+		defer server.Close()
+
+		profile := RoleProfile{Name: "deploy", RoleArn: TEST_ROLE_ARN, ExternalId: "xyzzy", DurationSeconds: 900}
+		assumed, err := assumeRoleProfile(testCredentials(), profile, AWSConfig{Region: "us-east-1", STSEndpoint: server.URL})
+		So(err, ShouldEqual, nil)
+		So(form["Action"], ShouldResemble, []string{"AssumeRole"})
+		So(form["RoleArn"], ShouldResemble, []string{TEST_ROLE_ARN})
+		So(form["RoleSessionName"], ShouldResemble, []string{"testuser"})
+		So(form["ExternalId"], ShouldResemble, []string{"xyzzy"})
+		So(form["DurationSeconds"], ShouldResemble, []string{"900"})
+
+		So(assumed.IamUsername, ShouldEqual, "Deployer")
+		So(assumed.AccountAliasOrId, ShouldEqual, "123456789012")
+		decoded := assumed.Encryptions[0].decoded
+		So(decoded.KeyId, ShouldEqual, "ASIAassumed")
+		So(decoded.SessionToken, ShouldEqual, "assumedtoken")
+		So(decoded.Expiration, ShouldEqual, "2014-06-12T01:00:00Z")
+		// the environment variables saved with the base credentials are kept
+		So(decoded.EnvVars["FOO"], ShouldEqual, "bar")
+	})
+}
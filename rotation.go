@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 'credulous rotate --all' rotates every set of credentials in a
+// repository whose lifetime has run out, or is about to, or which are
+// older than --older-than, and saves the new keys for everyone the old
+// ones were encrypted for. With --daemon it checks again every --interval
+// until it's interrupted.
+const DEFAULT_ROTATE_INTERVAL time.Duration = 24 * time.Hour
+
+// A storedCredential is the latest set of credentials saved for a user,
+// as read without decrypting them
+type storedCredential struct {
+	alias    string
+	username string
+	filename string
+	metadata Credentials
+}
+
+func (stored storedCredential) name() string {
+	return stored.username + "@" + stored.alias
+}
+
+// findStoredCredentials reads the latest credentials saved for each user
+// in the repository
+func findStoredCredentials(repo string) ([]storedCredential, error) {
+	stored := []storedCredential{}
+	aliases, err := ioutil.ReadDir(repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, alias := range aliases {
+		if !alias.IsDir() || strings.HasPrefix(alias.Name(), ".") {
+			continue
+		}
+		users, err := ioutil.ReadDir(filepath.Join(repo, alias.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			if !user.IsDir() || strings.HasPrefix(user.Name(), ".") {
+				continue
+			}
+			dir := filepath.Join(repo, alias.Name(), user.Name())
+			metadata, filename, err := readLatestMetadata(dir)
+			// nothing may have been saved yet, or the last file removed
+			if err == errNoCredentialsSaved {
+				log.Print("WARNING: No credentials saved in " + dir + "; skipping it")
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			stored = append(stored, storedCredential{
+				alias:    alias.Name(),
+				username: user.Name(),
+				filename: filename,
+				metadata: metadata,
+			})
+		}
+	}
+	return stored, nil
+}
+
+type rotationPolicy struct {
+	// credentials created longer ago than this are rotated, if it's set
+	olderThan time.Duration
+}
+
+// due says why the credentials should be rotated, or returns "" if they
+// needn't be yet. They're rotated as soon as their lifetime is near
+// enough its end to be warned about, rather than once they're refused.
+func (policy rotationPolicy) due(creds Credentials, now time.Time) (string, error) {
+	expiry, ok, err := creds.expiresAt()
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		remaining := expiry.Sub(now)
+		if remaining <= 0 {
+			return "lifetime ran out " + formatDuration(-remaining) + " ago", nil
+		}
+		if remaining < creds.lifetimeWarning() {
+			return "lifetime runs out in " + formatDuration(remaining), nil
+		}
+	}
+	if policy.olderThan <= 0 {
+		return "", nil
+	}
+	created, err := strconv.ParseInt(creds.CreateTime, 10, 64)
+	if err != nil {
+		return "", errors.New("Invalid creation time '" + creds.CreateTime + "'")
+	}
+	age := now.Sub(time.Unix(created, 0))
+	if age >= policy.olderThan {
+		return "created " + formatDuration(age) + " ago", nil
+	}
+	return "", nil
+}
+
+// recipients finds the public keys that the credentials were encrypted
+// for among the candidates, returning the fingerprints of any it can't
+func recipients(creds Credentials, candidates []ssh.PublicKey) (found []ssh.PublicKey, missing []string) {
+	seen := map[string]bool{}
+	for _, enc := range creds.Encryptions {
+		// the ssh-agent's copies are for keys that have their own
+		if enc.Scheme != "" || seen[enc.Fingerprint] {
+			continue
+		}
+		seen[enc.Fingerprint] = true
+		var pubkey ssh.PublicKey
+		for _, candidate := range candidates {
+			if fingerprintMatches(enc.Fingerprint, candidate) {
+				pubkey = candidate
+				break
+			}
+		}
+		if pubkey == nil {
+			missing = append(missing, enc.Fingerprint)
+			continue
+		}
+		found = append(found, pubkey)
+	}
+	return found, missing
+}
+
+// candidateRecipients gathers the public keys that rotated credentials
+// might need to be encrypted for: those given with --key, those in the
+// repository's keyring, those in ~/.ssh, and those held by the ssh-agent
+func candidateRecipients(keyfiles []string, repo string) ([]ssh.PublicKey, error) {
+	candidates := []ssh.PublicKey{}
+	for _, keyfile := range keyfiles {
+		pubkey, err := readSSHPubkeyFile(keyfile)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, pubkey)
+	}
+
+	keyring, err := readKeyring(repo)
+	if err != nil {
+		return nil, err
+	}
+	candidates = append(candidates, keyring.publicKeys()...)
+
+	filenames, _ := filepath.Glob(filepath.Join(os.Getenv("HOME"), ".ssh", "*.pub"))
+	for _, filename := range filenames {
+		if pubkey, err := readSSHPubkeyFile(filename); err == nil {
+			candidates = append(candidates, pubkey)
+		}
+	}
+
+	sshAgent, conn := connectSSHAgent()
+	if sshAgent == nil {
+		return candidates, nil
+	}
+	defer conn.Close()
+	keys, err := sshAgent.List()
+	if err != nil {
+		log.Print("WARNING: Unable to list the ssh-agent's keys: " + err.Error())
+		return candidates, nil
+	}
+	for _, key := range keys {
+		if pubkey, err := ssh.ParsePublicKey(key.Marshal()); err == nil {
+			candidates = append(candidates, pubkey)
+		}
+	}
+	return candidates, nil
+}
+
+// inheritSaved carries over to rotated credentials what was saved with
+// the latest credentials for the same user: who they were encrypted for,
+// their environment variables and their lifetime. Whatever was given on
+// the command line takes precedence: any data.pubkeys replace the
+// recipients, each of env replaces the variable of the same name, and
+// the lifetime is kept if lifetimeGiven. It returns false if nothing has
+// been saved for the user yet.
+func inheritSaved(data *SaveData, env map[string]string, lifetimeGiven bool, keyfile string, candidates []ssh.PublicKey) (bool, error) {
+	metadata, filename, err := readLatestMetadata(filepath.Join(data.repo, data.alias, data.username))
+	if os.IsNotExist(err) || err == errNoCredentialsSaved {
+		data.cred.EnvVars = env
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(data.pubkeys) == 0 {
+		pubkeys, missing := recipients(metadata, candidates)
+		if len(missing) > 0 {
+			return false, errors.New(filename + " is also encrypted for " + strings.Join(missing, ", ") +
+				", whose public key can't be found; please give every key to encrypt for with --key")
+		}
+		data.pubkeys = pubkeys
+	}
+
+	creds, ok := agentGetCredentials(data.repo, data.alias, data.username)
+	if !ok {
+		creds, err = RetrieveCredentials(data.repo, data.alias, data.username, keyfile)
+		if err != nil {
+			return false, errors.New("Unable to read the environment variables saved in " + filename + ": " + err.Error())
+		}
+	}
+	saved := creds.Encryptions[0].decoded
+	vars := map[string]string{}
+	for name, value := range saved.EnvVars {
+		vars[name] = value
+	}
+	for name, value := range env {
+		vars[name] = value
+	}
+	if len(vars) > 0 {
+		data.cred.EnvVars = vars
+	}
+	// a session's lifetime is only how long it had left
+	if !lifetimeGiven && !saved.temporary() {
+		data.lifetime = metadata.LifeTime
+	}
+	return true, nil
+}
+
+type autoRotator struct {
+	repo       string
+	keyfile    string
+	candidates []ssh.PublicKey
+	policy     rotationPolicy
+	// the lifetime of the new credentials; zero keeps the old lifetime
+	lifetime int
+	dryRun   bool
+	config   AWSConfig
+	now      func() time.Time
+	// rotate replaces the access key in data.cred with a new one and
+	// saves it; it's rotateCredentials, except in the tests
+	rotate func(data SaveData) error
+}
+
+// run rotates whatever credentials in the repository are due, returning
+// the names of those it rotated; one set that can't be rotated doesn't
+// stop the others being
+func (rotator autoRotator) run() (rotated []string, err error) {
+	stored, err := findStoredCredentials(rotator.repo)
+	if err != nil {
+		return nil, err
+	}
+	now := rotator.now()
+	due, failed := 0, 0
+	for _, s := range stored {
+		reason, err := rotator.policy.due(s.metadata, now)
+		if err != nil {
+			log.Print("WARNING: Not rotating " + s.name() + ": " + s.filename + ": " + err.Error())
+			failed++
+			continue
+		}
+		if reason == "" {
+			continue
+		}
+		due++
+		if rotator.dryRun {
+			fmt.Printf("would rotate %s (%s)\n", s.name(), reason)
+		} else {
+			fmt.Printf("rotating %s (%s)\n", s.name(), reason)
+		}
+		if err = rotator.rotateOne(s); err != nil {
+			log.Print("WARNING: Not rotating " + s.name() + ": " + err.Error())
+			failed++
+			continue
+		}
+		rotated = append(rotated, s.name())
+	}
+	if len(rotated) > 0 && !rotator.dryRun {
+		syncAfterSave(rotator.repo)
+	}
+	if failed > 0 {
+		return rotated, fmt.Errorf("%d of %d credentials could not be rotated", failed, due)
+	}
+	return rotated, nil
+}
+
+func (rotator autoRotator) rotateOne(stored storedCredential) error {
+	// find everyone to encrypt the new key for before making it, since it
+	// can't be saved for anyone who's left out
+	pubkeys, missing := recipients(stored.metadata, rotator.candidates)
+	if len(missing) > 0 {
+		return errors.New("No public key found for " + strings.Join(missing, ", ") +
+			"; please give them with --key")
+	}
+	if rotator.dryRun {
+		return nil
+	}
+
+	creds, ok := agentGetCredentials(rotator.repo, stored.alias, stored.username)
+	if !ok {
+		var err error
+		creds, err = RetrieveCredentials(rotator.repo, stored.alias, stored.username, rotator.keyfile)
+		if err != nil {
+			return err
+		}
+	}
+	cred := creds.Encryptions[0].decoded
+	if cred.temporary() {
+		return errors.New("Temporary credentials cannot be rotated; they have no IAM access key")
+	}
+
+	lifetime := rotator.lifetime
+	if lifetime == 0 {
+		lifetime = stored.metadata.LifeTime
+	}
+	return rotator.rotate(SaveData{
+		cred:     cred,
+		username: stored.metadata.IamUsername,
+		alias:    stored.metadata.AccountAliasOrId,
+		pubkeys:  pubkeys,
+		lifetime: lifetime,
+		repo:     rotator.repo,
+		config:   rotator.config,
+	})
+}
+
+// runEvery rotates whatever is due every interval, until a signal arrives
+func (rotator autoRotator) runEvery(interval time.Duration, signals <-chan os.Signal) error {
+	for {
+		if _, err := rotator.run(); err != nil {
+			log.Print("WARNING: " + err.Error())
+		}
+		select {
+		case <-time.After(interval):
+		case <-signals:
+			return nil
+		}
+	}
+}
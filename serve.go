@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 'credulous serve' decrypts a set of credentials once, and hands them
+// out on the loopback interface the way ECS and EC2 do, so that the AWS
+// SDKs pick them up (and renewed session credentials after them) without
+// the credentials ever being in anyone's environment.
+const (
+	ECS_CREDENTIALS_PATH  string = "/credentials"
+	IMDS_TOKEN_PATH       string = "/latest/api/token"
+	IMDS_CREDENTIALS_PATH string = "/latest/meta-data/iam/security-credentials/"
+	IMDS_TOKEN_HEADER     string = "X-aws-ec2-metadata-token"
+	IMDS_TOKEN_TTL_HEADER string = "X-aws-ec2-metadata-token-ttl-seconds"
+	MAX_IMDS_TOKEN_TTL    int    = 21600
+)
+
+// a random port on the loopback interface
+const DEFAULT_SERVE_ADDRESS string = "127.0.0.1:0"
+
+// long-term credentials don't expire, but they're served as though they
+// do, so that clients come back for them every so often
+const STATIC_CREDENTIALS_LIFETIME time.Duration = time.Hour
+
+// how long to wait for requests in flight when shutting down
+const SHUTDOWN_TIMEOUT time.Duration = 5 * time.Second
+
+// the JSON both ECS and EC2 serve; only EC2 sends Code, LastUpdated and Type
+type servedCredential struct {
+	Code            string `json:",omitempty"`
+	LastUpdated     string `json:",omitempty"`
+	Type            string `json:",omitempty"`
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      string
+}
+
+type credentialServer struct {
+	provider  func() (Credentials, error)
+	authToken string
+	imds      bool
+	now       func() time.Time
+
+	mutex      sync.Mutex
+	current    *Credential
+	roleName   string
+	updated    time.Time
+	expiry     time.Time
+	imdsTokens map[string]time.Time
+	closed     bool
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newCredentialServer serves the credentials from provider, which is
+// called again whenever the credentials being served are about to expire
+func newCredentialServer(provider func() (Credentials, error), imds bool) (*credentialServer, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	return &credentialServer{
+		provider:   provider,
+		authToken:  token,
+		imds:       imds,
+		now:        time.Now,
+		imdsTokens: map[string]time.Time{},
+	}, nil
+}
+
+// credential returns the credentials to serve and their expiry, renewing
+// them first if they're about to expire
+func (server *credentialServer) credential() (Credential, string, time.Time, error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.closed {
+		return Credential{}, "", time.Time{}, errors.New("The server is shutting down")
+	}
+
+	now := server.now()
+	if server.current != nil && now.Add(SESSION_EXPIRY_MARGIN).Before(server.expiry) {
+		return *server.current, server.roleName, server.expiry, nil
+	}
+	if server.current != nil && !server.current.temporary() {
+		server.expiry = now.Add(STATIC_CREDENTIALS_LIFETIME)
+		return *server.current, server.roleName, server.expiry, nil
+	}
+
+	creds, err := server.provider()
+	if err != nil {
+		return Credential{}, "", time.Time{}, err
+	}
+	cred := creds.Encryptions[0].decoded
+	expiry := now.Add(STATIC_CREDENTIALS_LIFETIME)
+	if cred.Expiration != "" {
+		expiry, err = time.Parse(time.RFC3339, cred.Expiration)
+		if err != nil {
+			return Credential{}, "", time.Time{}, err
+		}
+		if !now.Before(expiry) {
+			return Credential{}, "", time.Time{}, errors.New("The credentials being served expired at " + cred.Expiration)
+		}
+	}
+	server.current = &cred
+	server.roleName = creds.IamUsername
+	server.updated = now
+	server.expiry = expiry
+	return cred, server.roleName, expiry, nil
+}
+
+// environment returns the variables that point the AWS SDKs at the server
+func (server *credentialServer) environment(address string) []envVar {
+	base := "http://" + address
+	vars := []envVar{
+		{"AWS_CONTAINER_CREDENTIALS_FULL_URI", base + ECS_CREDENTIALS_PATH},
+		{"AWS_CONTAINER_AUTHORIZATION_TOKEN", server.authToken},
+	}
+	if server.imds {
+		vars = append(vars, envVar{"AWS_EC2_METADATA_SERVICE_ENDPOINT", base + "/"})
+	}
+	return vars
+}
+
+// isLoopbackHost checks a host, with or without a port, is the loopback
+// interface; checking the Host header of requests too keeps web pages
+// from reaching the server by rebinding their own names to 127.0.0.1
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.ToLower(host) == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listenLoopback refuses to serve credentials to the network
+func listenLoopback(address string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if !isLoopbackHost(host) {
+		return nil, errors.New("Credentials are only served on the loopback interface; " + host + " is not a loopback address")
+	}
+	return net.Listen("tcp", address)
+}
+
+func (server *credentialServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isLoopbackHost(r.Host) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.URL.Path == ECS_CREDENTIALS_PATH:
+		server.serveECS(w, r)
+	case server.imds && r.URL.Path == IMDS_TOKEN_PATH:
+		server.serveIMDSToken(w, r)
+	case server.imds && strings.HasPrefix(r.URL.Path, IMDS_CREDENTIALS_PATH):
+		server.serveIMDSCredentials(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (server *credentialServer) serveECS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(server.authToken)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	cred, _, expiry, err := server.credential()
+	if err != nil {
+		server.fail(w, err)
+		return
+	}
+	server.writeCredential(w, servedCredential{
+		AccessKeyId:     cred.KeyId,
+		SecretAccessKey: cred.SecretKey,
+		Token:           cred.SessionToken,
+		Expiration:      expiry.UTC().Format(time.RFC3339),
+	})
+}
+
+// serveIMDSToken hands out session tokens the way IMDSv2 does: only for a
+// PUT, and never to a request that's come through a proxy
+func (server *credentialServer) serveIMDSToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("X-Forwarded-For") != "" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	ttl, err := strconv.Atoi(r.Header.Get(IMDS_TOKEN_TTL_HEADER))
+	if err != nil || ttl < 1 || ttl > MAX_IMDS_TOKEN_TTL {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	token, err := randomToken()
+	if err != nil {
+		server.fail(w, err)
+		return
+	}
+
+	server.mutex.Lock()
+	now := server.now()
+	for old, expiry := range server.imdsTokens {
+		if !now.Before(expiry) {
+			delete(server.imdsTokens, old)
+		}
+	}
+	server.imdsTokens[token] = now.Add(time.Duration(ttl) * time.Second)
+	server.mutex.Unlock()
+
+	w.Header().Set(IMDS_TOKEN_TTL_HEADER, strconv.Itoa(ttl))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(token))
+}
+
+func (server *credentialServer) validIMDSToken(token string) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	expiry, ok := server.imdsTokens[token]
+	return ok && server.now().Before(expiry)
+}
+
+func (server *credentialServer) serveIMDSCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !server.validIMDSToken(r.Header.Get(IMDS_TOKEN_HEADER)) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	cred, roleName, expiry, err := server.credential()
+	if err != nil {
+		server.fail(w, err)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, IMDS_CREDENTIALS_PATH)
+	if name == "" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(roleName))
+		return
+	}
+	if name != roleName {
+		http.NotFound(w, r)
+		return
+	}
+	server.mutex.Lock()
+	updated := server.updated
+	server.mutex.Unlock()
+	server.writeCredential(w, servedCredential{
+		Code:            "Success",
+		LastUpdated:     updated.UTC().Format(time.RFC3339),
+		Type:            "AWS-HMAC",
+		AccessKeyId:     cred.KeyId,
+		SecretAccessKey: cred.SecretKey,
+		Token:           cred.SessionToken,
+		Expiration:      expiry.UTC().Format(time.RFC3339),
+	})
+}
+
+func (server *credentialServer) writeCredential(w http.ResponseWriter, served servedCredential) {
+	b, err := json.Marshal(served)
+	if err != nil {
+		server.fail(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	wipeBytes(b)
+}
+
+// fail logs the reason credentials can't be served, rather than telling
+// whoever asked for them
+func (server *credentialServer) fail(w http.ResponseWriter, err error) {
+	log.Print("WARNING: Unable to serve credentials: " + err.Error())
+	http.Error(w, "Credentials unavailable", http.StatusServiceUnavailable)
+}
+
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// wipe forgets the credentials being served. Go has no way of scrubbing
+// strings, so the best it can do is drop every reference to them, and
+// have the runtime collect them and hand the memory back.
+func (server *credentialServer) wipe() {
+	server.mutex.Lock()
+	server.closed = true
+	server.current = nil
+	server.roleName = ""
+	server.provider = nil
+	server.imdsTokens = map[string]time.Time{}
+	server.mutex.Unlock()
+	debug.FreeOSMemory()
+}
+
+// serveCredentials serves until a signal arrives, then finishes the
+// requests in flight and wipes the credentials
+func serveCredentials(listener net.Listener, server *credentialServer, signals <-chan os.Signal) error {
+	httpServer := &http.Server{Handler: server, ReadHeaderTimeout: 10 * time.Second}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- httpServer.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		server.wipe()
+		return err
+	case <-signals:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	err := httpServer.Shutdown(ctx)
+	server.wipe()
+	return err
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testServerRequest(server *credentialServer, method, path string, headers map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "http://127.0.0.1:9911"+path, nil)
+	panic_the_err(err)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	return w
+}
+
+func TestServeECSCredentials(t *testing.T) {
+	Convey("Test serving credentials as ECS does", t, func() {
+		calls := 0
+		server, err := newCredentialServer(func() (Credentials, error) {
+			calls += 1
+			return testCredentials(), nil
+		}, true)
+		So(err, ShouldEqual, nil)
+		So(len(server.authToken), ShouldEqual, 64)
+		now := time.Date(2014, 6, 12, 0, 0, 0, 0, time.UTC)
+		server.now = func() time.Time { return now }
+
+		Convey("The authorization token is required", func() {
+			w := testServerRequest(server, "GET", ECS_CREDENTIALS_PATH, nil)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			w = testServerRequest(server, "GET", ECS_CREDENTIALS_PATH, map[string]string{"Authorization": "guess"})
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			So(calls, ShouldEqual, 0)
+		})
+
+		Convey("Long-term credentials are served with a rolling expiry", func() {
+			auth := map[string]string{"Authorization": server.authToken}
+			w := testServerRequest(server, "GET", ECS_CREDENTIALS_PATH, auth)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var served servedCredential
+			So(json.Unmarshal(w.Body.Bytes(), &served), ShouldEqual, nil)
+			So(served.AccessKeyId, ShouldEqual, "plaintextkeyid")
+			So(served.SecretAccessKey, ShouldEqual, "plaintextsecret")
+			So(served.Token, ShouldEqual, "")
+			So(served.Expiration, ShouldEqual, "2014-06-12T01:00:00Z")
+			So(served.Code, ShouldEqual, "")
+
+			now = now.Add(58 * time.Minute)
+			w = testServerRequest(server, "GET", ECS_CREDENTIALS_PATH, auth)
+			So(json.Unmarshal(w.Body.Bytes(), &served), ShouldEqual, nil)
+			So(served.Expiration, ShouldEqual, "2014-06-12T01:58:00Z")
+			// they're never decrypted again
+			So(calls, ShouldEqual, 1)
+		})
+
+		Convey("Requests for other hosts are refused", func() {
+			req, err := http.NewRequest("GET", "http://attacker.example.com"+ECS_CREDENTIALS_PATH, nil)
+			panic_the_err(err)
+			req.Header.Set("Authorization", server.authToken)
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("Nothing is served once the credentials are wiped", func() {
+			server.wipe()
+			w := testServerRequest(server, "GET", ECS_CREDENTIALS_PATH, map[string]string{"Authorization": server.authToken})
+			So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(server.current, ShouldBeNil)
+		})
+	})
+}
+
+func TestServeSessionCredentials(t *testing.T) {
+	Convey("Test renewing session credentials", t, func() {
+		now := time.Date(2014, 6, 12, 0, 0, 0, 0, time.UTC)
+		calls := 0
+		server, err := newCredentialServer(func() (Credentials, error) {
+			calls += 1
+			if calls > 2 {
+				return Credentials{}, errors.New("STS is down")
+			}
+			return testSession(now.Add(time.Hour)), nil
+		}, true)
+		So(err, ShouldEqual, nil)
+		server.now = func() time.Time { return now }
+
+		cred, _, expiry, err := server.credential()
+		So(err, ShouldEqual, nil)
+		So(cred.SessionToken, ShouldEqual, "sessiontoken")
+		So(expiry, ShouldResemble, now.Add(time.Hour))
+
+		now = now.Add(30 * time.Minute)
+		_, _, _, err = server.credential()
+		So(err, ShouldEqual, nil)
+		So(calls, ShouldEqual, 1)
+
+		now = now.Add(27 * time.Minute)
+		_, _, expiry, err = server.credential()
+		So(err, ShouldEqual, nil)
+		So(calls, ShouldEqual, 2)
+		So(expiry, ShouldResemble, now.Add(time.Hour))
+
+		now = now.Add(58 * time.Minute)
+		w := testServerRequest(server, "GET", ECS_CREDENTIALS_PATH, map[string]string{"Authorization": server.authToken})
+		So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+		So(w.Body.String(), ShouldNotContainSubstring, "STS")
+	})
+}
+
+func TestServeIMDSCredentials(t *testing.T) {
+	Convey("Test serving credentials as IMDSv2 does", t, func() {
+		server, err := newCredentialServer(func() (Credentials, error) {
+			return testSession(time.Now().Add(time.Hour)), nil
+		}, true)
+		So(err, ShouldEqual, nil)
+
+		Convey("A session token is needed", func() {
+			w := testServerRequest(server, "GET", IMDS_CREDENTIALS_PATH, nil)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			w = testServerRequest(server, "GET", IMDS_TOKEN_PATH, map[string]string{IMDS_TOKEN_TTL_HEADER: "60"})
+			So(w.Code, ShouldEqual, http.StatusMethodNotAllowed)
+			w = testServerRequest(server, "PUT", IMDS_TOKEN_PATH, nil)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			w = testServerRequest(server, "PUT", IMDS_TOKEN_PATH, map[string]string{IMDS_TOKEN_TTL_HEADER: "60", "X-Forwarded-For": "10.0.0.1"})
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("The role is listed, then its credentials fetched", func() {
+			w := testServerRequest(server, "PUT", IMDS_TOKEN_PATH, map[string]string{IMDS_TOKEN_TTL_HEADER: "60"})
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get(IMDS_TOKEN_TTL_HEADER), ShouldEqual, "60")
+			token := map[string]string{IMDS_TOKEN_HEADER: w.Body.String()}
+
+			w = testServerRequest(server, "GET", IMDS_CREDENTIALS_PATH, token)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, "testuser")
+
+			w = testServerRequest(server, "GET", IMDS_CREDENTIALS_PATH+"testuser", token)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var served servedCredential
+			So(json.Unmarshal(w.Body.Bytes(), &served), ShouldEqual, nil)
+			So(served.Code, ShouldEqual, "Success")
+			So(served.Type, ShouldEqual, "AWS-HMAC")
+			So(served.AccessKeyId, ShouldEqual, "ASIAsession")
+			So(served.Token, ShouldEqual, "sessiontoken")
+
+			w = testServerRequest(server, "GET", IMDS_CREDENTIALS_PATH+"otherrole", token)
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Session tokens expire", func() {
+			w := testServerRequest(server, "PUT", IMDS_TOKEN_PATH, map[string]string{IMDS_TOKEN_TTL_HEADER: "1"})
+			token := map[string]string{IMDS_TOKEN_HEADER: w.Body.String()}
+			server.now = func() time.Time { return time.Now().Add(2 * time.Second) }
+			w = testServerRequest(server, "GET", IMDS_CREDENTIALS_PATH, token)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("IMDS can be turned off", func() {
+			server.imds = false
+			w := testServerRequest(server, "PUT", IMDS_TOKEN_PATH, map[string]string{IMDS_TOKEN_TTL_HEADER: "60"})
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+			So(len(server.environment("127.0.0.1:9911")), ShouldEqual, 2)
+		})
+	})
+}
+
+func TestServeOnLoopback(t *testing.T) {
+	Convey("Test credentials are only served on the loopback interface", t, func() {
+		So(isLoopbackHost("127.0.0.1:9911"), ShouldBeTrue)
+		So(isLoopbackHost("[::1]:9911"), ShouldBeTrue)
+		So(isLoopbackHost("localhost"), ShouldBeTrue)
+		So(isLoopbackHost("0.0.0.0:9911"), ShouldBeFalse)
+		So(isLoopbackHost("127.0.0.1.attacker.example.com"), ShouldBeFalse)
+
+		_, err := listenLoopback("0.0.0.0:0")
+		So(err, ShouldNotEqual, nil)
+		_, err = listenLoopback(":0")
+		So(err, ShouldNotEqual, nil)
+	})
+
+	Convey("Test serving until a signal arrives", t, func() {
+		server, err := newCredentialServer(func() (Credentials, error) {
+			return testCredentials(), nil
+		}, true)
+		So(err, ShouldEqual, nil)
+		listener, err := listenLoopback(DEFAULT_SERVE_ADDRESS)
+		So(err, ShouldEqual, nil)
+		signals := make(chan os.Signal, 1)
+		done := make(chan error, 1)
+		go func() {
+			done <- serveCredentials(listener, server, signals)
+		}()
+
+		vars := server.environment(listener.Addr().String())
+		So(vars[0].name, ShouldEqual, "AWS_CONTAINER_CREDENTIALS_FULL_URI")
+		req, err := http.NewRequest("GET", vars[0].value, nil)
+		panic_the_err(err)
+		req.Header.Set("Authorization", vars[1].value)
+		resp, err := http.DefaultClient.Do(req)
+		So(err, ShouldEqual, nil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		So(err, ShouldEqual, nil)
+		So(string(body), ShouldContainSubstring, "plaintextkeyid")
+
+		signals <- os.Interrupt
+		So(<-done, ShouldEqual, nil)
+		So(server.closed, ShouldBeTrue)
+		So(server.current, ShouldBeNil)
+	})
+}
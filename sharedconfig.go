@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The AWS CLI and SDKs share their credentials and configuration in two
+// INI files, whose locations can be changed with these variables
+const (
+	SHARED_CREDENTIALS_ENV string = "AWS_SHARED_CREDENTIALS_FILE"
+	SHARED_CONFIG_ENV      string = "AWS_CONFIG_FILE"
+)
+
+// the keys credentials are kept under, in either file
+const (
+	INI_ACCESS_KEY_ID     string = "aws_access_key_id"
+	INI_SECRET_ACCESS_KEY string = "aws_secret_access_key"
+	INI_SESSION_TOKEN     string = "aws_session_token"
+	INI_SECURITY_TOKEN    string = "aws_security_token"
+	INI_CREDENTIAL_PROC   string = "credential_process"
+)
+
+// profile names are kept to what can't break the section headers
+var PROFILE_NAME_PATTERN = regexp.MustCompile(`^[A-Za-z0-9_.@+=,-]+$`)
+
+func sharedFilePath(envName, name string) string {
+	filename := os.Getenv(envName)
+	if filename == "" {
+		return filepath.Join(os.Getenv("HOME"), ".aws", name)
+	}
+	if strings.HasPrefix(filename, "~/") {
+		return filepath.Join(os.Getenv("HOME"), filename[2:])
+	}
+	return filename
+}
+
+func sharedCredentialsPath() string {
+	return sharedFilePath(SHARED_CREDENTIALS_ENV, "credentials")
+}
+
+func sharedConfigPath() string {
+	return sharedFilePath(SHARED_CONFIG_ENV, "config")
+}
+
+// An iniFile keeps every line of the file it was read from, so that
+// changing one section leaves the rest of the file exactly as it was
+type iniFile struct {
+	sections []*iniSection
+}
+
+// The lines of a section include its header, apart from the lines before
+// the first header, which are kept in a section with no name
+type iniSection struct {
+	name  string
+	lines []string
+}
+
+func parseINI(b []byte) *iniFile {
+	file := &iniFile{sections: []*iniSection{{}}}
+	text := strings.TrimSuffix(string(b), "\n")
+	if text == "" {
+		return file
+	}
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			name := strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			file.sections = append(file.sections, &iniSection{name: name})
+		}
+		last := file.sections[len(file.sections)-1]
+		last.lines = append(last.lines, line)
+	}
+	return file
+}
+
+// readINIFile treats a missing file as an empty one
+func readINIFile(filename string) (*iniFile, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return parseINI(nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseINI(b), nil
+}
+
+func (file *iniFile) section(name string) *iniSection {
+	for _, section := range file.sections[1:] {
+		if section.name == name {
+			return section
+		}
+	}
+	return nil
+}
+
+// addSection returns the named section, adding it to the end of the file
+// if it isn't there already
+func (file *iniFile) addSection(name string) *iniSection {
+	if section := file.section(name); section != nil {
+		return section
+	}
+	last := file.sections[len(file.sections)-1]
+	if n := len(last.lines); n > 0 && strings.TrimSpace(last.lines[n-1]) != "" {
+		last.lines = append(last.lines, "")
+	}
+	section := &iniSection{name: name, lines: []string{"[" + name + "]"}}
+	file.sections = append(file.sections, section)
+	return section
+}
+
+func (file *iniFile) bytes() []byte {
+	lines := []string{}
+	for _, section := range file.sections {
+		lines = append(lines, section.lines...)
+	}
+	if len(lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// writeFile replaces the file in one go, so that a reader never sees half
+// of it; it holds credentials, so only its owner may read it
+func (file *iniFile) writeFile(filename string) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(0600); err == nil {
+		_, err = tmp.Write(file.bytes())
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// find returns the index of the line setting key; indented lines carry on
+// the value before them, so they're never keys
+func (section *iniSection) find(key string) int {
+	for i, line := range section.lines {
+		if line == "" || line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && strings.ToLower(strings.TrimSpace(parts[0])) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (section *iniSection) get(key string) string {
+	i := section.find(key)
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSpace(strings.SplitN(section.lines[i], "=", 2)[1])
+}
+
+// set replaces the key's value where it is, or adds the key after the
+// last line in the section that isn't blank
+func (section *iniSection) set(key, value string) {
+	line := key + " = " + value
+	if i := section.find(key); i >= 0 {
+		section.lines[i] = line
+		return
+	}
+	end := len(section.lines)
+	for end > 1 && strings.TrimSpace(section.lines[end-1]) == "" {
+		end -= 1
+	}
+	lines := append([]string{}, section.lines[:end]...)
+	lines = append(lines, line)
+	section.lines = append(lines, section.lines[end:]...)
+}
+
+func (section *iniSection) remove(key string) {
+	if i := section.find(key); i >= 0 {
+		section.lines = append(section.lines[:i], section.lines[i+1:]...)
+	}
+}
+
+// configSectionName is the section a profile has in the config file,
+// where all but the default profile are prefixed with 'profile'
+func configSectionName(profile string) string {
+	if profile == "default" {
+		return profile
+	}
+	return "profile " + profile
+}
+
+type sharedProfile struct {
+	name string
+	cred Credential
+}
+
+func (section *iniSection) credential() (Credential, bool) {
+	cred := Credential{
+		KeyId:        section.get(INI_ACCESS_KEY_ID),
+		SecretKey:    section.get(INI_SECRET_ACCESS_KEY),
+		SessionToken: section.get(INI_SESSION_TOKEN),
+	}
+	if cred.SessionToken == "" {
+		cred.SessionToken = section.get(INI_SECURITY_TOKEN)
+	}
+	return cred, cred.KeyId != "" && cred.SecretKey != ""
+}
+
+// readSharedProfiles returns the profiles with keys in them, from the
+// credentials file and then the config file, which the SDKs also read
+// keys from; where both have keys for a profile, the credentials file wins
+func readSharedProfiles(credentialsFile, configFile string) ([]sharedProfile, error) {
+	profiles := []sharedProfile{}
+	seen := map[string]bool{}
+
+	file, err := readINIFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, section := range file.sections[1:] {
+		if cred, ok := section.credential(); ok && !seen[section.name] {
+			profiles = append(profiles, sharedProfile{name: section.name, cred: cred})
+			seen[section.name] = true
+		}
+	}
+
+	file, err = readINIFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, section := range file.sections[1:] {
+		name := section.name
+		if name != "default" {
+			if !strings.HasPrefix(name, "profile ") {
+				continue
+			}
+			name = strings.TrimSpace(strings.TrimPrefix(name, "profile "))
+		}
+		if cred, ok := section.credential(); ok && !seen[name] {
+			profiles = append(profiles, sharedProfile{name: name, cred: cred})
+			seen[name] = true
+		}
+	}
+	return profiles, nil
+}
+
+// selectProfiles picks the named profiles, in the order named, or all of
+// them if none are named
+func selectProfiles(profiles []sharedProfile, names []string) ([]sharedProfile, error) {
+	if len(names) == 0 {
+		return profiles, nil
+	}
+	selected := []sharedProfile{}
+	for _, name := range names {
+		found := false
+		for _, profile := range profiles {
+			if profile.name == name {
+				selected = append(selected, profile)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.New("No credentials found for the profile '" + name + "'")
+		}
+	}
+	return selected, nil
+}
+
+// importProfile saves a profile's credentials. Unless data.force is set,
+// they're saved under the user and account IAM (or STS) says they belong
+// to; otherwise, under the profile name if it's username@account, or as
+// the user named by the profile in the account in data.alias
+func importProfile(profile sharedProfile, data SaveData) error {
+	data.cred = profile.cred
+	data.cred.EnvVars = nil
+	if data.force {
+		if strings.Contains(profile.name, "@") {
+			account, username, err := splitUserAndAccount(profile.name)
+			if err != nil {
+				return err
+			}
+			data.username, data.alias = username, account
+		} else if data.alias != "" {
+			data.username = profile.name
+		} else {
+			return errors.New("Cannot tell whose credentials are in the profile '" + profile.name +
+				"' without checking with AWS; name the profile username@account, or specify the account")
+		}
+	}
+	return SaveCredentials(data)
+}
+
+// exportProfile writes the credentials into the credentials file, in
+// place of any already in the profile, leaving everything else alone
+func exportProfile(filename, profile string, cred Credential) error {
+	if !PROFILE_NAME_PATTERN.MatchString(profile) {
+		return errors.New("Invalid profile name '" + profile + "'")
+	}
+	file, err := readINIFile(filename)
+	if err != nil {
+		return err
+	}
+	section := file.addSection(profile)
+	section.set(INI_ACCESS_KEY_ID, cred.KeyId)
+	section.set(INI_SECRET_ACCESS_KEY, cred.SecretKey)
+	if cred.temporary() {
+		section.set(INI_SESSION_TOKEN, cred.SessionToken)
+	} else {
+		section.remove(INI_SESSION_TOKEN)
+	}
+	section.remove(INI_SECURITY_TOKEN)
+	return file.writeFile(filename)
+}
+
+// exportCredentialProcess sets up the profile in the config file to run
+// command for its credentials, rather than writing them out. The SDKs
+// prefer keys in the credentials file, so any there are warned about.
+func exportCredentialProcess(configFile, credentialsFile, profile, command string) error {
+	if !PROFILE_NAME_PATTERN.MatchString(profile) {
+		return errors.New("Invalid profile name '" + profile + "'")
+	}
+	file, err := readINIFile(configFile)
+	if err != nil {
+		return err
+	}
+	section := file.addSection(configSectionName(profile))
+	section.set(INI_CREDENTIAL_PROC, command)
+	for _, key := range []string{INI_ACCESS_KEY_ID, INI_SECRET_ACCESS_KEY, INI_SESSION_TOKEN, INI_SECURITY_TOKEN} {
+		section.remove(key)
+	}
+	err = file.writeFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	credentials, err := readINIFile(credentialsFile)
+	if err != nil {
+		return err
+	}
+	if found := credentials.section(profile); found != nil {
+		if _, ok := found.credential(); ok {
+			log.Print("WARNING: The keys for the profile '" + profile + "' in " + credentialsFile + " will be used instead")
+		}
+	}
+	return nil
+}
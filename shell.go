@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// An OutputFormat writes environment variable assignments (and the
+// statements to remove them again) in a form a particular shell or tool
+// understands. Each writes its output in a single Write call.
+type OutputFormat interface {
+	Set(output io.Writer, vars []envVar) error
+	Unset(output io.Writer, names []string) error
+}
+
+const DEFAULT_OUTPUT_FORMAT string = "bash"
+
+var OUTPUT_FORMATS = map[string]OutputFormat{
+	"bash":       posixFormat{},
+	"sh":         posixFormat{},
+	"zsh":        posixFormat{},
+	"fish":       fishFormat{},
+	"powershell": powershellFormat{},
+	"cmd":        cmdFormat{},
+	"dotenv":     dotenvFormat{},
+	"json":       jsonFormat{},
+}
+
+func getOutputFormat(name string) (OutputFormat, error) {
+	if name == "" {
+		name = DEFAULT_OUTPUT_FORMAT
+	}
+	format, ok := OUTPUT_FORMATS[strings.ToLower(name)]
+	if !ok {
+		names := []string{}
+		for name := range OUTPUT_FORMATS {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Unknown output format '%s'; choose one of %s", name, strings.Join(names, ", "))
+	}
+	return format, nil
+}
+
+// bash, zsh and other POSIX shells: inside double quotes, only these
+// characters are special
+type posixFormat struct{}
+
+var posixEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+
+func (posixFormat) Set(output io.Writer, vars []envVar) error {
+	var buf bytes.Buffer
+	for _, v := range vars {
+		fmt.Fprintf(&buf, "export %s=\"%s\"\n", v.name, posixEscaper.Replace(v.value))
+	}
+	_, err := output.Write(buf.Bytes())
+	return err
+}
+
+func (posixFormat) Unset(output io.Writer, names []string) error {
+	_, err := fmt.Fprintf(output, "unset %s\n", strings.Join(names, " "))
+	return err
+}
+
+// shellJoin makes a command line of args for a POSIX shell, quoting any
+// that need it in single quotes, inside which nothing is special
+func shellJoin(args []string) string {
+	quoted := []string{}
+	for _, arg := range args {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./_-") == "" {
+			quoted = append(quoted, arg)
+		} else {
+			quoted = append(quoted, "'"+strings.Replace(arg, "'", `'\''`, -1)+"'")
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// fish: inside single quotes, only backslash and single quote are special
+type fishFormat struct{}
+
+var fishEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+func (fishFormat) Set(output io.Writer, vars []envVar) error {
+	var buf bytes.Buffer
+	for _, v := range vars {
+		fmt.Fprintf(&buf, "set -gx %s '%s';\n", v.name, fishEscaper.Replace(v.value))
+	}
+	_, err := output.Write(buf.Bytes())
+	return err
+}
+
+func (fishFormat) Unset(output io.Writer, names []string) error {
+	_, err := fmt.Fprintf(output, "set -e %s;\n", strings.Join(names, " "))
+	return err
+}
+
+// PowerShell: inside single quotes, a single quote is written twice
+type powershellFormat struct{}
+
+func (powershellFormat) Set(output io.Writer, vars []envVar) error {
+	var buf bytes.Buffer
+	for _, v := range vars {
+		fmt.Fprintf(&buf, "$Env:%s = '%s'\n", v.name, strings.Replace(v.value, "'", "''", -1))
+	}
+	_, err := output.Write(buf.Bytes())
+	return err
+}
+
+func (powershellFormat) Unset(output io.Writer, names []string) error {
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "Remove-Item Env:%s -ErrorAction SilentlyContinue\n", name)
+	}
+	_, err := output.Write(buf.Bytes())
+	return err
+}
+
+// cmd.exe, as a batch file: the quotes around the whole assignment make
+// everything but % literal, and % is escaped by doubling it. There's no
+// way at all to set a variable containing a newline.
+type cmdFormat struct{}
+
+func (cmdFormat) Set(output io.Writer, vars []envVar) error {
+	var buf bytes.Buffer
+	for _, v := range vars {
+		if strings.ContainsAny(v.value, "\r\n") {
+			return fmt.Errorf("The value of %s contains a newline, which cmd cannot represent", v.name)
+		}
+		fmt.Fprintf(&buf, "set \"%s=%s\"\r\n", v.name, strings.Replace(v.value, "%", "%%", -1))
+	}
+	_, err := output.Write(buf.Bytes())
+	return err
+}
+
+func (cmdFormat) Unset(output io.Writer, names []string) error {
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "set \"%s=\"\r\n", name)
+	}
+	_, err := output.Write(buf.Bytes())
+	return err
+}
+
+// dotenv files, as read by docker-compose, foreman and friends
+type dotenvFormat struct{}
+
+var dotenvEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`)
+
+func (dotenvFormat) Set(output io.Writer, vars []envVar) error {
+	var buf bytes.Buffer
+	for _, v := range vars {
+		fmt.Fprintf(&buf, "%s=\"%s\"\n", v.name, dotenvEscaper.Replace(v.value))
+	}
+	_, err := output.Write(buf.Bytes())
+	return err
+}
+
+func (dotenvFormat) Unset(output io.Writer, names []string) error {
+	return errors.New("The dotenv format cannot unset variables")
+}
+
+type jsonFormat struct{}
+
+func (jsonFormat) Set(output io.Writer, vars []envVar) error {
+	values := make(map[string]string)
+	for _, v := range vars {
+		values[v.name] = v.value
+	}
+	b, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(append(b, '\n'))
+	return err
+}
+
+func (jsonFormat) Unset(output io.Writer, names []string) error {
+	return errors.New("The json format cannot unset variables")
+}
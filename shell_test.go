@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testAwkwardVars() []envVar {
+	return []envVar{
+		{"PLAIN", "value"},
+		{"AWKWARD", `it's "$HOME" \ ` + "`pwd`%PATH%"},
+	}
+}
+
+func TestOutputFormats(t *testing.T) {
+	Convey("Test choosing an output format", t, func() {
+		format, err := getOutputFormat("")
+		So(err, ShouldEqual, nil)
+		So(format, ShouldResemble, posixFormat{})
+		format, err = getOutputFormat("PowerShell")
+		So(err, ShouldEqual, nil)
+		So(format, ShouldResemble, powershellFormat{})
+		_, err = getOutputFormat("tcsh")
+		So(err, ShouldNotEqual, nil)
+	})
+
+	Convey("Test quoting for each format", t, func() {
+		Convey("bash", func() {
+			var buf bytes.Buffer
+			err := posixFormat{}.Set(&buf, testAwkwardVars())
+			So(err, ShouldEqual, nil)
+			So(buf.String(), ShouldEqual, "export PLAIN=\"value\"\nexport AWKWARD=\"it's \\\"\\$HOME\\\" \\\\ \\`pwd\\`%PATH%\"\n")
+		})
+		Convey("fish", func() {
+			var buf bytes.Buffer
+			err := fishFormat{}.Set(&buf, testAwkwardVars())
+			So(err, ShouldEqual, nil)
+			So(buf.String(), ShouldEqual, "set -gx PLAIN 'value';\nset -gx AWKWARD 'it\\'s \"$HOME\" \\\\ `pwd`%PATH%';\n")
+		})
+		Convey("PowerShell", func() {
+			var buf bytes.Buffer
+			err := powershellFormat{}.Set(&buf, testAwkwardVars())
+			So(err, ShouldEqual, nil)
+			So(buf.String(), ShouldEqual, "$Env:PLAIN = 'value'\n$Env:AWKWARD = 'it''s \"$HOME\" \\ `pwd`%PATH%'\n")
+		})
+		Convey("cmd", func() {
+			var buf bytes.Buffer
+			err := cmdFormat{}.Set(&buf, testAwkwardVars())
+			So(err, ShouldEqual, nil)
+			So(buf.String(), ShouldEqual, "set \"PLAIN=value\"\r\nset \"AWKWARD=it's \"$HOME\" \\ `pwd`%%PATH%%\"\r\n")
+
+			err = cmdFormat{}.Set(&buf, []envVar{{"MULTI", "two\nlines"}})
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("dotenv", func() {
+			var buf bytes.Buffer
+			err := dotenvFormat{}.Set(&buf, []envVar{{"MULTI", "two\n\"lines\""}})
+			So(err, ShouldEqual, nil)
+			So(buf.String(), ShouldEqual, "MULTI=\"two\\n\\\"lines\\\"\"\n")
+		})
+		Convey("json", func() {
+			var buf bytes.Buffer
+			err := jsonFormat{}.Set(&buf, testAwkwardVars())
+			So(err, ShouldEqual, nil)
+			var values map[string]string
+			err = json.Unmarshal(buf.Bytes(), &values)
+			So(err, ShouldEqual, nil)
+			So(values["AWKWARD"], ShouldEqual, testAwkwardVars()[1].value)
+		})
+	})
+
+	Convey("Test unsetting credentials", t, func() {
+		creds := testCredentials()
+		Convey("bash", func() {
+			var buf bytes.Buffer
+			err := creds.DisplayUnset(&buf, posixFormat{})
+			So(err, ShouldEqual, nil)
+			So(buf.String(), ShouldEqual, "unset AWS_ACCESS_KEY_ID AWS_SECRET_ACCESS_KEY AWS_SESSION_TOKEN AWS_SECURITY_TOKEN BACON FOO\n")
+		})
+		Convey("PowerShell", func() {
+			var buf bytes.Buffer
+			err := creds.DisplayUnset(&buf, powershellFormat{})
+			So(err, ShouldEqual, nil)
+			So(buf.String(), ShouldContainSubstring, "Remove-Item Env:FOO -ErrorAction SilentlyContinue\n")
+		})
+		Convey("Formats that can't unset", func() {
+			var buf bytes.Buffer
+			So(creds.DisplayUnset(&buf, dotenvFormat{}), ShouldNotEqual, nil)
+			So(creds.DisplayUnset(&buf, jsonFormat{}), ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestShellJoin(t *testing.T) {
+	Convey("Test quoting a command line for a shell", t, func() {
+		So(shellJoin([]string{"credulous", "process", "hoopy@frood", "--repo", "/home/ford/.credulous/local"}),
+			ShouldEqual, "credulous process hoopy@frood --repo /home/ford/.credulous/local")
+		So(shellJoin([]string{"--repo", "/home/ford/my repos/ops; rm -rf ~", "--role", "it's", ""}),
+			ShouldEqual, `--repo '/home/ford/my repos/ops; rm -rf ~' --role 'it'\''s' ''`)
+	})
+}
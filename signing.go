@@ -0,0 +1,711 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/libgit2/git2go"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Anyone who can push to a shared repository could replace a credential
+// file with one of their own, so commits can be signed, and credentials
+// verified before they're used. Signing is set up with git's own
+// settings (commit.gpgsign, gpg.format and user.signingkey), so that git
+// signs the same way: SSH signatures are made here, with the ssh-agent or
+// the private key, and OpenPGP ones with gpg. With credulous.verifysignatures
+// set, credentials are only used if the commit that saved them was signed
+// by someone in the keyring, and the keyring itself only if each change
+// to it, deleting it included, was signed by someone in the keyring it
+// replaced. The first keyring can only be signed by someone in it, so
+// the commit that introduced it is pinned, as credulous.keyringroot,
+// when verifying is set up; any other keyring without one before it is
+// refused.
+const (
+	VERIFY_SIGNATURES_KEY string = "credulous.verifysignatures"
+	KEYRING_ROOT_KEY      string = "credulous.keyringroot"
+	SSHSIG_MAGIC          string = "SSHSIG"
+	SSHSIG_NAMESPACE      string = "git"
+	SSHSIG_BEGIN          string = "-----BEGIN SSH SIGNATURE-----"
+	SSHSIG_END            string = "-----END SSH SIGNATURE-----"
+	PGP_SIGNATURE_BEGIN   string = "-----BEGIN PGP SIGNATURE-----"
+)
+
+// the parts of an SSH signature (see OpenSSH's PROTOCOL.sshsig) after
+// the magic preamble
+type sshSignature struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// what's actually signed, after the magic preamble
+type sshSignedData struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+func sshSignatureHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, errors.New("Unsupported SSH signature hash " + algorithm)
+}
+
+func sshSignedBytes(namespace, algorithm string, message []byte) ([]byte, error) {
+	h, err := sshSignatureHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(message)
+	data := sshSignedData{Namespace: namespace, HashAlgorithm: algorithm, Hash: h.Sum(nil)}
+	return append([]byte(SSHSIG_MAGIC), ssh.Marshal(data)...), nil
+}
+
+// signSSH makes an armored SSH signature of message, signing with sign
+func signSSH(message []byte, pubkey ssh.PublicKey, sign func(data []byte) (*ssh.Signature, error)) (string, error) {
+	data, err := sshSignedBytes(SSHSIG_NAMESPACE, "sha512", message)
+	if err != nil {
+		return "", err
+	}
+	sig, err := sign(data)
+	if err != nil {
+		return "", err
+	}
+	blob := append([]byte(SSHSIG_MAGIC), ssh.Marshal(sshSignature{
+		Version:       1,
+		PublicKey:     pubkey.Marshal(),
+		Namespace:     SSHSIG_NAMESPACE,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(sig),
+	})...)
+
+	encoded := base64.StdEncoding.EncodeToString(blob)
+	lines := []string{SSHSIG_BEGIN}
+	for len(encoded) > 70 {
+		lines = append(lines, encoded[:70])
+		encoded = encoded[70:]
+	}
+	lines = append(lines, encoded, SSHSIG_END)
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// verifySSHSignature checks an armored SSH signature of message, and
+// returns the key that made it
+func verifySSHSignature(armored string, message []byte) (ssh.PublicKey, error) {
+	armored = strings.TrimSpace(armored)
+	if !strings.HasPrefix(armored, SSHSIG_BEGIN) || !strings.HasSuffix(armored, SSHSIG_END) {
+		return nil, errors.New("Not an SSH signature")
+	}
+	encoded := strings.Join(strings.Fields(armored[len(SSHSIG_BEGIN):len(armored)-len(SSHSIG_END)]), "")
+	blob, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("Invalid SSH signature: " + err.Error())
+	}
+	if !bytes.HasPrefix(blob, []byte(SSHSIG_MAGIC)) {
+		return nil, errors.New("Invalid SSH signature")
+	}
+	var parsed sshSignature
+	if err = ssh.Unmarshal(blob[len(SSHSIG_MAGIC):], &parsed); err != nil {
+		return nil, errors.New("Invalid SSH signature: " + err.Error())
+	}
+	if parsed.Version != 1 {
+		return nil, fmt.Errorf("Unsupported SSH signature version %d", parsed.Version)
+	}
+	if parsed.Namespace != SSHSIG_NAMESPACE {
+		return nil, errors.New("The SSH signature is for " + parsed.Namespace + ", not " + SSHSIG_NAMESPACE)
+	}
+	pubkey, err := ssh.ParsePublicKey(parsed.PublicKey)
+	if err != nil {
+		return nil, errors.New("Invalid SSH signature: " + err.Error())
+	}
+	var sig ssh.Signature
+	if err = ssh.Unmarshal(parsed.Signature, &sig); err != nil {
+		return nil, errors.New("Invalid SSH signature: " + err.Error())
+	}
+	// as for OpenSSH, SHA-1 isn't good enough
+	if sig.Format == ssh.KeyAlgoRSA {
+		return nil, errors.New("SSH signatures made with ssh-rsa (SHA-1) are not accepted")
+	}
+	data, err := sshSignedBytes(parsed.Namespace, parsed.HashAlgorithm, message)
+	if err != nil {
+		return nil, err
+	}
+	if err = pubkey.Verify(data, &sig); err != nil {
+		return nil, errors.New("The SSH signature does not match: " + err.Error())
+	}
+	return pubkey, nil
+}
+
+// parseGPGStatus returns the fingerprints of the signing key, and its
+// primary key, from the status lines gpg writes on verifying a good
+// signature
+func parseGPGStatus(status []byte) []string {
+	fingerprints := []string{}
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "[GNUPG:]" || fields[1] != "VALIDSIG" {
+			continue
+		}
+		fingerprints = append(fingerprints, fields[2])
+		if len(fields) >= 12 {
+			fingerprints = append(fingerprints, fields[11])
+		}
+	}
+	return fingerprints
+}
+
+func normalizePGPFingerprint(fingerprint string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(fingerprint), ""))
+}
+
+// verifyGPGSignature has gpg check an OpenPGP signature of message,
+// returning the fingerprints of the key that made it
+func verifyGPGSignature(program, armored string, message []byte) ([]string, error) {
+	sigfile, err := ioutil.TempFile("", "credulous-signature")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(sigfile.Name())
+	_, err = sigfile.WriteString(armored)
+	sigfile.Close()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(program, "--status-fd=1", "--verify", sigfile.Name(), "-")
+	cmd.Stdin = bytes.NewReader(message)
+	// gpg exits non-zero for a bad signature, so the status says which
+	status, _ := cmd.Output()
+	fingerprints := parseGPGStatus(status)
+	if len(fingerprints) == 0 {
+		return nil, errors.New("The OpenPGP signature could not be verified with " + program)
+	}
+	return fingerprints, nil
+}
+
+// trustedSigner names the recipient in the keyring whose key made the
+// signature of message
+func trustedSigner(keyring Keyring, signature string, message []byte, gpgProgram string) (string, error) {
+	if strings.HasPrefix(strings.TrimSpace(signature), PGP_SIGNATURE_BEGIN) {
+		fingerprints, err := verifyGPGSignature(gpgProgram, signature, message)
+		if err != nil {
+			return "", err
+		}
+		for _, recipient := range keyring.Recipients {
+			for _, fingerprint := range fingerprints {
+				if recipient.PGPFingerprint != "" && normalizePGPFingerprint(fingerprint) == normalizePGPFingerprint(recipient.PGPFingerprint) {
+					return recipient.Name, nil
+				}
+			}
+		}
+		return "", errors.New("Signed with OpenPGP key " + fingerprints[len(fingerprints)-1] + ", which is not in the keyring")
+	}
+
+	pubkey, err := verifySSHSignature(signature, message)
+	if err != nil {
+		return "", err
+	}
+	for _, recipient := range keyring.Recipients {
+		if fingerprintMatches(recipient.Fingerprint, pubkey) {
+			return recipient.Name, nil
+		}
+	}
+	return "", errors.New("Signed with SSH key " + SSHFingerprint(pubkey) + ", which is not in the keyring")
+}
+
+// commitSigner signs commits as git would, given the repository's
+// configuration
+type commitSigner struct {
+	format     string
+	key        string
+	gpgProgram string
+}
+
+// gitCommitSigner returns nil if commits aren't to be signed
+func gitCommitSigner(repo *git.Repository) (*commitSigner, error) {
+	config, err := repo.Config()
+	if err != nil {
+		return nil, err
+	}
+	if sign, err := config.LookupBool("commit.gpgsign"); err != nil || !sign {
+		return nil, nil
+	}
+	signer := &commitSigner{format: "openpgp", gpgProgram: "gpg"}
+	if format, err := config.LookupString("gpg.format"); err == nil && format != "" {
+		signer.format = format
+	}
+	if program, err := config.LookupString("gpg.program"); err == nil && program != "" {
+		signer.gpgProgram = program
+	}
+	signer.key, _ = config.LookupString("user.signingkey")
+	switch signer.format {
+	case "openpgp":
+	case "ssh":
+		if signer.key == "" {
+			return nil, errors.New("Commits are to be signed with SSH, but user.signingkey is not set")
+		}
+	default:
+		return nil, errors.New("Unable to sign commits with gpg.format " + signer.format)
+	}
+	return signer, nil
+}
+
+func (signer commitSigner) sign(content []byte) (string, error) {
+	if signer.format == "openpgp" {
+		args := []string{"--status-fd=2", "-bsa"}
+		if signer.key != "" {
+			args = append(args, "-u", signer.key)
+		}
+		cmd := exec.Command(signer.gpgProgram, args...)
+		cmd.Stdin = bytes.NewReader(content)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", errors.New("Unable to sign the commit with " + signer.gpgProgram + ": " + err.Error())
+		}
+		return string(out), nil
+	}
+
+	pubkey, keyfile, err := signer.sshKey()
+	if err != nil {
+		return "", err
+	}
+	if sshAgent, conn := connectSSHAgent(); sshAgent != nil {
+		defer conn.Close()
+		if held, err := agentHasKey(sshAgent, SSHFingerprint(pubkey)); err == nil && held != nil {
+			return signSSH(content, pubkey, func(data []byte) (*ssh.Signature, error) {
+				var flags agent.SignatureFlags
+				if pubkey.Type() == ssh.KeyAlgoRSA {
+					flags = agent.SignatureFlagRsaSha512
+				}
+				return sshAgent.SignWithFlags(pubkey, data, flags)
+			})
+		}
+	}
+	if keyfile == "" {
+		return "", errors.New("The ssh-agent doesn't hold the key to sign commits with")
+	}
+	privkey, err := loadPrivateKey(keyfile)
+	if err != nil {
+		return "", err
+	}
+	sshSigner, err := ssh.NewSignerFromSigner(privkey)
+	if err != nil {
+		return "", err
+	}
+	return signSSH(content, pubkey, func(data []byte) (*ssh.Signature, error) {
+		if algorithmSigner, ok := sshSigner.(ssh.AlgorithmSigner); ok && pubkey.Type() == ssh.KeyAlgoRSA {
+			return algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+		}
+		return sshSigner.Sign(rand.Reader, data)
+	})
+}
+
+// sshKey reads user.signingkey, which as for git is either a public key
+// itself, prefixed with "key::", or the file holding it or the private key
+func (signer commitSigner) sshKey() (pubkey ssh.PublicKey, keyfile string, err error) {
+	if strings.HasPrefix(signer.key, "key::") {
+		pubkey, _, _, _, err = ssh.ParseAuthorizedKey([]byte(strings.TrimPrefix(signer.key, "key::")))
+		return pubkey, "", err
+	}
+	keyfile = signer.key
+	if strings.HasPrefix(keyfile, "~/") {
+		keyfile = filepath.Join(os.Getenv("HOME"), keyfile[2:])
+	}
+	keyfile = strings.TrimSuffix(keyfile, ".pub")
+	pubkey, err = readSSHPubkeyFile(keyfile + ".pub")
+	if err != nil {
+		return nil, "", err
+	}
+	return pubkey, keyfile, nil
+}
+
+// gitCommitContent is the raw commit object git would write for the
+// commit, without a signature
+func gitCommitContent(tree *git.Oid, parents []*git.Oid, sig *git.Signature, message string) []byte {
+	var content bytes.Buffer
+	fmt.Fprintf(&content, "tree %s\n", tree.String())
+	for _, parent := range parents {
+		fmt.Fprintf(&content, "parent %s\n", parent.String())
+	}
+	ident := fmt.Sprintf("%s <%s> %d %s", sig.Name, sig.Email, sig.When.Unix(), sig.When.Format("-0700"))
+	fmt.Fprintf(&content, "author %s\ncommitter %s\n\n%s", ident, ident, message)
+	return content.Bytes()
+}
+
+// addCommitSignature adds the signature to the commit's headers, as git
+// does, indenting each of its lines after the first
+func addCommitSignature(content []byte, signature string) []byte {
+	end := bytes.Index(content, []byte("\n\n"))
+	header := "gpgsig " + strings.Replace(strings.TrimSuffix(signature, "\n"), "\n", "\n ", -1) + "\n"
+	signed := append([]byte{}, content[:end+1]...)
+	signed = append(signed, header...)
+	return append(signed, content[end+1:]...)
+}
+
+// gitCreateCommit commits tree on the branch HEAD is on, signing the
+// commit if the repository is set up to
+func gitCreateCommit(repo *git.Repository, sig *git.Signature, message string, tree *git.Tree, parents ...*git.Commit) (*git.Oid, error) {
+	signer, err := gitCommitSigner(repo)
+	if err != nil {
+		return nil, err
+	}
+	if signer == nil {
+		return repo.CreateCommit("HEAD", sig, sig, message, tree, parents...)
+	}
+
+	parentIds := []*git.Oid{}
+	for _, parent := range parents {
+		parentIds = append(parentIds, parent.Id())
+	}
+	content := gitCommitContent(tree.Id(), parentIds, sig, message)
+	signature, err := signer.sign(content)
+	if err != nil {
+		return nil, err
+	}
+	odb, err := repo.Odb()
+	if err != nil {
+		return nil, err
+	}
+	commitId, err := odb.Write(addCommitSignature(content, signature), git.ObjectCommit)
+	if err != nil {
+		return nil, err
+	}
+	head, err := repo.References.Lookup("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	summary := strings.SplitN(message, "\n", 2)[0]
+	_, err = repo.References.Create(head.SymbolicTarget(), commitId, true, "commit: "+summary)
+	if err != nil {
+		return nil, err
+	}
+	return commitId, nil
+}
+
+// gitBlobId is the id git gives a file with the contents given
+func gitBlobId(contents []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(contents))
+	h.Write(contents)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// gitIntroducingCommit finds the commit that gave the file at path the
+// contents it has in commit, following history back for as long as a
+// parent has the same contents
+func gitIntroducingCommit(commit *git.Commit, path string) (*git.Commit, *git.Oid, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, nil, err
+	}
+	entry, err := tree.EntryByPath(path)
+	if err != nil {
+		return nil, nil, errors.New(path + " has not been committed")
+	}
+	blob := entry.Id
+	for {
+		var same *git.Commit
+		for i := uint(0); i < commit.ParentCount(); i++ {
+			parent := commit.Parent(i)
+			if parentTree, err := parent.Tree(); err == nil {
+				if parentEntry, err := parentTree.EntryByPath(path); err == nil && parentEntry.Id.Equal(blob) {
+					same = parent
+					break
+				}
+			}
+		}
+		if same == nil {
+			return commit, blob, nil
+		}
+		commit = same
+	}
+}
+
+// gitVerifyCommit names who in the keyring signed the commit
+func gitVerifyCommit(commit *git.Commit, keyring Keyring, gpgProgram string) (string, error) {
+	signature, signed, err := commit.ExtractSignature()
+	if err != nil {
+		return "", errors.New("Commit " + commit.Id().String() + " is not signed")
+	}
+	signer, err := trustedSigner(keyring, signature, []byte(signed), gpgProgram)
+	if err != nil {
+		return "", errors.New("Commit " + commit.Id().String() + ": " + err.Error())
+	}
+	return signer, nil
+}
+
+// gitPreviousKeyring finds the nearest ancestor of commit that has the
+// keyring, along with its child on the way back from commit: the commit
+// that replaced the keyring, or deleted it
+func gitPreviousKeyring(commit *git.Commit, path string) (holder, child *git.Commit) {
+	type step struct {
+		commit, child *git.Commit
+	}
+	queue := []step{}
+	for i := uint(0); i < commit.ParentCount(); i++ {
+		queue = append(queue, step{commit.Parent(i), commit})
+	}
+	seen := map[string]bool{}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if seen[next.commit.Id().String()] {
+			continue
+		}
+		seen[next.commit.Id().String()] = true
+		if tree, err := next.commit.Tree(); err == nil {
+			if _, err = tree.EntryByPath(path); err == nil {
+				return next.commit, next.child
+			}
+		}
+		for i := uint(0); i < next.commit.ParentCount(); i++ {
+			queue = append(queue, step{next.commit.Parent(i), next.commit})
+		}
+	}
+	return nil, nil
+}
+
+// gitKeyringRoot finds the commit that introduced the first keyring in
+// the history of commit
+func gitKeyringRoot(commit *git.Commit) (*git.Commit, error) {
+	path := KEYRING_DIR + "/" + KEYRING_FILE
+	for {
+		introduced, _, err := gitIntroducingCommit(commit, path)
+		if err != nil {
+			return nil, errors.New("The repository has no keyring to verify signatures with")
+		}
+		holder, _ := gitPreviousKeyring(introduced, path)
+		if holder == nil {
+			return introduced, nil
+		}
+		commit = holder
+	}
+}
+
+// gitVerifiedKeyring returns the keyring as of commit, having checked
+// that every change to it, including deleting it, was signed by someone
+// in the keyring before; only the keyring introduced by root, which was
+// pinned when verifying was set up, is trusted because it's signed by
+// someone in it
+func gitVerifiedKeyring(repo *git.Repository, commit *git.Commit, root, gpgProgram string) (Keyring, error) {
+	path := KEYRING_DIR + "/" + KEYRING_FILE
+	introduced, blobId, err := gitIntroducingCommit(commit, path)
+	if err != nil {
+		return Keyring{}, errors.New("The repository has no keyring to verify signatures with")
+	}
+	blob, err := repo.LookupBlob(blobId)
+	if err != nil {
+		return Keyring{}, err
+	}
+	keyring := Keyring{}
+	if err = json.Unmarshal(blob.Contents(), &keyring); err != nil {
+		return Keyring{}, errors.New("Unable to read the keyring in commit " + introduced.Id().String() + ": " + err.Error())
+	}
+
+	trusted := keyring
+	if introduced.Id().String() != root {
+		holder, child := gitPreviousKeyring(introduced, path)
+		if holder == nil {
+			return Keyring{}, errors.New("The keyring can't be trusted: commit " + introduced.Id().String() +
+				" started a new keyring, not the one trusted when verifying was set up")
+		}
+		if trusted, err = gitVerifiedKeyring(repo, holder, root, gpgProgram); err != nil {
+			return Keyring{}, err
+		}
+		if !child.Id().Equal(introduced.Id()) {
+			if _, err = gitVerifyCommit(child, trusted, gpgProgram); err != nil {
+				return Keyring{}, errors.New("The keyring can't be trusted: " + err.Error())
+			}
+		}
+	}
+	if _, err = gitVerifyCommit(introduced, trusted, gpgProgram); err != nil {
+		return Keyring{}, errors.New("The keyring can't be trusted: " + err.Error())
+	}
+	return keyring, nil
+}
+
+// gitVerifySignatures says whether credentials in the repository must be
+// verified before they're used
+func gitVerifySignatures(repopath string) bool {
+	isrepo, err := isGitRepo(repopath)
+	if err != nil || !isrepo {
+		return false
+	}
+	repo, err := git.OpenRepository(repopath)
+	if err != nil {
+		return false
+	}
+	config, err := repo.Config()
+	if err != nil {
+		return false
+	}
+	verify, err := config.LookupBool(VERIFY_SIGNATURES_KEY)
+	return err == nil && verify
+}
+
+// verifyIfRequired checks the file, relative to the repository, with
+// verifyCredentialFile if credentials in the repository must be verified
+// before they're used
+func verifyIfRequired(repopath, relpath string) error {
+	if !gitVerifySignatures(repopath) {
+		return nil
+	}
+	_, err := verifyCredentialFile(repopath, relpath)
+	return err
+}
+
+// verifyCredentialFile checks that the file, relative to the repository,
+// is as it was committed, by someone in the keyring; it returns who
+func verifyCredentialFile(repopath, relpath string) (string, error) {
+	repo, err := git.OpenRepository(repopath)
+	if err != nil {
+		return "", err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", errors.New("Nothing has been committed in " + repopath)
+	}
+	commit, err := repo.LookupCommit(head.Target())
+	if err != nil {
+		return "", err
+	}
+	gpgProgram := "gpg"
+	if config, err := repo.Config(); err == nil {
+		if program, err := config.LookupString("gpg.program"); err == nil && program != "" {
+			gpgProgram = program
+		}
+	}
+
+	root := ""
+	if config, err := repo.Config(); err == nil {
+		root, _ = config.LookupString(KEYRING_ROOT_KEY)
+	}
+	if root == "" {
+		return "", errors.New("No keyring has been trusted for " + repopath +
+			"; run 'credulous repo signing --verify' to trust the one it has")
+	}
+	keyring, err := gitVerifiedKeyring(repo, commit, root, gpgProgram)
+	if err != nil {
+		return "", err
+	}
+	introduced, blobId, err := gitIntroducingCommit(commit, filepath.ToSlash(relpath))
+	if err != nil {
+		return "", err
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(repopath, relpath))
+	if err != nil {
+		return "", err
+	}
+	if gitBlobId(contents) != blobId.String() {
+		return "", errors.New(relpath + " has been changed since it was committed")
+	}
+	signer, err := gitVerifyCommit(introduced, keyring, gpgProgram)
+	if err != nil {
+		return "", errors.New("Unable to verify " + relpath + ": " + err.Error())
+	}
+	return signer, nil
+}
+
+// gitSetSigning has commits in the repository signed with the key given,
+// in gpg.format format, or stops signing them if format is ""
+func gitSetSigning(repopath, format, key string) error {
+	repo, err := git.OpenRepository(repopath)
+	if err != nil {
+		return err
+	}
+	config, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	if format == "" {
+		return config.SetBool("commit.gpgsign", false)
+	}
+	if err = config.SetString("gpg.format", format); err != nil {
+		return err
+	}
+	if err = config.SetString("user.signingkey", key); err != nil {
+		return err
+	}
+	return config.SetBool("commit.gpgsign", true)
+}
+
+// gitSetVerifySignatures turns verifying on or off; turning it on pins
+// the commit that introduced the repository's first keyring, which is
+// then the only keyring trusted without a signature from the one before
+func gitSetVerifySignatures(repopath string, verify bool) error {
+	repo, err := git.OpenRepository(repopath)
+	if err != nil {
+		return err
+	}
+	config, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	if verify {
+		head, err := repo.Head()
+		if err != nil {
+			return errors.New("Nothing has been committed in " + repopath)
+		}
+		commit, err := repo.LookupCommit(head.Target())
+		if err != nil {
+			return err
+		}
+		root, err := gitKeyringRoot(commit)
+		if err != nil {
+			return err
+		}
+		if err = config.SetString(KEYRING_ROOT_KEY, root.Id().String()); err != nil {
+			return err
+		}
+	}
+	return config.SetBool(VERIFY_SIGNATURES_KEY, verify)
+}
+
+// describeSigning says how commits in the repository are signed, and
+// whether credentials are verified
+func describeSigning(repopath string) (string, error) {
+	repo, err := git.OpenRepository(repopath)
+	if err != nil {
+		return "", err
+	}
+	signer, err := gitCommitSigner(repo)
+	if err != nil {
+		return "", err
+	}
+	description := "Commits are not signed"
+	if signer != nil && signer.format == "ssh" {
+		description = "Commits are signed with the SSH key " + signer.key
+	} else if signer != nil {
+		description = "Commits are signed with " + signer.gpgProgram
+		if signer.key != "" {
+			description += ", using the OpenPGP key " + signer.key
+		}
+	}
+	if gitVerifySignatures(repopath) {
+		return description + "; credentials are verified before they're used", nil
+	}
+	return description + "; credentials are not verified", nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSigning(t *testing.T) {
+	Convey("Test signing commits and verifying their signatures", t, func() {
+		defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+		os.Setenv("SSH_AUTH_SOCK", "")
+		content := []byte("tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n" +
+			"author Ford Prefect <ford@example.com> 1402531200 +1000\n" +
+			"committer Ford Prefect <ford@example.com> 1402531200 +1000\n\n" +
+			"Credentials saved by Credulous")
+
+		keyring := Keyring{}
+		for _, name := range []string{"testkey", "testkey_ed25519", "testkey_ecdsa"} {
+			recipient, err := newRecipient(name, "", "testdata/"+name+".pub")
+			panic_the_err(err)
+			keyring.Recipients = append(keyring.Recipients, recipient)
+		}
+
+		Convey("Commits are signed with SSH keys as git would sign them", func() {
+			for _, recipient := range keyring.Recipients {
+				signer := commitSigner{format: "ssh", key: "testdata/" + recipient.Name + ".pub"}
+				signature, err := signer.sign(content)
+				So(err, ShouldEqual, nil)
+				So(signature, ShouldStartWith, SSHSIG_BEGIN)
+
+				name, err := trustedSigner(keyring, signature, content, "gpg")
+				So(err, ShouldEqual, nil)
+				So(name, ShouldEqual, recipient.Name)
+
+				_, err = trustedSigner(keyring, signature, append(content, '!'), "gpg")
+				So(err, ShouldNotEqual, nil)
+			}
+		})
+
+		Convey("Only signatures by someone in the keyring are trusted", func() {
+			signer := commitSigner{format: "ssh", key: "testdata/testkey_ed25519"}
+			signature, err := signer.sign(content)
+			So(err, ShouldEqual, nil)
+			_, err = trustedSigner(Keyring{Recipients: keyring.Recipients[:1]}, signature, content, "gpg")
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "not in the keyring")
+		})
+
+		Convey("Signatures for something else aren't accepted", func() {
+			privkey, err := loadPrivateKey("testdata/testkey_ed25519")
+			panic_the_err(err)
+			sshSigner, err := ssh.NewSignerFromSigner(privkey)
+			panic_the_err(err)
+			data, err := sshSignedBytes("file", "sha512", content)
+			panic_the_err(err)
+			sig, err := sshSigner.Sign(rand.Reader, data)
+			panic_the_err(err)
+			signature, err := signSSH(content, sshSigner.PublicKey(), func([]byte) (*ssh.Signature, error) {
+				return sig, nil
+			})
+			panic_the_err(err)
+			_, err = verifySSHSignature(signature, content)
+			So(err, ShouldNotEqual, nil)
+			_, err = verifySSHSignature("not a signature", content)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Signatures are added to commits as git adds them", func() {
+			signed := addCommitSignature(content, SSHSIG_BEGIN+"\nAAAA\n"+SSHSIG_END+"\n")
+			lines := strings.Split(string(signed), "\n")
+			So(lines[3], ShouldEqual, "gpgsig "+SSHSIG_BEGIN)
+			So(lines[4], ShouldEqual, " AAAA")
+			So(lines[5], ShouldEqual, " "+SSHSIG_END)
+			So(lines[6], ShouldEqual, "")
+			So(lines[7], ShouldEqual, "Credentials saved by Credulous")
+		})
+
+		So(gitBlobId([]byte("hello\n")), ShouldEqual, "ce013625030ba8dba906f756967f9e9ca394464a")
+		So(parseGPGStatus([]byte("[GNUPG:] NEWSIG\n"+
+			"[GNUPG:] VALIDSIG 0123456789ABCDEF0123456789ABCDEF01234567 2014-06-12 1402531200 0 4 0 1 8 00 "+
+			"FEDCBA9876543210FEDCBA9876543210FEDCBA98\n")), ShouldResemble, []string{
+			"0123456789ABCDEF0123456789ABCDEF01234567", "FEDCBA9876543210FEDCBA9876543210FEDCBA98",
+		})
+		So(normalizePGPFingerprint("fedc ba98 7654 3210"), ShouldEqual, "FEDCBA9876543210")
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// An ssh-agent won't decrypt anything for us, but it will sign things. If
+// the signature is deterministic (RSA PKCS#1 v1.5 and ed25519 signatures
+// are; ECDSA signatures are not), then signing the same random challenge
+// always produces the same bytes, which we can turn into an AES key. So
+// alongside the usual entry for each public key, credulous saves a second
+// entry with Scheme set to SCHEME_AGENT whenever the agent holds that key.
+const SCHEME_AGENT string = "ssh-agent"
+
+// prefixed to the challenge before signing, so that the signature can't
+// be mistaken for (or obtained as) one for SSH authentication
+const AGENT_SIGNATURE_NAMESPACE string = "credulous-ssh-agent-v1\x00"
+
+type AgentEncryption struct {
+	Challenge       string
+	SignatureFormat string
+	Ciphertext      string
+}
+
+// connectSSHAgent returns nil if there's no agent to talk to
+func connectSSHAgent() (agent.ExtendedAgent, io.Closer) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, nil
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		log.Print("WARNING: Unable to connect to ssh-agent: " + err.Error())
+		return nil, nil
+	}
+	return agent.NewClient(conn), conn
+}
+
+// agentHasKey looks for the key with the given fingerprint in the agent
+func agentHasKey(sshAgent agent.ExtendedAgent, fingerprint string) (ssh.PublicKey, error) {
+	keys, err := sshAgent.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		pubkey, err := ssh.ParsePublicKey(key.Marshal())
+		if err != nil {
+			continue
+		}
+		if fingerprintMatches(fingerprint, pubkey) {
+			return pubkey, nil
+		}
+	}
+	return nil, nil
+}
+
+func agentSign(sshAgent agent.ExtendedAgent, pubkey ssh.PublicKey, challenge []byte) (*ssh.Signature, error) {
+	data := append([]byte(AGENT_SIGNATURE_NAMESPACE), challenge...)
+	var flags agent.SignatureFlags
+	if pubkey.Type() == ssh.KeyAlgoRSA {
+		// pin the hash, since the agent's default may change
+		flags = agent.SignatureFlagRsaSha256
+	}
+	return sshAgent.SignWithFlags(pubkey, data, flags)
+}
+
+func deriveAgentKey(sig *ssh.Signature, challenge []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, sig.Blob, challenge, "Credulous "+SCHEME_AGENT, 32)
+}
+
+// agentEncode returns ok == false if the agent doesn't hold the key, or
+// can't produce deterministic signatures with it
+func agentEncode(plaintext string, pubkey ssh.PublicKey, additionalData []byte, sshAgent agent.ExtendedAgent) (ciphertext string, ok bool, err error) {
+	if pubkey.Type() != ssh.KeyAlgoRSA && pubkey.Type() != ssh.KeyAlgoED25519 {
+		return "", false, nil
+	}
+	agentKey, err := agentHasKey(sshAgent, SSHFingerprint(pubkey))
+	if err != nil || agentKey == nil {
+		return "", false, err
+	}
+
+	challenge := make([]byte, 32)
+	_, err = rand.Read(challenge)
+	if err != nil {
+		return "", false, err
+	}
+
+	sig, err := agentSign(sshAgent, agentKey, challenge)
+	if err != nil {
+		return "", false, err
+	}
+	// a hardware token might well randomise its signatures; if so, this
+	// scheme can't work, and the credentials would be unreadable via the agent
+	again, err := agentSign(sshAgent, agentKey, challenge)
+	if err != nil {
+		return "", false, err
+	}
+	if sig.Format != again.Format || !bytes.Equal(sig.Blob, again.Blob) {
+		log.Print("WARNING: ssh-agent signatures for " + SSHFingerprint(pubkey) + " are not deterministic; not saving an agent-decryptable copy")
+		return "", false, nil
+	}
+
+	aesKey, err := deriveAgentKey(sig, challenge)
+	if err != nil {
+		return "", false, err
+	}
+	encoded, err := encodeAESGCM(aesKey, plaintext, additionalData)
+	if err != nil {
+		return "", false, err
+	}
+
+	tmp, err := json.Marshal(AgentEncryption{
+		Challenge:       base64.StdEncoding.EncodeToString(challenge),
+		SignatureFormat: sig.Format,
+		Ciphertext:      encoded,
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return base64.StdEncoding.EncodeToString(tmp), true, nil
+}
+
+func agentDecode(enc Encryption, additionalData []byte, sshAgent agent.ExtendedAgent) (plaintext string, err error) {
+	agentKey, err := agentHasKey(sshAgent, enc.Fingerprint)
+	if err != nil {
+		return "", err
+	}
+	if agentKey == nil {
+		return "", errors.New("The ssh-agent does not hold the key " + enc.Fingerprint)
+	}
+
+	in, err := base64.StdEncoding.DecodeString(enc.Ciphertext)
+	if err != nil {
+		return "", err
+	}
+	var encrypted AgentEncryption
+	err = json.Unmarshal(in, &encrypted)
+	if err != nil {
+		return "", err
+	}
+	challenge, err := base64.StdEncoding.DecodeString(encrypted.Challenge)
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := agentSign(sshAgent, agentKey, challenge)
+	if err != nil {
+		return "", err
+	}
+	if sig.Format != encrypted.SignatureFormat {
+		return "", fmt.Errorf("The ssh-agent produced a %s signature, but these credentials need %s", sig.Format, encrypted.SignatureFormat)
+	}
+
+	aesKey, err := deriveAgentKey(sig, challenge)
+	if err != nil {
+		return "", err
+	}
+	return decodeAESGCM(aesKey, encrypted.Ciphertext, additionalData)
+}
+
+// decryptWithAgent tries each agent entry in turn; it returns an empty
+// plaintext (and no error) if the agent can't decrypt any of them, so
+// that the caller can fall back to reading a private key
+func decryptWithAgent(creds Credentials, additionalData []byte) (string, ssh.PublicKey) {
+	sshAgent, conn := connectSSHAgent()
+	if sshAgent == nil {
+		return "", nil
+	}
+	defer conn.Close()
+
+	for _, enc := range creds.Encryptions {
+		if enc.Scheme != SCHEME_AGENT {
+			continue
+		}
+		agentKey, err := agentHasKey(sshAgent, enc.Fingerprint)
+		if err != nil || agentKey == nil {
+			continue
+		}
+		plaintext, err := agentDecode(enc, additionalData, sshAgent)
+		if err != nil {
+			log.Print("WARNING: Unable to decrypt using ssh-agent: " + err.Error())
+			continue
+		}
+		return plaintext, agentKey
+	}
+	return "", nil
+}
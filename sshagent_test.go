@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func testAgentWithKey(name string) agent.ExtendedAgent {
+	privkey, err := loadPrivateKey(name)
+	panic_the_err(err)
+	keyring := agent.NewKeyring()
+	err = keyring.Add(agent.AddedKey{PrivateKey: privkey})
+	panic_the_err(err)
+	return keyring.(agent.ExtendedAgent)
+}
+
+func TestAgentEncodeDecode(t *testing.T) {
+	Convey("Test encrypting and decrypting via ssh-agent", t, func() {
+		for _, name := range []string{"testdata/testkey", "testdata/testkey_ed25519"} {
+			sshAgent := testAgentWithKey(name)
+			pubkey, err := readSSHPubkeyFile(name + ".pub")
+			panic_the_err(err)
+
+			ciphertext, ok, err := agentEncode("some plaintext", pubkey, []byte("metadata"), sshAgent)
+			So(err, ShouldEqual, nil)
+			So(ok, ShouldBeTrue)
+
+			enc := Encryption{
+				Fingerprint: SSHFingerprint(pubkey),
+				Scheme:      SCHEME_AGENT,
+				Ciphertext:  ciphertext,
+			}
+			plaintext, err := agentDecode(enc, []byte("metadata"), sshAgent)
+			So(err, ShouldEqual, nil)
+			So(plaintext, ShouldEqual, "some plaintext")
+
+			_, err = agentDecode(enc, []byte("tampered"), sshAgent)
+			So(err, ShouldNotEqual, nil)
+		}
+	})
+
+	Convey("Test ECDSA keys are not used via ssh-agent", t, func() {
+		sshAgent := testAgentWithKey("testdata/testkey_ecdsa")
+		pubkey, err := readSSHPubkeyFile("testdata/testkey_ecdsa.pub")
+		panic_the_err(err)
+		_, ok, err := agentEncode("some plaintext", pubkey, []byte("metadata"), sshAgent)
+		So(err, ShouldEqual, nil)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Test keys the agent doesn't hold", t, func() {
+		sshAgent := testAgentWithKey("testdata/testkey_ed25519")
+		pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+		panic_the_err(err)
+		_, ok, err := agentEncode("some plaintext", pubkey, []byte("metadata"), sshAgent)
+		So(err, ShouldEqual, nil)
+		So(ok, ShouldBeFalse)
+
+		enc := Encryption{Fingerprint: SSHFingerprint(pubkey), Scheme: SCHEME_AGENT}
+		_, err = agentDecode(enc, []byte("metadata"), sshAgent)
+		So(err, ShouldNotEqual, nil)
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Temporary credentials (those with a session token) can't identify
+// themselves through IAM, since their access key doesn't belong to any
+// IAM user, so they're identified through STS instead
+const STS_API_VERSION string = "2011-06-15"
+
+func newSTSClient(cred Credential, config AWSConfig) awsQuery {
+	return awsQuery{
+		cred:     cred,
+		service:  "sts",
+		region:   config.Region,
+		endpoint: config.STSEndpoint,
+		version:  STS_API_VERSION,
+	}
+}
+
+type CallerIdentity struct {
+	Account string
+	Arn     string
+	UserId  string
+}
+
+type getCallerIdentityResponse struct {
+	Result CallerIdentity `xml:"GetCallerIdentityResult"`
+}
+
+func getCallerIdentity(client awsQuery) (CallerIdentity, error) {
+	var resp getCallerIdentityResponse
+	err := client.call("GetCallerIdentity", nil, &resp)
+	if err != nil {
+		return CallerIdentity{}, err
+	}
+	return resp.Result, nil
+}
+
+// Name returns the name credentials for this identity are saved under:
+// the name of an IAM or federated user, the name of an assumed role, or
+// the account ID for the root user (just as for its long-term keys,
+// where the username is the same as the account)
+func (id CallerIdentity) Name() (string, error) {
+	parts := strings.SplitN(id.Arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" {
+		return "", errors.New("Cannot parse ARN " + id.Arn)
+	}
+	resource := parts[5]
+	fields := strings.Split(resource, "/")
+	switch {
+	case resource == "root":
+		return id.Account, nil
+	case fields[0] == "user" && len(fields) >= 2:
+		// IAM user names may have a path, as in user/path/to/name
+		return fields[len(fields)-1], nil
+	case fields[0] == "assumed-role" && len(fields) >= 2:
+		return fields[1], nil
+	case fields[0] == "federated-user" && len(fields) == 2:
+		return fields[1], nil
+	}
+	return "", errors.New("Cannot find a name in ARN " + id.Arn)
+}
+
+// getSTSUsernameAndAccount is the equivalent of getAWSUsernameAndAlias
+// for temporary credentials; since account aliases are only available
+// through IAM, the account is always its ID
+func getSTSUsernameAndAccount(client awsQuery) (username, account string, err error) {
+	id, err := getCallerIdentity(client)
+	if err != nil {
+		return "", "", err
+	}
+	username, err = id.Name()
+	if err != nil {
+		return "", "", err
+	}
+	return username, id.Account, nil
+}
+
+// the credentials returned by AssumeRole, GetSessionToken and friends
+type stsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      string
+}
+
+func (c stsCredentials) credential() Credential {
+	return Credential{
+		KeyId:        c.AccessKeyId,
+		SecretKey:    c.SecretAccessKey,
+		SessionToken: c.SessionToken,
+		Expiration:   c.Expiration,
+	}
+}
+
+type assumeRoleResponse struct {
+	Result struct {
+		Credentials stsCredentials
+	} `xml:"AssumeRoleResult"`
+}
+
+func assumeRole(client awsQuery, profile RoleProfile, sessionName string) (Credential, error) {
+	params := url.Values{}
+	params.Set("RoleArn", profile.RoleArn)
+	params.Set("RoleSessionName", sessionName)
+	if profile.ExternalId != "" {
+		params.Set("ExternalId", profile.ExternalId)
+	}
+	if profile.DurationSeconds != 0 {
+		params.Set("DurationSeconds", strconv.Itoa(profile.DurationSeconds))
+	}
+
+	var resp assumeRoleResponse
+	err := client.call("AssumeRole", params, &resp)
+	if err != nil {
+		return Credential{}, err
+	}
+	return resp.Result.Credentials.credential(), nil
+}
+
+type getSessionTokenResponse struct {
+	Result struct {
+		Credentials stsCredentials
+	} `xml:"GetSessionTokenResult"`
+}
+
+// getSessionToken exchanges long-term credentials and an MFA code for
+// session credentials; a durationSeconds of 0 means the STS default
+func getSessionToken(client awsQuery, serialNumber, tokenCode string, durationSeconds int) (Credential, error) {
+	params := url.Values{}
+	params.Set("SerialNumber", serialNumber)
+	params.Set("TokenCode", tokenCode)
+	if durationSeconds != 0 {
+		params.Set("DurationSeconds", strconv.Itoa(durationSeconds))
+	}
+
+	var resp getSessionTokenResponse
+	err := client.call("GetSessionToken", params, &resp)
+	if err != nil {
+		return Credential{}, err
+	}
+	return resp.Result.Credentials.credential(), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCallerIdentityName(t *testing.T) {
+	Convey("Test finding names in caller identity ARNs", t, func() {
+		names := map[string]string{
+			"arn:aws:iam::123456789012:user/bob":                       "bob",
+			"arn:aws:iam::123456789012:user/division/team/bob":         "bob",
+			"arn:aws:sts::123456789012:assumed-role/Deployer/session1": "Deployer",
+			"arn:aws:sts::123456789012:federated-user/carol":           "carol",
+			"arn:aws:iam::123456789012:root":                           "123456789012",
+		}
+		for arn, name := range names {
+			id := CallerIdentity{Account: "123456789012", Arn: arn}
+			result, err := id.Name()
+			So(err, ShouldEqual, nil)
+			So(result, ShouldEqual, name)
+		}
+
+		for _, arn := range []string{"not an arn", "arn:aws:iam::123456789012:group/admins"} {
+			_, err := CallerIdentity{Arn: arn}.Name()
+			So(err, ShouldNotEqual, nil)
+		}
+	})
+}
+
+func TestGetSTSUsernameAndAccount(t *testing.T) {
+	Convey("Test identifying temporary credentials through STS", t, func() {
+		var form map[string][]string
+		var token string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			form = r.PostForm
+			token = r.Header.Get("X-Amz-Security-Token")
+			w.Write([]byte(`<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Arn>arn:aws:sts::123456789012:assumed-role/Deployer/session1</Arn>
+    <UserId>AROAEXAMPLE:session1</UserId>
+    <Account>123456789012</Account>
+  </GetCallerIdentityResult>
+  <ResponseMetadata><RequestId>abc123</RequestId></ResponseMetadata>
+</GetCallerIdentityResponse>`))
+		}))
+		defer server.Close()
+
+		client := newSTSClient(Credential{KeyId: "ASIAtest", SecretKey: "secret", SessionToken: "token"},
+			AWSConfig{Region: "us-east-1", STSEndpoint: server.URL})
+		username, account, err := getSTSUsernameAndAccount(client)
+		So(err, ShouldEqual, nil)
+		So(username, ShouldEqual, "Deployer")
+		So(account, ShouldEqual, "123456789012")
+		So(form["Action"], ShouldResemble, []string{"GetCallerIdentity"})
+		So(form["Version"], ShouldResemble, []string{STS_API_VERSION})
+		So(token, ShouldEqual, "token")
+
+		Convey("Temporary credentials are saved as STS identifies them, whatever account is given", func() {
+			repo, err := ioutil.TempDir("", "credulous-sts")
+			panic_the_err(err)
+			defer os.RemoveAll(repo)
+			pubkey, err := readSSHPubkeyFile("testdata/testkey.pub")
+			panic_the_err(err)
+			err = SaveCredentials(SaveData{
+				cred:    Credential{KeyId: "ASIAEXAMPLEKEY123456", SecretKey: "secret", SessionToken: "token"},
+				alias:   "frood",
+				pubkeys: []ssh.PublicKey{pubkey},
+				repo:    repo,
+				config:  AWSConfig{Region: "us-east-1", STSEndpoint: server.URL},
+			})
+			So(err, ShouldEqual, nil)
+			creds, err := RetrieveCredentials(repo, "123456789012", "Deployer", "testdata/testkey")
+			So(err, ShouldEqual, nil)
+			So(creds.AccountAliasOrId, ShouldEqual, "123456789012")
+			_, err = os.Stat(filepath.Join(repo, "frood"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}